@@ -0,0 +1,292 @@
+package clientconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/metadata/client"
+	"github.com/nicolagi/dino/quota"
+	"github.com/nicolagi/dino/storage"
+	"github.com/nicolagi/dino/tlsconfig"
+	"github.com/nicolagi/dino/volume"
+	"github.com/rogpeppe/rjson"
+)
+
+// Config is embedded in the configuration of each client, which adds its own
+// properties.
+type Config struct {
+	Debug bool `json:"debug"`
+
+	// Whether to keep track of bytes and inodes used, per user and per volume,
+	// and enforce the limits set with the quota command. All clients sharing a
+	// volume should agree on this, or usage counters will be inaccurate.
+	Quota bool `json:"quota"`
+
+	// Contents of files and symlinks smaller than this many bytes are stored
+	// in the metadata, rather than as blobs, saving a round trip to the blob
+	// store to read them. Zero (the default) disables inlining, which clients
+	// from before inlining was introduced can't read.
+	InlineThreshold int `json:"inline_threshold"`
+
+	// If set, the path to a file containing a hex-encoded 256-bit key, used to
+	// encrypt blobs and metadata before they are sent to the remote stores. All
+	// clients sharing a volume need the same key.
+	Keyfile string `json:"keyfile"`
+
+	// Whether to encrypt blobs deterministically, so that identical contents
+	// put by different clients are stored once, at the cost of revealing to
+	// the blob store which blobs are identical.
+	Convergent bool `json:"convergent"`
+
+	// Identifies this client, in the nodes it changes, to the processes
+	// following change events on other clients, and to the metadata server.
+	// Defaults to "user@host".
+	Origin string `json:"origin"`
+
+	// Used for the metadata and blob servers with tls set: the certificate
+	// authorities to trust (the system ones if unset), and the certificate to
+	// present, if the servers require one.
+	TLS struct {
+		CA   string `json:"ca"`
+		Cert string `json:"cert"`
+		Key  string `json:"key"`
+	} `json:"tls"`
+
+	Metadata struct {
+		Type string `json:"type"`
+
+		// Only used by dinofs. If set, e.g., to "100ms", metadata changes are
+		// collected for that long, or until fsync, and committed in batches,
+		// rather than synchronously at each mutation.
+		WriteBehind string `json:"write_behind"`
+
+		// Properties for "dino" type.
+		Address string `json:"address"`
+
+		// More metadata servers to fail over to, e.g., the others of a
+		// replicated group. The first one available is used, address first,
+		// and those that couldn't be reached are backed off from.
+		Addresses []string `json:"addresses"`
+
+		// Shared with the metadata server, which uses it to authenticate this
+		// client by its origin, if it requires authentication.
+		Secret string `json:"secret"`
+
+		// Whether the metadata server is served over TLS.
+		TLS bool `json:"tls"`
+
+		// Properties for "dynamodb" type.
+		Profile string `json:"profile"`
+		Region  string `json:"region"`
+		Table   string `json:"table"`
+	} `json:"metadata"`
+
+	Blobs struct {
+		Type string `json:"type"`
+
+		// Whether to compress blobs, both in the local cache and in the
+		// remote store. Blobs put uncompressed remain readable.
+		Compress bool `json:"compress"`
+
+		// How file contents are laid out in blobs: "whole" (the default),
+		// one blob per file, or "chunked", split into chunks at
+		// content-defined boundaries, so that similar files share most
+		// chunks. Either layout can read blobs put with the other.
+		Layout string `json:"layout"`
+
+		// Properties for "dino" type.
+		Address string `json:"address"`
+
+		// Whether the blob server is served over TLS.
+		TLS bool `json:"tls"`
+
+		// Sent to the blob server, if it requires a token.
+		Token string `json:"token"`
+
+		// Properties for "s3" type.
+		Profile string `json:"profile"`
+		Region  string `json:"region"`
+		Bucket  string `json:"bucket"`
+	} `json:"blobs"`
+}
+
+// Load decodes the configuration file into c, a pointer to the client's
+// configuration. If the file doesn't exist, pathname is taken as an alias,
+// which expands to $HOME/lib/dino/fs-ALIAS.config.
+func Load(pathname string, c interface{}) error {
+	f, err := os.Open(pathname)
+	if os.IsNotExist(err) {
+		f, err = os.Open(os.ExpandEnv(fmt.Sprintf("$HOME/lib/dino/fs-%s.config", pathname)))
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return rjson.NewDecoder(f).Decode(c)
+}
+
+// ApplyDefaults sets the properties that are missing, and have a default.
+func (c *Config) ApplyDefaults() {
+	if c.Origin == "" {
+		c.Origin = volume.DefaultOrigin()
+	}
+}
+
+// ClientTLS returns the TLS configuration to connect to the servers with.
+func (c *Config) ClientTLS() (*tls.Config, error) {
+	return tlsconfig.Client(os.ExpandEnv(c.TLS.CA), os.ExpandEnv(c.TLS.Cert), os.ExpandEnv(c.TLS.Key))
+}
+
+// MetadataAddresses returns the metadata servers to connect to, in order of
+// preference.
+func (c *Config) MetadataAddresses() []string {
+	if c.Metadata.Address == "" {
+		return c.Metadata.Addresses
+	}
+	return append([]string{c.Metadata.Address}, c.Metadata.Addresses...)
+}
+
+// VersionedStore builds the metadata store, encrypted if there's a key. The
+// listener, if not nil, is called with the changes made by other clients, if
+// the store learns of them. The returned function stops the store.
+func (c *Config) VersionedStore(listener storage.ChangeListener) (store storage.VersionedStore, close func(), err error) {
+	switch c.Metadata.Type {
+	case "dino":
+		opts := []client.Option{
+			client.WithAddresses(c.MetadataAddresses()...),
+			client.WithName(c.Origin),
+			client.WithSecret([]byte(c.Metadata.Secret)),
+		}
+		if c.Metadata.TLS {
+			tlsConfig, err := c.ClientTLS()
+			if err != nil {
+				return nil, nil, err
+			}
+			opts = append(opts, client.WithTLS(tlsConfig))
+		}
+		s := storage.NewRemoteVersionedStore(client.New(opts...), storage.WithChangeListener(listener))
+		s.Start()
+		store, close = s, s.Stop
+	case "dynamodb":
+		store, err = storage.NewDynamoDBVersionedStore(
+			c.Metadata.Profile,
+			c.Metadata.Region,
+			c.Metadata.Table,
+			storage.WithChangeListener(listener),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		close = func() {}
+	default:
+		return nil, nil, fmt.Errorf("%q: unknown metadata type", c.Metadata.Type)
+	}
+	if c.Keyfile == "" {
+		return store, close, nil
+	}
+	key, err := storage.LoadKey(os.ExpandEnv(c.Keyfile))
+	if err == nil {
+		store, err = storage.NewEncryptedVersionedStore(store, key)
+	}
+	if err != nil {
+		close()
+		return nil, nil, err
+	}
+	return store, close, nil
+}
+
+// RemoteStore builds the store that blobs are put in, encrypted if there's a
+// key. dinofs caches it locally; see BlobStore.
+func (c *Config) RemoteStore() (store storage.Store, err error) {
+	switch c.Blobs.Type {
+	case "dino":
+		opts := []storage.RemoteStoreOption{storage.WithRemoteToken(c.Blobs.Token)}
+		if c.Blobs.TLS {
+			tlsConfig, err := c.ClientTLS()
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, storage.WithRemoteTLS(tlsConfig))
+		}
+		store = storage.NewRemoteStore(c.Blobs.Address, opts...)
+	case "s3":
+		store, err = storage.NewS3Store(c.Blobs.Profile, c.Blobs.Region, c.Blobs.Bucket)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%q: unknown blobs type", c.Blobs.Type)
+	}
+	if c.Keyfile == "" {
+		return store, nil
+	}
+	key, err := storage.LoadKey(os.ExpandEnv(c.Keyfile))
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewEncryptedStore(store, key, c.Convergent)
+}
+
+// BlobStore builds the blob store on top of the given store, e.g., the one
+// returned by RemoteStore, compressing and chunking contents as configured.
+func (c *Config) BlobStore(store storage.Store) (storage.BlobStore, error) {
+	if c.Blobs.Compress {
+		store = storage.NewCompressedStore(store)
+	}
+	var sizes storage.ChunkSizes
+	switch c.Blobs.Layout {
+	case "", "whole":
+		// The zero sizes never split contents, but allow reading contents
+		// stored with the chunked layout.
+	case "chunked":
+		sizes = storage.DefaultChunkSizes
+	default:
+		return nil, fmt.Errorf("%q: unknown blobs layout", c.Blobs.Layout)
+	}
+	return storage.NewChunkedBlobStore(storage.NewBlobStore(store), sizes)
+}
+
+// OpenVolume builds the stores, without a local cache of blobs, and returns
+// the volume in them, charging quotas if enabled. The returned function stops
+// the metadata store.
+func (c *Config) OpenVolume(opts ...volume.Option) (v *volume.FS, close func(), err error) {
+	if c.InlineThreshold > volume.MaxInlineThreshold {
+		return nil, nil, fmt.Errorf("inline threshold %d larger than %d", c.InlineThreshold, volume.MaxInlineThreshold)
+	}
+	remote, err := c.RemoteStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	blobs, err := c.BlobStore(remote)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The tracker needs the store, which may receive changes right away.
+	var mu sync.Mutex
+	var quotas *quota.Tracker
+	metadata, close, err := c.VersionedStore(func(m message.Message) {
+		mu.Lock()
+		q := quotas
+		mu.Unlock()
+		if q != nil && quota.IsKey([]byte(m.Key())) {
+			q.Invalidate([]byte(m.Key()))
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	opts = append([]volume.Option{
+		volume.WithInlineThreshold(c.InlineThreshold),
+		volume.WithOrigin(c.Origin),
+	}, opts...)
+	if c.Quota {
+		mu.Lock()
+		quotas = quota.NewTracker(metadata)
+		mu.Unlock()
+		opts = append(opts, volume.WithQuotas(quotas))
+	}
+	return volume.New(metadata, blobs, opts...), close, nil
+}
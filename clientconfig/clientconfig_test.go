@@ -0,0 +1,58 @@
+package clientconfig_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/nicolagi/dino/clientconfig"
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	pathname := filepath.Join(t.TempDir(), "fs-test.config")
+	require.Nil(t, ioutil.WriteFile(pathname, []byte(`{
+		mountpoint: "/n/test"
+		quota: true
+		origin: "glenda@plan9"
+		metadata: {
+			type: "dino"
+			address: "localhost:6660"
+			addresses: ["localhost:6661"]
+		}
+		blobs: {
+			type: "dino"
+			layout: "chunked"
+		}
+	}`), 0600))
+	var c struct {
+		clientconfig.Config
+		Mountpoint string `json:"mountpoint"`
+	}
+	require.Nil(t, clientconfig.Load(pathname, &c))
+	assert.Equal(t, "/n/test", c.Mountpoint)
+	assert.True(t, c.Quota)
+	assert.Equal(t, "glenda@plan9", c.Origin)
+	assert.Equal(t, []string{"localhost:6660", "localhost:6661"}, c.MetadataAddresses())
+	assert.Equal(t, "chunked", c.Blobs.Layout)
+}
+
+func TestBlobStore(t *testing.T) {
+	var c clientconfig.Config
+	store := storage.NewInMemoryStore()
+	for _, layout := range []string{"", "whole", "chunked"} {
+		c.Blobs.Layout = layout
+		blobs, err := c.BlobStore(store)
+		require.Nil(t, err, layout)
+		key, err := blobs.Put([]byte("content"))
+		require.Nil(t, err, layout)
+		value, err := blobs.Get(key)
+		require.Nil(t, err, layout)
+		assert.Equal(t, "content", string(value), layout)
+	}
+	c.Blobs.Layout = "shredded"
+	_, err := c.BlobStore(store)
+	assert.NotNil(t, err)
+}
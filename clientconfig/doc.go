@@ -0,0 +1,4 @@
+// Package clientconfig holds the configuration shared by the clients of a
+// volume (dinofs, dinodav and dino9p), and builds the stores it describes, so
+// that the same file can configure all of them.
+package clientconfig // import "github.com/nicolagi/dino/clientconfig"
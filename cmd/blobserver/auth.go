@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type access int
+
+const (
+	readOnly access = iota
+	readWrite
+)
+
+type token struct {
+	value  string
+	name   string
+	access access
+}
+
+// Checks requests against the configured bearer tokens. With no tokens, any
+// request is allowed.
+type authorizer struct {
+	tokens []token
+}
+
+func newAuthorizer(c *config) (*authorizer, error) {
+	a := new(authorizer)
+	for value, t := range c.Tokens {
+		var level access
+		switch t.Access {
+		case "read-only":
+			level = readOnly
+		case "read-write":
+			level = readWrite
+		default:
+			return nil, fmt.Errorf("token %q: %q: unknown access, expecting read-only or read-write", t.Name, t.Access)
+		}
+		a.tokens = append(a.tokens, token{value: value, name: t.Name, access: level})
+	}
+	return a, nil
+}
+
+// Returns the name of the token the request was sent with, if any, and, if the
+// request isn't allowed, the status to reply with.
+func (a *authorizer) check(r *http.Request) (name string, status int) {
+	if len(a.tokens) == 0 {
+		return "", http.StatusOK
+	}
+	t := a.lookup(r.Header.Get("Authorization"))
+	if t == nil {
+		return "", http.StatusUnauthorized
+	}
+	if t.access == readOnly && r.Method != http.MethodGet {
+		return t.name, http.StatusForbidden
+	}
+	return t.name, http.StatusOK
+}
+
+// Compares all tokens, in constant time, so that timing doesn't reveal how
+// close a guess is.
+func (a *authorizer) lookup(header string) *token {
+	const prefix = "Bearer "
+	if !strings.HasPrefix(header, prefix) {
+		return nil
+	}
+	value := []byte(header[len(prefix):])
+	var found *token
+	for i := range a.tokens {
+		if subtle.ConstantTimeCompare(value, []byte(a.tokens[i].value)) == 1 {
+			found = &a.tokens[i]
+		}
+	}
+	return found
+}
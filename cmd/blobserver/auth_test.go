@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rogpeppe/rjson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthorizer(t *testing.T) {
+	var c config
+	require.Nil(t, rjson.Unmarshal([]byte(`{
+		tokens: {
+			reader: {name: "backup", access: "read-only"}
+			writer: {name: "laptop", access: "read-write"}
+		}
+	}`), &c))
+	auth, err := newAuthorizer(&c)
+	require.Nil(t, err)
+	testCases := []struct {
+		method string
+		header string
+		name   string
+		status int
+	}{
+		{http.MethodGet, "", "", http.StatusUnauthorized},
+		{http.MethodGet, "Bearer guess", "", http.StatusUnauthorized},
+		{http.MethodGet, "reader", "", http.StatusUnauthorized},
+		{http.MethodGet, "Bearer reader", "backup", http.StatusOK},
+		{http.MethodPut, "Bearer reader", "backup", http.StatusForbidden},
+		{http.MethodDelete, "Bearer reader", "backup", http.StatusForbidden},
+		{http.MethodGet, "Bearer writer", "laptop", http.StatusOK},
+		{http.MethodPut, "Bearer writer", "laptop", http.StatusOK},
+		{http.MethodDelete, "Bearer writer", "laptop", http.StatusOK},
+	}
+	for _, tc := range testCases {
+		r := httptest.NewRequest(tc.method, "/00", nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		name, status := auth.check(r)
+		assert.Equal(t, tc.name, name, "%s %q", tc.method, tc.header)
+		assert.Equal(t, tc.status, status, "%s %q", tc.method, tc.header)
+	}
+
+	t.Run("allows anything without tokens", func(t *testing.T) {
+		auth, err := newAuthorizer(&config{})
+		require.Nil(t, err)
+		_, status := auth.check(httptest.NewRequest(http.MethodPut, "/00", nil))
+		assert.Equal(t, http.StatusOK, status)
+	})
+	t.Run("rejects unknown access levels", func(t *testing.T) {
+		var c config
+		require.Nil(t, rjson.Unmarshal([]byte(`{tokens: {t: {name: "x", access: "admin"}}}`), &c))
+		_, err := newAuthorizer(&c)
+		assert.NotNil(t, err)
+	})
+}
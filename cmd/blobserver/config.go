@@ -9,6 +9,28 @@ import (
 type config struct {
 	BlobServer string `json:"blob_server"`
 	Debug      bool   `json:"debug"`
+
+	// Whether to compress blobs on disk. Blobs stored uncompressed remain
+	// readable.
+	Compress bool `json:"compress"`
+
+	// If cert and key are set, serve over TLS only, and if client_ca is also
+	// set, require clients to present certificates signed by it, identifying
+	// them by their common names.
+	TLS struct {
+		Cert     string `json:"cert"`
+		Key      string `json:"key"`
+		ClientCA string `json:"client_ca"`
+	} `json:"tls"`
+
+	// If set, clients must send one of these tokens as a bearer token. Each
+	// has a name, for the logs, and an access level, "read-only" (listing and
+	// getting blobs) or "read-write" (also putting and deleting them), e.g.,
+	// tokens: {"Dq8hV...": {name: "backup", access: "read-only"}}.
+	Tokens map[string]struct {
+		Name   string `json:"name"`
+		Access string `json:"access"`
+	} `json:"tokens"`
 }
 
 func loadConfig(pathname string) (*config, error) {
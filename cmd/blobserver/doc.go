@@ -2,9 +2,10 @@
 // its client, storage.RemoteStore. It is backed by a disk-based implementation
 // of storage.Store, but it should be extended to use any implementation.
 //
-// Valid requests are GETs and PUTs to paths of the form "/b33f" or "/f00d",
-// that is, slash followed by a hexadecimal string, encoding the key to GET or
-// PUT. Requests for other paths or with other HTTP verbs will return 400.
+// Valid requests are GETs, PUTs and DELETEs to paths of the form "/b33f" or
+// "/f00d", that is, slash followed by a hexadecimal string, encoding the key to
+// GET, PUT or DELETE. Requests for other paths or with other HTTP verbs will
+// return 400.
 //
 // If a key is not found, GETs return 404 with no body, which the client should
 // propagate as storage.ErrNotFound. Any other error on the GET path returns 500
@@ -13,5 +14,11 @@
 //
 // As for PUTs, the body is of course the value to be stored. The response is
 // either 200 status code and empty body, or 500 status code and the error
-// message in the body.
+// message in the body. DELETEs work the same way, and deleting a key that's
+// not there is not an error.
+//
+// Keys can be listed (e.g., for garbage collection) with a GET to
+// "/?after=b33f", which returns up to 1000 keys greater than the given one (or
+// all keys, if after is empty), hex-encoded, one per line, in increasing
+// order. An empty response body means there are no more keys.
 package main // import "github.com/nicolagi/dino/cmd/blobserver"
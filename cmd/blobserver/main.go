@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
 	"errors"
 	"flag"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/google/gops/agent"
 	"github.com/nicolagi/dino/storage"
+	"github.com/nicolagi/dino/tlsconfig"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -49,18 +51,54 @@ func main() {
 		log.Fatalf("Could not ensure directory %q exists: %v", dir, err)
 	}
 	dir = os.ExpandEnv("$HOME/lib/dino/data")
-	store := storage.NewDiskStore(dir)
+	var store storage.Store = storage.NewDiskStore(dir)
 	log.Infof("Will use a disk-based backend storing data at %s", dir)
+	if opts.Compress {
+		store = storage.NewCompressedStore(store)
+		log.Info("Will compress blobs")
+	}
+	auth, err := newAuthorizer(opts)
+	if err != nil {
+		log.WithField("err", err).Fatal("Could not load tokens")
+	}
+	if len(opts.Tokens) == 0 {
+		log.Warn("No tokens configured, any client can get and put blobs")
+	}
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		client := log.NewEntry(log.StandardLogger())
+		if r.TLS != nil {
+			if name := tlsconfig.Identity(*r.TLS); name != "" {
+				client = client.WithField("client", name)
+			}
+		}
+		token, allowed := auth.check(r)
+		if token != "" {
+			client = client.WithField("token", token)
+		}
+		if allowed == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dino"`)
+		}
 		var logger *log.Entry
 		status, body := func() (int, []byte) {
+			if allowed != http.StatusOK {
+				logger = client.WithFields(log.Fields{
+					"op":   r.Method,
+					"path": r.URL.Path,
+				})
+				logger.Warn(http.StatusText(allowed))
+				return allowed, []byte(http.StatusText(allowed))
+			}
+			if r.URL.Path == "/" && r.Method == http.MethodGet {
+				logger = client.WithField("op", "list")
+				return list(storage.Undecorate(store), r.URL.Query().Get("after"))
+			}
 			hkey := r.URL.Path[1:]
 			key, err := hex.DecodeString(hkey)
 			if err != nil {
 				return http.StatusBadRequest, []byte(fmt.Sprintf("%q: not a valid path, expecting hex key only", r.URL.Path))
 			}
-			logger = log.WithFields(log.Fields{
+			logger = client.WithFields(log.Fields{
 				"op":  r.Method,
 				"key": hkey,
 			})
@@ -77,6 +115,13 @@ func main() {
 				}
 				logger.Debug("Success")
 				return http.StatusOK, value
+			case http.MethodDelete:
+				if err := storage.Delete(storage.Undecorate(store), key); err != nil {
+					logger.WithField("err", err).Error()
+					return http.StatusInternalServerError, []byte(fmt.Sprintf("%q: %v", hkey, err))
+				}
+				logger.Debug("Success")
+				return http.StatusOK, nil
 			case http.MethodPut:
 				value, err := ioutil.ReadAll(r.Body)
 				if err != nil {
@@ -91,7 +136,7 @@ func main() {
 				return http.StatusOK, nil
 			default:
 				logger.Warn("Bad request")
-				return http.StatusBadRequest, []byte(fmt.Sprintf("%q: invalid method, expecting GET or PUT", r.Method))
+				return http.StatusBadRequest, []byte(fmt.Sprintf("%q: invalid method, expecting GET, PUT or DELETE", r.Method))
 			}
 		}()
 		w.WriteHeader(status)
@@ -102,7 +147,38 @@ func main() {
 		}
 	})
 
-	if err := http.ListenAndServe(opts.BlobServer, nil); err != nil {
+	server := &http.Server{Addr: opts.BlobServer}
+	if opts.TLS.Cert != "" {
+		server.TLSConfig, err = tlsconfig.Server(os.ExpandEnv(opts.TLS.Cert), os.ExpandEnv(opts.TLS.Key), os.ExpandEnv(opts.TLS.ClientCA))
+		if err != nil {
+			log.WithField("err", err).Fatal("Could not load TLS configuration")
+		}
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil {
 		log.WithField("err", err).Fatal("Could not listen and serve")
 	}
 }
+
+// Lists keys greater than the given hex-encoded key, one per line, hex-encoded.
+func list(store interface{}, hafter string) (int, []byte) {
+	after, err := hex.DecodeString(hafter)
+	if err != nil {
+		return http.StatusBadRequest, []byte(fmt.Sprintf("%q: not a valid hex key", hafter))
+	}
+	lister, ok := store.(storage.Lister)
+	if !ok {
+		return http.StatusNotImplemented, []byte(storage.ErrNotSupported.Error())
+	}
+	keys, err := lister.List(after)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+	var buf bytes.Buffer
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "%x\n", key)
+	}
+	return http.StatusOK, buf.Bytes()
+}
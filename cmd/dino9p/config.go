@@ -0,0 +1,28 @@
+package main
+
+import (
+	"github.com/nicolagi/dino/clientconfig"
+)
+
+// The dinofs configuration, so that the same file can be used for both, plus
+// the address to listen on: host:port or, if it contains a slash, the path of
+// a Unix socket. The properties only dinofs uses are ignored.
+type config struct {
+	clientconfig.Config
+	Address string `json:"9p_address"`
+}
+
+func loadConfig(pathname string) (*config, error) {
+	var c config
+	if err := clientconfig.Load(pathname, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *config) applyDefaultsForMissingProperties() {
+	c.ApplyDefaults()
+	if c.Address == "" {
+		c.Address = "localhost:5640"
+	}
+}
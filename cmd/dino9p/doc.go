@@ -0,0 +1,13 @@
+// Dino9p serves a dino volume over 9P2000, for Plan 9, plan9port and v9fs
+// clients. Like dinodav, it reads the same configuration files as dinofs and
+// accesses the metadata and blob stores directly, through the volume package,
+// so that 9P and FUSE clients can share a volume.
+//
+// Only plain 9P2000 is served: versions with extensions, e.g., 9P2000.L and
+// 9P2000.u, are negotiated down to it, so there are no symlinks, devices,
+// ownership changes or extended attributes. Fids refer to nodes by key, so a
+// fid keeps working if another client renames or removes its file. Files
+// opened for writing are buffered in memory and committed when clunked, or
+// synced with a null wstat. There's no authentication, and files are owned by
+// the user running dino9p.
+package main // import "github.com/nicolagi/dino/cmd/dino9p"
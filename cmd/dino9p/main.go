@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/google/gops/agent"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	defaultConfigFile := os.ExpandEnv("$HOME/lib/dino/fs-default.config")
+	configFile := flag.String("c", defaultConfigFile, "location of configuration file, or an alias to expand to $HOME/lib/dino/fs-ALIAS.config")
+	flag.Parse()
+
+	log.SetFormatter(&log.TextFormatter{
+		DisableColors: true,
+		FullTimestamp: true,
+	})
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Loading configuration from %q: %v", *configFile, err)
+	}
+
+	config.applyDefaultsForMissingProperties()
+
+	if config.Debug {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	if err := agent.Listen(agent.Options{}); err != nil {
+		log.WithField("err", err).Warn("Could not start gops agent")
+	} else {
+		defer agent.Close()
+	}
+
+	v, metadataClose, err := config.OpenVolume()
+	if err != nil {
+		log.WithField("err", err).Fatal("Could not open volume")
+	}
+	defer metadataClose()
+
+	network := "tcp"
+	if strings.Contains(config.Address, "/") {
+		network = "unix"
+	}
+	listener, err := net.Listen(network, config.Address)
+	if err != nil {
+		log.WithField("err", err).Fatal("Could not listen")
+	}
+	log.Infof("Serving on %s", config.Address)
+	srv := &server{v: v}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.WithField("err", err).Fatal("Could not accept connection")
+		}
+		go func() {
+			logger := log.WithField("remote", conn.RemoteAddr().String())
+			logger.Debug("Serving")
+			if err := srv.serve(conn); err != nil {
+				logger.WithField("err", err).Warn("Connection failed")
+			}
+			_ = conn.Close()
+		}()
+	}
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"9fans.net/go/plan9"
+	"github.com/nicolagi/dino/volume"
+)
+
+// The largest message size negotiated with clients.
+const maxMsize = 128 << 10
+
+// Files being written are buffered in memory, up to this size.
+const maxFileSize = 1 << 30
+
+var (
+	errFidInUse     = errors.New("fid already in use")
+	errUnknownFid   = errors.New("unknown fid")
+	errFidOpen      = errors.New("fid is open")
+	errFidNotOpen   = errors.New("fid not open")
+	errBadOffset    = errors.New("bad offset in directory read")
+	errBadName      = errors.New("bad file name")
+	errNoAuth       = errors.New("authentication not required")
+	errNotSupported = errors.New("operation not supported")
+)
+
+type server struct {
+	v *volume.FS
+}
+
+// Serves a connection until it's closed or the client misbehaves. Requests are
+// handled one at a time, so flushes have nothing to do.
+func (s *server) serve(rw io.ReadWriter) error {
+	c := &conn{v: s.v, msize: maxMsize, fids: make(map[uint32]*fid)}
+	defer c.clunkAll()
+	for {
+		tx, err := readFcall(rw, c.msize)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rx, err := c.handle(tx)
+		if err != nil {
+			rx = &plan9.Fcall{Type: plan9.Rerror, Ename: ename(err)}
+		} else {
+			rx.Type = tx.Type + 1
+		}
+		rx.Tag = tx.Tag
+		if err := plan9.WriteFcall(rw, rx); err != nil {
+			return err
+		}
+	}
+}
+
+// Like plan9.ReadFcall, but refuses messages larger than msize rather than
+// allocating whatever the size prefix says.
+func readFcall(r io.Reader, msize uint32) (*plan9.Fcall, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n < 7 || n > msize {
+		return nil, fmt.Errorf("invalid message size %d", n)
+	}
+	b := make([]byte, n)
+	copy(b, size[:])
+	if _, err := io.ReadFull(r, b[4:]); err != nil {
+		return nil, err
+	}
+	return plan9.UnmarshalFcall(b)
+}
+
+// Maps errors to the strings clients expect, e.g., v9fs maps them to errnos.
+func ename(err error) string {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return "file does not exist"
+	case errors.Is(err, fs.ErrExist):
+		return "file already exists"
+	case errors.Is(err, fs.ErrPermission):
+		return "permission denied"
+	case errors.Is(err, syscall.ENOTEMPTY):
+		return "directory not empty"
+	case errors.Is(err, syscall.EISDIR):
+		return "is a directory"
+	case errors.Is(err, syscall.ENOTDIR):
+		return "not a directory"
+	}
+	return err.Error()
+}
+
+type conn struct {
+	v     *volume.FS
+	msize uint32
+	fids  map[uint32]*fid
+}
+
+type fid struct {
+	// The node, last, and the directories walked through to get to it, from
+	// the root, so that walking to ".." goes back the same way. Nodes are
+	// referred to by key, so the fid keeps working if another client renames
+	// the file (or removes it, for as long as the node exists).
+	path []step
+
+	open   bool
+	mode   uint8
+	isDir  bool
+	rclose bool
+
+	// For open files, what's read (a snapshot taken when opening) and written
+	// (committed when clunked, if dirty).
+	content []byte
+	dirty   bool
+
+	// For open directories, the encoded entries not read yet, and the offset
+	// expected for the next read.
+	entries   []byte
+	dirOffset uint64
+}
+
+// A node, with the name it had in its directory when walked to.
+type step struct {
+	key  volume.Key
+	name string
+}
+
+func (f *fid) node() step {
+	return f.path[len(f.path)-1]
+}
+
+func (f *fid) isRoot() bool {
+	return len(f.path) == 1
+}
+
+// Returns the directory containing the node, which must not be the root.
+func (f *fid) dir() volume.Key {
+	return f.path[len(f.path)-2].key
+}
+
+func (f *fid) readable() bool {
+	return f.mode&3 != plan9.OWRITE
+}
+
+func (f *fid) writable() bool {
+	return f.mode&3 == plan9.OWRITE || f.mode&3 == plan9.ORDWR
+}
+
+func (c *conn) handle(tx *plan9.Fcall) (*plan9.Fcall, error) {
+	switch tx.Type {
+	case plan9.Tversion:
+		return c.version(tx)
+	case plan9.Tauth:
+		return nil, errNoAuth
+	case plan9.Tflush:
+		return &plan9.Fcall{}, nil
+	case plan9.Tattach:
+		return c.attach(tx)
+	}
+	f, ok := c.fids[tx.Fid]
+	if !ok {
+		return nil, errUnknownFid
+	}
+	switch tx.Type {
+	case plan9.Twalk:
+		return c.walk(f, tx)
+	case plan9.Topen:
+		return c.open(f, tx)
+	case plan9.Tcreate:
+		return c.create(f, tx)
+	case plan9.Tread:
+		return c.read(f, tx)
+	case plan9.Twrite:
+		return c.write(f, tx)
+	case plan9.Tclunk:
+		delete(c.fids, tx.Fid)
+		return &plan9.Fcall{}, c.clunk(f)
+	case plan9.Tremove:
+		delete(c.fids, tx.Fid)
+		return &plan9.Fcall{}, c.remove(f)
+	case plan9.Tstat:
+		return c.stat(f)
+	case plan9.Twstat:
+		return c.wstat(f, tx)
+	}
+	return nil, errNotSupported
+}
+
+func (c *conn) version(tx *plan9.Fcall) (*plan9.Fcall, error) {
+	if tx.Msize < 256 {
+		return nil, fmt.Errorf("msize %d too small", tx.Msize)
+	}
+	c.clunkAll()
+	c.msize = tx.Msize
+	if c.msize > maxMsize {
+		c.msize = maxMsize
+	}
+	rx := &plan9.Fcall{Msize: c.msize, Version: "unknown"}
+	if strings.HasPrefix(tx.Version, plan9.VERSION9P) {
+		// Extensions, e.g., 9P2000.L, are not supported.
+		rx.Version = plan9.VERSION9P
+	}
+	return rx, nil
+}
+
+func (c *conn) attach(tx *plan9.Fcall) (*plan9.Fcall, error) {
+	if _, ok := c.fids[tx.Fid]; ok {
+		return nil, errFidInUse
+	}
+	n, err := c.v.LookupKey(volume.RootKey)
+	if err != nil {
+		return nil, err
+	}
+	c.fids[tx.Fid] = &fid{path: []step{{key: volume.RootKey, name: "/"}}, isDir: true}
+	return &plan9.Fcall{Qid: qid(n)}, nil
+}
+
+func (c *conn) walk(f *fid, tx *plan9.Fcall) (*plan9.Fcall, error) {
+	if f.open {
+		return nil, errFidOpen
+	}
+	if _, ok := c.fids[tx.Newfid]; ok && tx.Newfid != tx.Fid {
+		return nil, errFidInUse
+	}
+	// Copied, so that fids don't share steps.
+	steps, isDir := append([]step(nil), f.path...), f.isDir
+	rx := &plan9.Fcall{}
+	for _, elem := range tx.Wname {
+		var n *volume.NodeInfo
+		var err error
+		switch {
+		case !isDir:
+			err = syscall.ENOTDIR
+		case elem == "..":
+			if len(steps) > 1 {
+				steps = steps[:len(steps)-1]
+			}
+			n, err = c.v.LookupKey(steps[len(steps)-1].key)
+		case validName(elem):
+			if n, err = c.v.LookupChild(steps[len(steps)-1].key, elem); err == nil {
+				steps = append(steps, step{key: n.Key, name: elem})
+			}
+		default:
+			err = errBadName
+		}
+		if err != nil {
+			if len(rx.Wqid) == 0 {
+				return nil, err
+			}
+			// A partial walk succeeds, without affecting newfid.
+			return rx, nil
+		}
+		isDir = n.IsDir()
+		rx.Wqid = append(rx.Wqid, qid(n))
+	}
+	c.fids[tx.Newfid] = &fid{path: steps, isDir: isDir}
+	return rx, nil
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+func (c *conn) open(f *fid, tx *plan9.Fcall) (*plan9.Fcall, error) {
+	if f.open {
+		return nil, errFidOpen
+	}
+	n, err := c.v.LookupKey(f.node().key)
+	if err != nil {
+		return nil, err
+	}
+	f.mode = tx.Mode
+	if n.IsDir() {
+		if f.writable() || tx.Mode&plan9.OTRUNC != 0 {
+			return nil, syscall.EISDIR
+		}
+	} else if tx.Mode&plan9.OTRUNC != 0 {
+		f.dirty = true
+	} else if f.content, err = c.v.ReadFileKey(n.Key); err != nil {
+		return nil, err
+	}
+	f.open = true
+	f.rclose = tx.Mode&plan9.ORCLOSE != 0
+	return &plan9.Fcall{Qid: qid(n), Iounit: c.msize - plan9.IOHDRSZ}, nil
+}
+
+func (c *conn) create(f *fid, tx *plan9.Fcall) (*plan9.Fcall, error) {
+	if f.open {
+		return nil, errFidOpen
+	}
+	if !f.isDir {
+		return nil, syscall.ENOTDIR
+	}
+	if !validName(tx.Name) {
+		return nil, errBadName
+	}
+	mode := uint32(tx.Perm & 0777)
+	switch {
+	case tx.Perm&plan9.DMDIR != 0:
+		if tx.Mode&3 != plan9.OREAD {
+			return nil, syscall.EISDIR
+		}
+		mode |= volume.ModeDir
+	case tx.Perm&^(plan9.DMDIR|0777) != 0:
+		// E.g., symlinks or devices, only in 9P2000.u.
+		return nil, errNotSupported
+	default:
+		mode |= volume.ModeRegular
+	}
+	n, err := c.v.CreateChild(f.node().key, tx.Name, mode)
+	if err != nil {
+		return nil, err
+	}
+	*f = fid{
+		path:   append(f.path, step{key: n.Key, name: tx.Name}),
+		open:   true,
+		mode:   tx.Mode,
+		isDir:  n.IsDir(),
+		rclose: tx.Mode&plan9.ORCLOSE != 0,
+	}
+	return &plan9.Fcall{Qid: qid(n), Iounit: c.msize - plan9.IOHDRSZ}, nil
+}
+
+func (c *conn) read(f *fid, tx *plan9.Fcall) (*plan9.Fcall, error) {
+	if !f.open || !f.readable() {
+		return nil, errFidNotOpen
+	}
+	count := uint64(tx.Count)
+	if max := uint64(c.msize - plan9.IOHDRSZ); count > max {
+		count = max
+	}
+	if f.isDir {
+		return c.readDir(f, tx.Offset, count)
+	}
+	if tx.Offset >= uint64(len(f.content)) {
+		return &plan9.Fcall{}, nil
+	}
+	end := tx.Offset + count
+	if end > uint64(len(f.content)) {
+		end = uint64(len(f.content))
+	}
+	return &plan9.Fcall{Data: f.content[tx.Offset:end]}, nil
+}
+
+// Reading from offset zero rereads the directory. Otherwise, reads must
+// continue from where the previous read stopped.
+func (c *conn) readDir(f *fid, offset uint64, count uint64) (*plan9.Fcall, error) {
+	if offset == 0 {
+		entries, err := c.v.ReadDirKey(f.node().key)
+		if err != nil {
+			return nil, err
+		}
+		f.entries = nil
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				return nil, err
+			}
+			b, err := dir(info).Bytes()
+			if err != nil {
+				return nil, err
+			}
+			f.entries = append(f.entries, b...)
+		}
+		f.dirOffset = 0
+	} else if offset != f.dirOffset {
+		return nil, errBadOffset
+	}
+	// Only whole entries are returned.
+	var n uint64
+	for n < uint64(len(f.entries)) {
+		size := 2 + uint64(binary.LittleEndian.Uint16(f.entries[n:]))
+		if n+size > count {
+			break
+		}
+		n += size
+	}
+	rx := &plan9.Fcall{Data: f.entries[:n]}
+	f.entries = f.entries[n:]
+	f.dirOffset += n
+	return rx, nil
+}
+
+func (c *conn) write(f *fid, tx *plan9.Fcall) (*plan9.Fcall, error) {
+	if !f.open || !f.writable() {
+		return nil, errFidNotOpen
+	}
+	// Checking the offset first keeps end from overflowing.
+	if tx.Offset > maxFileSize {
+		return nil, syscall.EFBIG
+	}
+	end := tx.Offset + uint64(len(tx.Data))
+	if end > maxFileSize {
+		return nil, syscall.EFBIG
+	}
+	if end > uint64(len(f.content)) {
+		resize(f, end)
+	}
+	copy(f.content[tx.Offset:], tx.Data)
+	f.dirty = true
+	return &plan9.Fcall{Count: uint32(len(tx.Data))}, nil
+}
+
+// Commits what was written, if anything.
+func (c *conn) sync(f *fid) error {
+	if !f.dirty {
+		return nil
+	}
+	if err := c.v.WriteFileKey(f.node().key, f.content); err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+func (c *conn) clunk(f *fid) error {
+	err := c.sync(f)
+	if f.rclose {
+		if rerr := c.remove(f); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// Removes the node from the directory it was walked to from, unless another
+// client renamed it meanwhile.
+func (c *conn) remove(f *fid) error {
+	if f.isRoot() {
+		return fs.ErrPermission
+	}
+	n := f.node()
+	return c.v.RemoveChild(f.dir(), n.name, n.key)
+}
+
+// Clunks all fids, e.g., when the connection is closed, committing what was
+// written.
+func (c *conn) clunkAll() {
+	for n, f := range c.fids {
+		_ = c.clunk(f)
+		delete(c.fids, n)
+	}
+}
+
+func (c *conn) stat(f *fid) (*plan9.Fcall, error) {
+	n := f.node()
+	info, err := c.v.StatKey(n.key, n.name)
+	if err != nil {
+		return nil, err
+	}
+	d := dir(info)
+	if f.open && !f.isDir {
+		d.Length = uint64(len(f.content))
+	}
+	b, err := d.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return &plan9.Fcall{Stat: b}, nil
+}
+
+// Changes the name (within the same directory), length, permissions or
+// modification time. A wstat changing nothing commits what was written.
+func (c *conn) wstat(f *fid, tx *plan9.Fcall) (*plan9.Fcall, error) {
+	d, err := plan9.UnmarshalDir(tx.Stat)
+	if err != nil {
+		return nil, err
+	}
+	var null plan9.Dir
+	null.Null()
+	if d.Uid != "" || d.Gid != "" || d.Muid != "" {
+		return nil, fs.ErrPermission
+	}
+	n := f.node()
+	rename := d.Name != "" && d.Name != n.name
+	if rename && f.isRoot() {
+		return nil, fs.ErrPermission
+	}
+	if rename && !validName(d.Name) {
+		return nil, errBadName
+	}
+	if d.Mode != null.Mode && (d.Mode&plan9.DMDIR != 0) != f.isDir {
+		return nil, fs.ErrPermission
+	}
+	if d.Length != null.Length && f.isDir && d.Length != 0 {
+		return nil, syscall.EISDIR
+	}
+	if !rename && d.Mode == null.Mode && d.Length == null.Length && d.Mtime == null.Mtime {
+		return &plan9.Fcall{}, c.sync(f)
+	}
+	if d.Length != null.Length && !f.isDir {
+		if err := c.truncate(f, d.Length); err != nil {
+			return nil, err
+		}
+	}
+	if d.Mode != null.Mode {
+		if err := c.v.ChmodKey(n.key, fs.FileMode(d.Mode&0777)); err != nil {
+			return nil, err
+		}
+	}
+	if d.Mtime != null.Mtime {
+		if err := c.v.ChtimesKey(n.key, time.Unix(int64(d.Mtime), 0)); err != nil {
+			return nil, err
+		}
+	}
+	if rename {
+		if err := c.v.RenameChild(f.dir(), n.name, d.Name, n.key); err != nil {
+			return nil, err
+		}
+		f.path[len(f.path)-1].name = d.Name
+	}
+	return &plan9.Fcall{}, nil
+}
+
+func (c *conn) truncate(f *fid, length uint64) error {
+	if length > maxFileSize {
+		return syscall.EFBIG
+	}
+	if f.open {
+		resize(f, length)
+		return nil
+	}
+	content, err := c.v.ReadFileKey(f.node().key)
+	if err != nil {
+		return err
+	}
+	// Not open, so committed right away.
+	g := &fid{path: f.path, content: content}
+	resize(g, length)
+	return c.sync(g)
+}
+
+func resize(f *fid, length uint64) {
+	if length <= uint64(len(f.content)) {
+		f.content = f.content[:length]
+	} else {
+		f.content = append(f.content, make([]byte, length-uint64(len(f.content)))...)
+	}
+	f.dirty = true
+}
+
+func qid(n *volume.NodeInfo) plan9.Qid {
+	q := plan9.Qid{
+		Path: binary.BigEndian.Uint64(n.Key[:8]),
+		Vers: uint32(n.Version),
+	}
+	switch n.Mode & volume.ModeType {
+	case volume.ModeDir:
+		q.Type = plan9.QTDIR
+	case volume.ModeSymlink:
+		q.Type = plan9.QTSYMLINK
+	}
+	return q
+}
+
+func dir(info fs.FileInfo) *plan9.Dir {
+	n := info.Sys().(*volume.NodeInfo)
+	d := &plan9.Dir{
+		Qid:    qid(n),
+		Mode:   plan9.Perm(info.Mode().Perm()),
+		Atime:  uint32(info.ModTime().Unix()),
+		Mtime:  uint32(info.ModTime().Unix()),
+		Length: uint64(info.Size()),
+		Name:   info.Name(),
+		Uid:    strconv.FormatUint(uint64(n.User), 10),
+		Gid:    strconv.FormatUint(uint64(n.Group), 10),
+	}
+	d.Muid = d.Uid
+	switch {
+	case info.IsDir():
+		d.Mode |= plan9.DMDIR
+		d.Length = 0
+	case info.Mode()&fs.ModeSymlink != 0:
+		d.Mode |= plan9.DMSYMLINK
+	}
+	return d
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"9fans.net/go/plan9"
+	"9fans.net/go/plan9/client"
+	"github.com/nicolagi/dino/storage"
+	"github.com/nicolagi/dino/volume"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	metadata := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	blobs := storage.NewBlobStore(storage.NewInMemoryStore())
+	v := volume.New(metadata, blobs)
+	srv := &server{v: v}
+	clientSide, serverSide := net.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- srv.serve(serverSide)
+	}()
+	conn, err := client.NewConn(clientSide)
+	require.Nil(t, err)
+	fsys, err := conn.Attach(nil, "glenda", "")
+	require.Nil(t, err)
+
+	t.Run("create, write and read", func(t *testing.T) {
+		dir, err := fsys.Create("dir", plan9.OREAD, plan9.DMDIR|0755)
+		require.Nil(t, err)
+		require.Nil(t, dir.Close())
+		f, err := fsys.Create("dir/file", plan9.ORDWR, 0644)
+		require.Nil(t, err)
+		// Fid.Write doesn't advance the offset.
+		_, err = f.WriteAt([]byte("world"), 7)
+		require.Nil(t, err)
+		_, err = f.WriteAt([]byte("hello, "), 0)
+		require.Nil(t, err)
+		// Not committed until clunked.
+		content, err := v.ReadFile("dir/file")
+		require.Nil(t, err)
+		assert.Empty(t, content)
+		require.Nil(t, f.Close())
+		content, err = v.ReadFile("dir/file")
+		require.Nil(t, err)
+		assert.Equal(t, "hello, world", string(content))
+
+		f, err = fsys.Open("dir/file", plan9.OREAD)
+		require.Nil(t, err)
+		b, err := ioutil.ReadAll(f)
+		require.Nil(t, err)
+		assert.Equal(t, "hello, world", string(b))
+		require.Nil(t, f.Close())
+
+		_, err = fsys.Create("dir/file", plan9.OWRITE, 0644)
+		assert.NotNil(t, err)
+	})
+	t.Run("directories and stat", func(t *testing.T) {
+		f, err := fsys.Open("dir", plan9.OREAD)
+		require.Nil(t, err)
+		dirs, err := f.Dirreadall()
+		require.Nil(t, err)
+		require.Nil(t, f.Close())
+		if assert.Len(t, dirs, 1) {
+			assert.Equal(t, "file", dirs[0].Name)
+			assert.Equal(t, uint64(12), dirs[0].Length)
+			assert.Equal(t, plan9.Perm(0644), dirs[0].Mode)
+		}
+		d, err := fsys.Stat("dir")
+		require.Nil(t, err)
+		assert.Equal(t, plan9.Perm(plan9.DMDIR|0755), d.Mode)
+		assert.Equal(t, uint8(plan9.QTDIR), d.Qid.Type)
+		_, err = fsys.Stat("dir/missing")
+		assert.NotNil(t, err)
+	})
+	t.Run("wstat and remove", func(t *testing.T) {
+		var d plan9.Dir
+		d.Null()
+		d.Name = "renamed"
+		d.Length = 5
+		d.Mode = 0600
+		require.Nil(t, fsys.Wstat("dir/file", &d))
+		content, err := v.ReadFile("dir/renamed")
+		require.Nil(t, err)
+		assert.Equal(t, "hello", string(content))
+		info, err := v.Stat("dir/renamed")
+		require.Nil(t, err)
+		assert.Equal(t, "-rw-------", info.Mode().String())
+		assert.NotNil(t, fsys.Remove("dir"))
+		require.Nil(t, fsys.Remove("dir/renamed"))
+		require.Nil(t, fsys.Remove("dir"))
+		entries, err := v.ReadDir(".")
+		require.Nil(t, err)
+		assert.Empty(t, entries)
+	})
+	t.Run("fids follow nodes renamed by other clients", func(t *testing.T) {
+		require.Nil(t, v.Mkdir("a", 0755))
+		require.Nil(t, v.WriteFile("a/file", []byte("before"), 0644))
+		f, err := fsys.Open("a/file", plan9.ORDWR|plan9.OTRUNC)
+		require.Nil(t, err)
+		require.Nil(t, v.Mkdir("b", 0755))
+		require.Nil(t, v.Rename("a/file", "b/moved"))
+		require.Nil(t, v.Rename("a", "c"))
+		_, err = f.WriteAt([]byte("after"), 0)
+		require.Nil(t, err)
+		d, err := f.Stat()
+		require.Nil(t, err)
+		assert.Equal(t, "file", d.Name)
+		require.Nil(t, f.Close())
+		content, err := v.ReadFile("b/moved")
+		require.Nil(t, err)
+		assert.Equal(t, "after", string(content))
+		_, err = v.Stat("c/file")
+		assert.NotNil(t, err)
+		// The fid's name is stale, so it doesn't remove what replaced it.
+		f, err = fsys.Open("b/moved", plan9.OREAD)
+		require.Nil(t, err)
+		require.Nil(t, v.Rename("b/moved", "b/other"))
+		require.Nil(t, v.WriteFile("b/moved", []byte("new"), 0644))
+		assert.NotNil(t, f.Remove())
+		content, err = v.ReadFile("b/moved")
+		require.Nil(t, err)
+		assert.Equal(t, "new", string(content))
+	})
+
+	require.Nil(t, conn.Close())
+	assert.Nil(t, <-done)
+}
+
+func TestWriteOffsetOverflow(t *testing.T) {
+	metadata := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	blobs := storage.NewBlobStore(storage.NewInMemoryStore())
+	srv := &server{v: volume.New(metadata, blobs)}
+	clientSide, serverSide := net.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- srv.serve(serverSide)
+	}()
+	rpc := func(tx *plan9.Fcall) *plan9.Fcall {
+		t.Helper()
+		require.Nil(t, plan9.WriteFcall(clientSide, tx))
+		rx, err := plan9.ReadFcall(clientSide)
+		require.Nil(t, err)
+		return rx
+	}
+
+	rx := rpc(&plan9.Fcall{Type: plan9.Tversion, Tag: plan9.NOTAG, Msize: 8192, Version: plan9.VERSION9P})
+	require.Equal(t, uint8(plan9.Rversion), rx.Type)
+	rx = rpc(&plan9.Fcall{Type: plan9.Tattach, Fid: 1, Afid: plan9.NOFID, Uname: "glenda"})
+	require.Equal(t, uint8(plan9.Rattach), rx.Type)
+	rx = rpc(&plan9.Fcall{Type: plan9.Tcreate, Fid: 1, Name: "file", Perm: 0644, Mode: plan9.OWRITE})
+	require.Equal(t, uint8(plan9.Rcreate), rx.Type)
+	// The offset plus the count wraps around.
+	rx = rpc(&plan9.Fcall{Type: plan9.Twrite, Fid: 1, Offset: ^uint64(0) - 2, Data: []byte("hello")})
+	assert.Equal(t, uint8(plan9.Rerror), rx.Type)
+	// The server is still serving.
+	rx = rpc(&plan9.Fcall{Type: plan9.Tclunk, Fid: 1})
+	assert.Equal(t, uint8(plan9.Rclunk), rx.Type)
+
+	require.Nil(t, clientSide.Close())
+	assert.Nil(t, <-done)
+}
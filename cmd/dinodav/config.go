@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/nicolagi/dino/clientconfig"
+)
+
+// The dinofs configuration, so that the same file can be used for both, plus
+// the address to listen on. The properties only dinofs uses are ignored.
+type config struct {
+	clientconfig.Config
+	DAVAddress string `json:"dav_address"`
+}
+
+func loadConfig(pathname string) (*config, error) {
+	var c config
+	if err := clientconfig.Load(pathname, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (c *config) applyDefaultsForMissingProperties() {
+	c.ApplyDefaults()
+	if c.DAVAddress == "" {
+		c.DAVAddress = "localhost:8089"
+	}
+}
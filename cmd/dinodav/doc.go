@@ -0,0 +1,7 @@
+// Dinodav serves a dino volume over WebDAV, for machines where FUSE isn't
+// available. It reads the same configuration files as dinofs, and accesses the
+// metadata and blob stores directly, so that changes made through it reach
+// dinofs clients as any other change. Symlinks are served as files containing
+// their targets, and there's no authentication: it listens on localhost by
+// default, and should be put behind a proxy to be exposed further.
+package main // import "github.com/nicolagi/dino/cmd/dinodav"
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/nicolagi/dino/volume"
+	"golang.org/x/net/webdav"
+)
+
+// Adapts a volume to webdav.FileSystem.
+type davFS struct {
+	v *volume.FS
+}
+
+var _ webdav.FileSystem = (*davFS)(nil)
+
+// Maps the slash-rooted paths used by webdav to the paths used by io/fs.
+func fsPath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func (d *davFS) Mkdir(_ context.Context, name string, perm os.FileMode) error {
+	return d.v.Mkdir(fsPath(name), perm)
+}
+
+// OpenFile supports opening for reading, and opening for writing with
+// truncation, which is all the webdav package needs, since contents are
+// always replaced as a whole.
+func (d *davFS) OpenFile(_ context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = fsPath(name)
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		f, err := d.v.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		return &davFile{File: f.(*volume.File)}, nil
+	}
+	if flag&os.O_TRUNC == 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EOPNOTSUPP}
+	}
+	if flag&os.O_CREATE == 0 {
+		if _, err := d.v.Stat(name); err != nil {
+			return nil, err
+		}
+	}
+	f, err := d.v.Create(name, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{File: f}, nil
+}
+
+func (d *davFS) RemoveAll(_ context.Context, name string) error {
+	return d.v.RemoveAll(fsPath(name))
+}
+
+func (d *davFS) Rename(_ context.Context, oldName, newName string) error {
+	return d.v.Rename(fsPath(oldName), fsPath(newName))
+}
+
+func (d *davFS) Stat(_ context.Context, name string) (os.FileInfo, error) {
+	return d.v.Stat(fsPath(name))
+}
+
+// Adds to volume.File the Readdir method of http.File.
+type davFile struct {
+	*volume.File
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	entries, err := f.ReadDir(count)
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return infos, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, err
+}
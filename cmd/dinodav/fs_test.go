@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nicolagi/dino/storage"
+	"github.com/nicolagi/dino/volume"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+func TestWebDAV(t *testing.T) {
+	metadata := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	blobs := storage.NewBlobStore(storage.NewInMemoryStore())
+	server := httptest.NewServer(&webdav.Handler{
+		FileSystem: &davFS{v: volume.New(metadata, blobs)},
+		LockSystem: webdav.NewMemLS(),
+	})
+	defer server.Close()
+
+	do := func(method, path, body string, header ...string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		require.Nil(t, err)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		require.Nil(t, err)
+		return resp.StatusCode, string(b)
+	}
+
+	status, _ := do("MKCOL", "/dir", "")
+	assert.Equal(t, http.StatusCreated, status)
+	status, _ = do("MKCOL", "/missing/dir", "")
+	assert.Equal(t, http.StatusConflict, status)
+	status, _ = do(http.MethodPut, "/dir/file", "content")
+	assert.Equal(t, http.StatusCreated, status)
+	status, body := do(http.MethodGet, "/dir/file", "")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "content", body)
+	status, body = do("PROPFIND", "/dir", "", "Depth", "1")
+	assert.Equal(t, http.StatusMultiStatus, status)
+	assert.Contains(t, body, "/dir/file")
+	status, _ = do("MOVE", "/dir/file", "", "Destination", server.URL+"/moved")
+	assert.Equal(t, http.StatusCreated, status)
+	status, _ = do(http.MethodPut, "/dir/other", "more")
+	assert.Equal(t, http.StatusCreated, status)
+	status, _ = do(http.MethodDelete, "/dir", "")
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = do(http.MethodGet, "/dir/other", "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// The changes are in the stores, for other clients to see.
+	v := volume.New(metadata, blobs)
+	entries, err := v.ReadDir(".")
+	require.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "moved", entries[0].Name())
+	}
+	content, err := v.ReadFile("moved")
+	require.Nil(t, err)
+	assert.Equal(t, "content", string(content))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"os"
+
+	"github.com/google/gops/agent"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+)
+
+func main() {
+	defaultConfigFile := os.ExpandEnv("$HOME/lib/dino/fs-default.config")
+	configFile := flag.String("c", defaultConfigFile, "location of configuration file, or an alias to expand to $HOME/lib/dino/fs-ALIAS.config")
+	flag.Parse()
+
+	log.SetFormatter(&log.TextFormatter{
+		DisableColors: true,
+		FullTimestamp: true,
+	})
+
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("Loading configuration from %q: %v", *configFile, err)
+	}
+
+	config.applyDefaultsForMissingProperties()
+
+	if config.Debug {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	if err := agent.Listen(agent.Options{}); err != nil {
+		log.WithField("err", err).Warn("Could not start gops agent")
+	} else {
+		defer agent.Close()
+	}
+
+	v, metadataClose, err := config.OpenVolume()
+	if err != nil {
+		log.WithField("err", err).Fatal("Could not open volume")
+	}
+	defer metadataClose()
+
+	handler := &webdav.Handler{
+		FileSystem: &davFS{v: v},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			logger := log.WithFields(log.Fields{
+				"method": r.Method,
+				"path":   r.URL.Path,
+			})
+			if err != nil {
+				logger.WithField("err", err).Warn("Failed")
+			} else {
+				logger.Debug("Success")
+			}
+		},
+	}
+	log.Infof("Serving on %s", config.DAVAddress)
+	if err := http.ListenAndServe(config.DAVAddress, handler); err != nil {
+		log.WithField("err", err).Fatal("Could not listen and serve")
+	}
+}
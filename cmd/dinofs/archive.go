@@ -0,0 +1,419 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/nicolagi/dino/quota"
+	"github.com/nicolagi/dino/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// Extended attributes are stored in PAX records with this prefix, as GNU tar
+// and bsdtar do.
+const paxXattrPrefix = "SCHILY.xattr."
+
+// Builds a factory for commands that access the volume without mounting it.
+// Nodes and blobs are committed directly to the remote stores.
+func unmountedFactory(c *config) (factory *dinoNodeFactory, close func(), err error) {
+	factory = new(dinoNodeFactory)
+	if factory.metadata, close, err = c.VersionedStore(factory.invalidateCache); err != nil {
+		return nil, nil, err
+	}
+	remote, err := c.RemoteStore()
+	if err != nil {
+		close()
+		return nil, nil, err
+	}
+	if factory.blobs, err = c.BlobStore(remote); err != nil {
+		close()
+		return nil, nil, err
+	}
+	if c.Quota {
+		factory.quotas = quota.NewTracker(factory.metadata)
+	}
+	if c.InlineThreshold > maxInlineThreshold {
+		close()
+		return nil, nil, fmt.Errorf("inline threshold %d larger than %d", c.InlineThreshold, maxInlineThreshold)
+	}
+	factory.inlineThreshold = c.InlineThreshold
+	return factory, close, nil
+}
+
+func exportCommand(c *config, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	file := flags.String("f", "-", "write the archive to this file, or to standard output")
+	dir := flags.String("dir", "/", "export only this directory")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	factory, closeFactory, err := unmountedFactory(c)
+	if err != nil {
+		return err
+	}
+	defer closeFactory()
+	if *file == "-" {
+		return exportTar(factory, *dir, os.Stdout)
+	}
+	f, err := os.Create(*file)
+	if err != nil {
+		return err
+	}
+	if err := exportTar(factory, *dir, f); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func importCommand(c *config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	file := flags.String("f", "-", "read the archive from this file, or from standard input")
+	dir := flags.String("dir", "/", "import into this directory, created if needed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	factory, closeFactory, err := unmountedFactory(c)
+	if err != nil {
+		return err
+	}
+	defer closeFactory()
+	if *file == "-" {
+		return importTar(factory, *dir, os.Stdin)
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	return importTar(factory, *dir, f)
+}
+
+// Loads the root node, or makes an empty one if the volume is empty.
+func loadRoot(factory *dinoNodeFactory) (*dinoNode, error) {
+	var rootKey [nodeKeyLen]byte
+	root := factory.existingNode("root", rootKey)
+	factory.root = root
+	if err := root.loadMetadata(rootKey); errors.Is(err, storage.ErrNotFound) {
+		root.mode = fuse.S_IFDIR | 0755
+		root.children = make(map[string]*dinoNode)
+	} else if err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// Walks the slash-separated path from the root. If mkdir is not nil, it's
+// called to create missing directories.
+func walkPath(factory *dinoNodeFactory, pathname string, mkdir func(dir *dinoNode, name string) (*dinoNode, error)) (node *dinoNode, err error) {
+	node, err = loadRoot(factory)
+	if err != nil {
+		return nil, err
+	}
+	return walkFrom(node, pathname, mkdir)
+}
+
+func walkFrom(node *dinoNode, pathname string, mkdir func(dir *dinoNode, name string) (*dinoNode, error)) (*dinoNode, error) {
+	for _, name := range splitPath(pathname) {
+		if node.mode&fuse.S_IFDIR == 0 {
+			return nil, fmt.Errorf("%q: %s is not a directory", pathname, node.name)
+		}
+		child, err := loadChild(node, name)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", pathname, err)
+		}
+		if child == nil {
+			if mkdir == nil {
+				return nil, fmt.Errorf("%q: %w", pathname, os.ErrNotExist)
+			}
+			if child, err = mkdir(node, name); err != nil {
+				return nil, err
+			}
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// Splits a slash-separated path into its non-empty elements, e.g., none for
+// "/" or "./".
+func splitPath(pathname string) []string {
+	pathname = strings.Trim(path.Clean("/"+pathname), "/")
+	if pathname == "" {
+		return nil
+	}
+	return strings.Split(pathname, "/")
+}
+
+// Returns the named child, loaded, or nil if there's no such child.
+func loadChild(dir *dinoNode, name string) (*dinoNode, error) {
+	child, ok := dir.children[name]
+	if !ok {
+		return nil, nil
+	}
+	if child.mode == modeNotLoaded {
+		if err := child.loadMetadata(child.key); err != nil {
+			return nil, err
+		}
+	}
+	return child, nil
+}
+
+// Adds a new child to the directory, without saving either.
+func newChild(dir *dinoNode, name string, mode uint32) (*dinoNode, error) {
+	child, err := dir.factory.allocNode()
+	if err != nil {
+		return nil, err
+	}
+	child.name = name
+	child.mode = mode
+	child.user = dir.user
+	child.group = dir.group
+	if mode&fuse.S_IFDIR != 0 {
+		child.children = make(map[string]*dinoNode)
+	}
+	dir.children[name] = child
+	return child, nil
+}
+
+// Writes the directory and its descendants as a tar stream.
+func exportTar(factory *dinoNodeFactory, dir string, w io.Writer) error {
+	node, err := walkPath(factory, dir, nil)
+	if err != nil {
+		return err
+	}
+	if node.mode&fuse.S_IFDIR == 0 {
+		return fmt.Errorf("%q: not a directory", dir)
+	}
+	tw := tar.NewWriter(w)
+	if err := exportChildren(tw, node, ""); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func exportChildren(tw *tar.Writer, dir *dinoNode, prefix string) error {
+	var names []string
+	for name := range dir.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child, err := loadChild(dir, name)
+		if err != nil {
+			return fmt.Errorf("%s%s: %w", prefix, name, err)
+		}
+		if err := exportNode(tw, child, prefix+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exportNode(tw *tar.Writer, node *dinoNode, name string) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    int64(node.mode & 07777),
+		Uid:     int(node.user),
+		Gid:     int(node.group),
+		ModTime: node.time,
+	}
+	for attr, value := range node.xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[paxXattrPrefix+attr] = string(value)
+	}
+	var content []byte
+	if len(node.contentKey) > 0 {
+		if node.inline {
+			content = node.contentKey
+		} else {
+			var err error
+			if content, err = node.factory.blobs.Get(node.contentKey); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	switch {
+	case node.mode&fuse.S_IFDIR != 0:
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case node.mode&fuse.S_IFLNK == fuse.S_IFLNK:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = string(content)
+	case node.mode&fuse.S_IFREG != 0:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(len(content))
+	default:
+		log.WithFields(log.Fields{
+			"name": name,
+			"mode": fmt.Sprintf("%o", node.mode),
+		}).Warn("Skipping node of unknown type")
+		return nil
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		if _, err := tw.Write(content); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		return exportChildren(tw, node, hdr.Name)
+	}
+	return nil
+}
+
+// Reads tar streams into a volume. Files and symlinks are saved as they're
+// read, and directories at the end, children first, so that nothing is visible
+// to clients before it's complete.
+type importer struct {
+	// The directories to save, in an order such that new directories come
+	// after their parents.
+	dirty []*dinoNode
+	seen  map[*dinoNode]bool
+}
+
+func (im *importer) markDirty(dir *dinoNode) {
+	if !im.seen[dir] {
+		im.seen[dir] = true
+		im.dirty = append(im.dirty, dir)
+	}
+}
+
+// Adds a new child to the directory, saved later if it's a directory.
+func (im *importer) newChild(dir *dinoNode, name string, mode uint32) (*dinoNode, error) {
+	child, err := newChild(dir, name, mode)
+	if err != nil {
+		return nil, err
+	}
+	im.markDirty(dir)
+	if mode&fuse.S_IFDIR != 0 {
+		im.markDirty(child)
+	}
+	return child, nil
+}
+
+func (im *importer) mkdir(dir *dinoNode, name string) (*dinoNode, error) {
+	return im.newChild(dir, name, fuse.S_IFDIR|0755)
+}
+
+// Reads a tar stream into the directory, created if needed. Existing files
+// are not overwritten.
+func importTar(factory *dinoNodeFactory, dir string, r io.Reader) error {
+	im := &importer{seen: make(map[*dinoNode]bool)}
+	top, err := walkPath(factory, dir, im.mkdir)
+	if err != nil {
+		return err
+	}
+	if top.mode&fuse.S_IFDIR == 0 {
+		return fmt.Errorf("%q: not a directory", dir)
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		names := splitPath(hdr.Name)
+		if len(names) == 0 {
+			// The top directory itself.
+			continue
+		}
+		parent, err := walkFrom(top, path.Join(names[:len(names)-1]...), im.mkdir)
+		if err != nil {
+			return err
+		}
+		if parent.mode&fuse.S_IFDIR == 0 {
+			return fmt.Errorf("%s: parent not a directory", hdr.Name)
+		}
+		if err := im.importEntry(parent, names[len(names)-1], hdr, tr); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+	for i := len(im.dirty) - 1; i >= 0; i-- {
+		node := im.dirty[i]
+		node.shouldSaveMetadata = true
+		if errno := node.sync(); errno != 0 {
+			return fmt.Errorf("saving %s: %w", node.name, errno)
+		}
+	}
+	return nil
+}
+
+func (im *importer) importEntry(parent *dinoNode, name string, hdr *tar.Header, r io.Reader) error {
+	var mode uint32
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		mode = fuse.S_IFDIR
+	case tar.TypeReg, tar.TypeRegA:
+		mode = fuse.S_IFREG
+	case tar.TypeSymlink:
+		mode = fuse.S_IFLNK
+	default:
+		log.WithFields(log.Fields{
+			"name": hdr.Name,
+			"type": string(hdr.Typeflag),
+		}).Warn("Skipping entry of unsupported type")
+		return nil
+	}
+	mode |= uint32(hdr.Mode) & 07777
+	node, err := loadChild(parent, name)
+	if err != nil {
+		return err
+	}
+	if node == nil {
+		if node, err = im.newChild(parent, name, mode); err != nil {
+			return err
+		}
+	} else if mode&fuse.S_IFDIR == 0 || node.mode&fuse.S_IFDIR == 0 {
+		// Only directories can be merged.
+		return os.ErrExist
+	}
+	node.mode = mode
+	node.user = uint32(hdr.Uid)
+	node.group = uint32(hdr.Gid)
+	node.time = hdr.ModTime
+	for key, value := range hdr.PAXRecords {
+		if !strings.HasPrefix(key, paxXattrPrefix) {
+			continue
+		}
+		if node.xattrs == nil {
+			node.xattrs = make(map[string][]byte)
+		}
+		node.xattrs[strings.TrimPrefix(key, paxXattrPrefix)] = []byte(value)
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		im.markDirty(node)
+		return nil
+	case tar.TypeSymlink:
+		node.content = []byte(hdr.Linkname)
+	default:
+		if node.content, err = ioutil.ReadAll(r); err != nil {
+			return err
+		}
+	}
+	node.shouldSaveContent = true
+	node.shouldSaveMetadata = true
+	if errno := node.sync(); errno != 0 {
+		return errno
+	}
+	// Not needed anymore.
+	node.content = nil
+	return nil
+}
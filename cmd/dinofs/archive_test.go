@@ -0,0 +1,80 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestArchive(t *testing.T) {
+	metadata := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	blobs := storage.NewBlobStore(storage.NewInMemoryStore())
+	rootdir, _, cleanup := testMount(t, func(factory *dinoNodeFactory) {
+		factory.metadata = metadata
+		factory.blobs = blobs
+	})
+	defer cleanup()
+
+	require.Nil(t, os.MkdirAll(filepath.Join(rootdir, "a/b"), 0750))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(rootdir, "a/b/file"), []byte("content"), 0640))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(rootdir, "empty"), nil, 0600))
+	require.Nil(t, os.Symlink("a/b/file", filepath.Join(rootdir, "link")))
+	require.Nil(t, unix.Setxattr(filepath.Join(rootdir, "a/b/file"), "user.color", []byte("blue"), 0))
+
+	var archive bytes.Buffer
+	require.Nil(t, exportTar(&dinoNodeFactory{metadata: metadata, blobs: blobs}, "/", &archive))
+
+	t.Run("export", func(t *testing.T) {
+		tr := tar.NewReader(bytes.NewReader(archive.Bytes()))
+		var names []string
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			require.Nil(t, err)
+			names = append(names, hdr.Name)
+			switch hdr.Name {
+			case "a/b/file":
+				assert.EqualValues(t, 0640, hdr.Mode)
+				assert.Equal(t, "blue", hdr.PAXRecords["SCHILY.xattr.user.color"])
+				content, err := ioutil.ReadAll(tr)
+				require.Nil(t, err)
+				assert.Equal(t, "content", string(content))
+			case "a/":
+				assert.Equal(t, byte(tar.TypeDir), hdr.Typeflag)
+				assert.EqualValues(t, 0750, hdr.Mode)
+			case "link":
+				assert.Equal(t, byte(tar.TypeSymlink), hdr.Typeflag)
+				assert.Equal(t, "a/b/file", hdr.Linkname)
+			}
+		}
+		assert.Equal(t, []string{"a/", "a/b/", "a/b/file", "empty", "link"}, names)
+	})
+
+	t.Run("import into another volume and export again", func(t *testing.T) {
+		other := &dinoNodeFactory{
+			metadata: storage.NewVersionedWrapper(storage.NewInMemoryStore()),
+			blobs:    storage.NewBlobStore(storage.NewInMemoryStore()),
+		}
+		require.Nil(t, importTar(other, "/x/y", bytes.NewReader(archive.Bytes())))
+		var again bytes.Buffer
+		require.Nil(t, exportTar(&dinoNodeFactory{metadata: other.metadata, blobs: other.blobs}, "/x/y", &again))
+		assert.Equal(t, archive.Bytes(), again.Bytes())
+	})
+
+	t.Run("import does not overwrite files", func(t *testing.T) {
+		err := importTar(&dinoNodeFactory{metadata: metadata, blobs: blobs}, "/", bytes.NewReader(archive.Bytes()))
+		assert.True(t, errors.Is(err, os.ErrExist))
+	})
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Commands other than mounting the file system, e.g., for administration.
+// Each is passed the loaded configuration and the command line arguments after
+// the command name.
+var commands = map[string]func(*config, []string) error{
+	"export": exportCommand,
+	"fsck":   fsckCommand,
+	"gc":     gcCommand,
+	"import": importCommand,
+	"quota":  quotaCommand,
+}
+
+func runCommand(c *config, args []string) error {
+	command, ok := commands[args[0]]
+	if !ok {
+		return fmt.Errorf("%q: unknown command (known: %s)", args[0], commandNames())
+	}
+	return command(c, args[1:])
+}
+
+func commandNames() string {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nicolagi/dino/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// Maximum number of puts in a single put-many request.
+const maxCommitBatch = 100
+
+// committer implements write-behind of metadata. Instead of being put one at a
+// time as they are synced, nodes are serialized and collected for a short
+// window, or until flushed (e.g., by closing a file), and then put in batches.
+//
+// Since the syscalls mutating nodes return before the metadata is committed,
+// they can't fail because of a concurrent update by another client. If a put
+// fails, the node is marked for reload, and the local changes are lost. Quotas
+// are charged for the changes only once committed.
+type committer struct {
+	factory *dinoNodeFactory
+	window  time.Duration
+
+	// Serializes flushes, so that batches are committed in order.
+	flushing sync.Mutex
+
+	mu       sync.Mutex
+	seq      uint64
+	pending  map[[nodeKeyLen]byte]*pendingCommit
+	inflight map[[nodeKeyLen]byte]bool
+	timer    *time.Timer
+
+	// Whether a flush has been started because of a full batch, and hasn't
+	// taken the pending nodes yet.
+	flushRequested bool
+}
+
+type pendingCommit struct {
+	key     [nodeKeyLen]byte
+	version uint64
+	value   []byte
+
+	// Keys of the node's children at the time of serialization. A node must be
+	// committed after its new children, or other clients could see a
+	// reference to a node that does not exist yet.
+	children [][nodeKeyLen]byte
+
+	// Order of the latest enqueuing, to have deterministic batches.
+	seq uint64
+
+	// To make once committed, accumulated over enqueuings.
+	charges []charge
+}
+
+func newCommitter(factory *dinoNodeFactory, window time.Duration) *committer {
+	return &committer{
+		factory:  factory,
+		window:   window,
+		pending:  make(map[[nodeKeyLen]byte]*pendingCommit),
+		inflight: make(map[[nodeKeyLen]byte]bool),
+	}
+}
+
+// Call with node lock held. Returns the version the node will be committed
+// with. Enqueuing a node that's still pending replaces its value, rather than
+// causing another put. The charges are made once the node is committed.
+func (c *committer) enqueue(node *dinoNode, charges []charge) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.pending[node.key]
+	if p == nil {
+		p = &pendingCommit{
+			key:     node.key,
+			version: node.version + 1,
+		}
+		c.pending[node.key] = p
+	}
+	p.value = node.serialize()
+	p.charges = append(p.charges, charges...)
+	p.children = p.children[:0]
+	for _, child := range node.children {
+		p.children = append(p.children, child.key)
+	}
+	c.seq++
+	p.seq = c.seq
+	if len(c.pending) >= maxCommitBatch {
+		if !c.flushRequested {
+			c.flushRequested = true
+			go c.flushInBackground()
+		}
+	} else if c.timer == nil {
+		c.timer = time.AfterFunc(c.window, c.flushInBackground)
+	}
+	return p.version
+}
+
+// Tells whether the node with the given key has changes not yet committed.
+func (c *committer) isPending(key [nodeKeyLen]byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pending[key] != nil || c.inflight[key]
+}
+
+func (c *committer) flushInBackground() {
+	if err := c.flush(); err != nil {
+		log.WithField("err", err).Warn("Could not commit metadata")
+	}
+}
+
+// Commits all pending nodes. Call without holding any node lock, as nodes
+// whose commit fails are marked for reload.
+func (c *committer) flush() error {
+	c.flushing.Lock()
+	defer c.flushing.Unlock()
+	c.mu.Lock()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.flushRequested = false
+	batch := c.pending
+	c.pending = make(map[[nodeKeyLen]byte]*pendingCommit)
+	for key := range batch {
+		c.inflight[key] = true
+	}
+	c.mu.Unlock()
+
+	ordered := childrenFirst(batch)
+	var failed int
+	var err error
+	for len(ordered) > 0 {
+		n := len(ordered)
+		if n > maxCommitBatch {
+			n = maxCommitBatch
+		}
+		chunk := ordered[:n]
+		ordered = ordered[n:]
+		var f int
+		f, err = c.commit(chunk)
+		failed += f
+		if err != nil {
+			c.requeue(append(chunk, ordered...))
+			break
+		}
+	}
+	c.mu.Lock()
+	for key := range batch {
+		delete(c.inflight, key)
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not commit %d nodes", failed)
+	}
+	return nil
+}
+
+// Puts the given nodes, returning how many failed, or an error if the outcome
+// of the puts is unknown.
+func (c *committer) commit(batch []*pendingCommit) (failed int, err error) {
+	puts := make([]storage.VersionedPut, len(batch))
+	for i, p := range batch {
+		puts[i] = storage.VersionedPut{
+			Version: p.version,
+			Key:     p.key[:],
+			Value:   p.value,
+		}
+	}
+	errs, err := c.factory.metadata.PutMany(puts)
+	if err != nil {
+		return 0, err
+	}
+	log.WithField("count", len(batch)).Debug("Committed metadata")
+	for i, p := range batch {
+		if errs[i] == nil {
+			c.factory.charge(p.charges)
+			continue
+		}
+		failed++
+		log.WithFields(log.Fields{
+			"key":     fmt.Sprintf("%.10x", p.key[:]),
+			"version": p.version,
+			"err":     errs[i],
+		}).Warn("Could not commit metadata, will reload")
+		if node := c.factory.getKnown(p.key); node != nil {
+			node.mu.Lock()
+			node.shouldReloadMetadata = true
+			node.mu.Unlock()
+		}
+	}
+	return failed, nil
+}
+
+// Puts back nodes whose commit outcome is unknown, to be retried later, unless
+// they have been enqueued again meanwhile, in which case their charges are
+// made with the later commit.
+func (c *committer) requeue(batch []*pendingCommit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range batch {
+		if later := c.pending[p.key]; later != nil {
+			later.charges = append(p.charges, later.charges...)
+		} else {
+			c.pending[p.key] = p
+		}
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.window, c.flushInBackground)
+	}
+}
+
+// Orders pending commits so that each node comes after its children.
+func childrenFirst(batch map[[nodeKeyLen]byte]*pendingCommit) []*pendingCommit {
+	sorted := make([]*pendingCommit, 0, len(batch))
+	for _, p := range batch {
+		sorted = append(sorted, p)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].seq < sorted[j].seq
+	})
+	ordered := make([]*pendingCommit, 0, len(batch))
+	visited := make(map[[nodeKeyLen]byte]bool)
+	var visit func(p *pendingCommit)
+	visit = func(p *pendingCommit) {
+		if visited[p.key] {
+			return
+		}
+		visited[p.key] = true
+		for _, key := range p.children {
+			if child := batch[key]; child != nil {
+				visit(child)
+			}
+		}
+		ordered = append(ordered, p)
+	}
+	for _, p := range sorted {
+		visit(p)
+	}
+	return ordered
+}
+
+// Commits pending metadata, if write-behind is enabled. Call without holding
+// any node lock.
+func (factory *dinoNodeFactory) commitPending() syscall.Errno {
+	if factory.commits == nil {
+		return 0
+	}
+	if err := factory.commits.flush(); err != nil {
+		log.WithField("err", err).Error("Could not commit metadata")
+		return syscall.EIO
+	}
+	return 0
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/dino/quota"
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// Counts calls to the wrapped store.
+type countingVersionedStore struct {
+	storage.VersionedStore
+
+	mu      sync.Mutex
+	puts    int
+	putMany []int
+	gets    int
+	getMany []int
+}
+
+func (s *countingVersionedStore) Get(key []byte) (uint64, []byte, error) {
+	s.mu.Lock()
+	s.gets++
+	s.mu.Unlock()
+	return s.VersionedStore.Get(key)
+}
+
+func (s *countingVersionedStore) GetMany(keys [][]byte) ([]storage.VersionedValue, error) {
+	s.mu.Lock()
+	s.getMany = append(s.getMany, len(keys))
+	s.mu.Unlock()
+	return s.VersionedStore.GetMany(keys)
+}
+
+func (s *countingVersionedStore) getCounts() (gets int, getMany []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets, append([]int(nil), s.getMany...)
+}
+
+func (s *countingVersionedStore) Put(version uint64, key []byte, value []byte) error {
+	s.mu.Lock()
+	s.puts++
+	s.mu.Unlock()
+	return s.VersionedStore.Put(version, key, value)
+}
+
+func (s *countingVersionedStore) PutMany(puts []storage.VersionedPut) ([]error, error) {
+	s.mu.Lock()
+	s.putMany = append(s.putMany, len(puts))
+	s.mu.Unlock()
+	return s.VersionedStore.PutMany(puts)
+}
+
+func (s *countingVersionedStore) counts() (puts int, putMany []int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.puts, append([]int(nil), s.putMany...)
+}
+
+// Blocks put-many calls until released.
+type blockingVersionedStore struct {
+	storage.VersionedStore
+	release chan struct{}
+}
+
+func (s *blockingVersionedStore) PutMany(puts []storage.VersionedPut) ([]error, error) {
+	<-s.release
+	return s.VersionedStore.PutMany(puts)
+}
+
+func TestFullBatchesFlushOnce(t *testing.T) {
+	store := &blockingVersionedStore{
+		VersionedStore: storage.NewVersionedWrapper(storage.NewInMemoryStore()),
+		release:        make(chan struct{}),
+	}
+	factory := &dinoNodeFactory{metadata: store}
+	c := newCommitter(factory, time.Hour)
+	factory.commits = c
+	enqueue := func(n int) {
+		for i := 0; i < n; i++ {
+			var node dinoNode
+			node.factory = factory
+			_, _ = rand.Read(node.key[:])
+			node.mu.Lock()
+			c.enqueue(&node, nil)
+			node.mu.Unlock()
+		}
+	}
+	// Fill a batch, whose flush gets stuck, then keep enqueuing.
+	enqueue(maxCommitBatch)
+	for {
+		c.mu.Lock()
+		taken := len(c.inflight) == maxCommitBatch
+		c.mu.Unlock()
+		if taken {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	before := runtime.NumGoroutine()
+	enqueue(3 * maxCommitBatch)
+	// At most one more flush waits for the stuck one.
+	assert.True(t, runtime.NumGoroutine()-before <= 1)
+	close(store.release)
+	require.Nil(t, c.flush())
+	c.mu.Lock()
+	assert.Empty(t, c.pending)
+	assert.Empty(t, c.inflight)
+	c.mu.Unlock()
+}
+
+func TestChildrenFirst(t *testing.T) {
+	key := func(b byte) (k [nodeKeyLen]byte) {
+		k[0] = b
+		return k
+	}
+	batch := make(map[[nodeKeyLen]byte]*pendingCommit)
+	add := func(b byte, seq uint64, children ...byte) {
+		p := &pendingCommit{key: key(b), seq: seq}
+		for _, c := range children {
+			p.children = append(p.children, key(c))
+		}
+		batch[p.key] = p
+	}
+	// The root was enqueued first, and re-enqueued after a child directory was
+	// created and populated. Node 5 is a child that's not pending.
+	add(1, 1, 2, 5)
+	add(2, 2, 3, 4)
+	add(3, 3)
+	add(4, 4)
+	add(6, 5)
+	var got []byte
+	for _, p := range childrenFirst(batch) {
+		got = append(got, p.key[0])
+	}
+	assert.Equal(t, []byte{3, 4, 2, 1, 6}, got)
+}
+
+func TestWriteBehind(t *testing.T) {
+	store := &countingVersionedStore{
+		VersionedStore: storage.NewVersionedWrapper(storage.NewInMemoryStore()),
+	}
+	rootdir, factory, cleanup := testMount(t, func(factory *dinoNodeFactory) {
+		factory.metadata = store
+		// Long enough that only explicit flushes commit.
+		factory.commits = newCommitter(factory, time.Hour)
+	})
+	defer cleanup()
+
+	dir := filepath.Join(rootdir, "dir")
+	require.Nil(t, os.Mkdir(dir, 0755))
+	// Kept open, as closing commits.
+	var files []*os.File
+	for i := 0; i < 10; i++ {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("file%d", i)))
+		require.Nil(t, err)
+		_, err = f.Write([]byte("content"))
+		require.Nil(t, err)
+		files = append(files, f)
+	}
+	puts, putMany := store.counts()
+	assert.Equal(t, 0, puts)
+	assert.Empty(t, putMany)
+	dirty := make([]byte, 8)
+	n, err := unix.Getxattr(dir, "dino.dirty", dirty)
+	require.Nil(t, err)
+	assert.Equal(t, "true", string(dirty[:n]))
+
+	// Returns whether the version of the node in the store is the local one.
+	committed := func(node *dinoNode) bool {
+		node.mu.Lock()
+		key, want := node.key, node.version
+		node.mu.Unlock()
+		version, _, err := store.Get(key[:])
+		require.Nil(t, err)
+		return version == want
+	}
+
+	t.Run("fsync commits all pending changes in one batch", func(t *testing.T) {
+		require.Nil(t, files[0].Sync())
+		puts, putMany := store.counts()
+		assert.Equal(t, 0, puts)
+		// The root, the directory and its files.
+		assert.Equal(t, []int{12}, putMany)
+		n, err := unix.Getxattr(dir, "dino.dirty", dirty)
+		require.Nil(t, err)
+		assert.Equal(t, "false", string(dirty[:n]))
+		factory.root.mu.Lock()
+		child := factory.root.children["dir"]
+		factory.root.mu.Unlock()
+		for _, node := range []*dinoNode{factory.root, child} {
+			assert.True(t, committed(node))
+		}
+	})
+	t.Run("closing commits what's been written", func(t *testing.T) {
+		for _, f := range files {
+			require.Nil(t, f.Close())
+		}
+		puts, putMany := store.counts()
+		assert.Equal(t, 0, puts)
+		// The content of the first file was committed on fsync, that of
+		// each of the others on closing it.
+		assert.Equal(t, []int{12, 1, 1, 1, 1, 1, 1, 1, 1, 1}, putMany)
+		factory.root.mu.Lock()
+		parent := factory.root.children["dir"]
+		factory.root.mu.Unlock()
+		parent.mu.Lock()
+		node := parent.children["file9"]
+		parent.mu.Unlock()
+		assert.True(t, committed(node))
+	})
+	t.Run("nodes failing to commit are reloaded", func(t *testing.T) {
+		factory.root.mu.Lock()
+		parent := factory.root.children["dir"]
+		factory.root.mu.Unlock()
+		parent.mu.Lock()
+		node := parent.children["file1"]
+		parent.mu.Unlock()
+		// Another client committed a change meanwhile.
+		node.mu.Lock()
+		err := store.Put(node.version+1, node.key[:], node.serialize())
+		node.mu.Unlock()
+		require.Nil(t, err)
+		require.Nil(t, os.Chmod(filepath.Join(dir, "file1"), 0600))
+		f, err := os.Open(filepath.Join(dir, "file1"))
+		require.Nil(t, err)
+		assert.Equal(t, syscall.EIO, unwrapErrno(f.Sync()))
+		require.Nil(t, f.Close())
+		fi, err := os.Stat(filepath.Join(dir, "file1"))
+		require.Nil(t, err)
+		assert.Equal(t, os.FileMode(0644), fi.Mode())
+	})
+}
+
+func TestWriteBehindChargesOnCommit(t *testing.T) {
+	store := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	rootdir, factory, cleanup := testMount(t, func(factory *dinoNodeFactory) {
+		factory.metadata = store
+		factory.quotas = quota.NewTracker(store)
+		factory.commits = newCommitter(factory, time.Hour)
+	})
+	defer cleanup()
+	usage := func() quota.Counters {
+		usage, err := factory.quotas.Usage(quota.Volume)
+		require.Nil(t, err)
+		return usage
+	}
+
+	name := filepath.Join(rootdir, "file")
+	f, err := os.Create(name)
+	require.Nil(t, err)
+	_, err = f.Write(bytes.Repeat([]byte("x"), 100))
+	require.Nil(t, err)
+	assert.Equal(t, quota.Counters{}, usage())
+	require.Nil(t, f.Close())
+	// The root and the file.
+	assert.Equal(t, quota.Counters{Bytes: 100, Inodes: 2}, usage())
+
+	t.Run("changes failing to commit are not charged", func(t *testing.T) {
+		factory.root.mu.Lock()
+		node := factory.root.children["file"]
+		factory.root.mu.Unlock()
+		// Another client committed a change meanwhile.
+		node.mu.Lock()
+		err := store.Put(node.version+1, node.key[:], node.serialize())
+		node.mu.Unlock()
+		require.Nil(t, err)
+		err = ioutil.WriteFile(name, bytes.Repeat([]byte("x"), 200), 0644)
+		assert.Equal(t, syscall.EIO, unwrapErrno(err))
+		assert.Equal(t, quota.Counters{Bytes: 100, Inodes: 2}, usage())
+	})
+}
+
+func unwrapErrno(err error) error {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
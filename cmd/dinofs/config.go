@@ -1,60 +1,37 @@
 package main
 
 import (
-	"fmt"
-	"os"
-
-	"github.com/rogpeppe/rjson"
+	"github.com/nicolagi/dino/clientconfig"
 )
 
 type config struct {
+	clientconfig.Config
 	Mountpoint string `json:"mountpoint"`
 	Name       string `json:"name"`
-	Debug      bool   `json:"debug"`
 	DebugFUSE  bool   `json:"debug_fuse"`
 	LogPath    string `json:"log_path"`
 	DataPath   string `json:"data_path"`
 
-	Metadata struct {
-		Type string `json:"type"`
-
-		// Properties for "dino" type.
-		Address string `json:"address"`
-
-		// Properties for "dynamodb" type.
-		Profile string `json:"profile"`
-		Region  string `json:"region"`
-		Table   string `json:"table"`
-	} `json:"metadata"`
-
-	Blobs struct {
-		Type string `json:"type"`
+	// How long to wait, when unmounting, for blobs to be propagated to the
+	// remote store, e.g., "1m".
+	DrainTimeout string `json:"drain_timeout"`
 
-		// Properties for "dino" type.
-		Address string `json:"address"`
-
-		// Properties for "s3" type.
-		Profile string `json:"profile"`
-		Region  string `json:"region"`
-		Bucket  string `json:"bucket"`
-	} `json:"blobs"`
+	// Whether to bypass the page cache for all files, rather than only for those
+	// opened with O_DIRECT. Reads will then see writes from other clients as
+	// soon as they are received, at the cost of more FUSE requests.
+	DirectIO bool `json:"direct_io"`
 }
 
 func loadConfig(pathname string) (*config, error) {
-	f, err := os.Open(pathname)
-	if os.IsNotExist(err) {
-		// Hack: If it doesn't exist, treat pathname as a shortcut.
-		f, err = os.Open(os.ExpandEnv(fmt.Sprintf("$HOME/lib/dino/fs-%s.config", pathname)))
-	}
-	if err != nil {
+	var c config
+	if err := clientconfig.Load(pathname, &c); err != nil {
 		return nil, err
 	}
-	var c *config
-	err = rjson.NewDecoder(f).Decode(&c)
-	return c, err
+	return &c, nil
 }
 
 func (c *config) applyDefaultsForMissingProperties() {
+	c.ApplyDefaults()
 	if c.Mountpoint == "" {
 		c.Mountpoint = "/n/dino"
 	}
@@ -67,4 +44,7 @@ func (c *config) applyDefaultsForMissingProperties() {
 	if c.DataPath == "" {
 		c.DataPath = "$HOME/lib/dino/data"
 	}
+	if c.DrainTimeout == "" {
+		c.DrainTimeout = "1m"
+	}
 }
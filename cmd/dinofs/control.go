@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/nicolagi/dino/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// Name of the synthetic directory, at the root of the mount, exposing the
+// state of the running dinofs and accepting commands. It shadows any actual
+// directory entry with the same name.
+const controlName = ".dino"
+
+// Shown in place of secrets in the config file.
+const redacted = "<set>"
+
+const ctlUsage = `Write one of the following commands to this file:
+flush           save all pending changes
+loglevel LEVEL  set log level (debug, info, warning, error)
+`
+
+// controlDir is the synthetic directory exposing dinofs internals.
+type controlDir struct {
+	fs.Inode
+
+	factory *dinoNodeFactory
+	config  *config
+
+	// The remote store for blobs, could be nil.
+	remoteBlobs storage.Store
+}
+
+func newControlDir(factory *dinoNodeFactory, c *config, remoteBlobs storage.Store) *controlDir {
+	return &controlDir{
+		factory:     factory,
+		config:      c,
+		remoteBlobs: remoteBlobs,
+	}
+}
+
+func (dir *controlDir) OnAdd(ctx context.Context) {
+	files := map[string]*controlFile{
+		"status": {generate: dir.status},
+		"queue":  {generate: dir.queue},
+		"cache":  {generate: dir.cache},
+		"config": {generate: dir.configuration},
+		"ctl": {
+			generate: func() []byte { return []byte(ctlUsage) },
+			write:    dir.ctl,
+		},
+	}
+	for name, file := range files {
+		mode := uint32(fuse.S_IFREG | 0444)
+		if file.write != nil {
+			mode = fuse.S_IFREG | 0644
+		}
+		file.mode = mode
+		dir.AddChild(name, dir.NewPersistentInode(ctx, file, fs.StableAttr{
+			Mode: mode,
+			Ino:  dir.factory.inogen.next(),
+		}), false)
+	}
+}
+
+func (dir *controlDir) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = fuse.S_IFDIR | 0555
+	return 0
+}
+
+func (dir *controlDir) status() []byte {
+	var buf bytes.Buffer
+	report := func(what, kind string, store interface{}) {
+		reporter, ok := storage.Undecorate(store).(storage.StatusReporter)
+		if !ok {
+			fmt.Fprintf(&buf, "%s\t%s\n", what, kind)
+			return
+		}
+		s := reporter.Status()
+		state := "connected"
+		if !s.Connected {
+			state = "disconnected"
+		}
+		fmt.Fprintf(&buf, "%s\t%s\t%s\t%s", what, kind, s.Address, state)
+		if s.Err != nil {
+			fmt.Fprintf(&buf, "\t%v", s.Err)
+		}
+		buf.WriteByte('\n')
+	}
+	report("metadata", dir.config.Metadata.Type, dir.factory.metadata)
+	report("blobs", dir.config.Blobs.Type, dir.remoteBlobs)
+	return buf.Bytes()
+}
+
+func (dir *controlDir) queue() []byte {
+	pending := 0
+	if dir.factory.paired != nil {
+		pending = dir.factory.paired.Pending()
+	}
+	return []byte(fmt.Sprintf("writeback\t%d\n", pending))
+}
+
+func (dir *controlDir) cache() []byte {
+	var buf bytes.Buffer
+	nodes, contentBytes := dir.factory.cacheSizes()
+	fmt.Fprintf(&buf, "nodes\t%d\n", nodes)
+	fmt.Fprintf(&buf, "content\t%d bytes\n", contentBytes)
+	report := func(what string, stats storage.CacheStats) {
+		rate := 0.0
+		if total := stats.Hits + stats.Misses; total > 0 {
+			rate = float64(stats.Hits) / float64(total)
+		}
+		fmt.Fprintf(&buf, "%s\t%d hits\t%d misses\t%.2f hit rate\n", what, stats.Hits, stats.Misses, rate)
+	}
+	type cacheStatter interface {
+		CacheStats() storage.CacheStats
+	}
+	if s, ok := storage.Undecorate(dir.factory.metadata).(cacheStatter); ok {
+		report("metadata", s.CacheStats())
+	}
+	if dir.factory.paired != nil {
+		report("blobs", dir.factory.paired.CacheStats())
+	}
+	return buf.Bytes()
+}
+
+// The file is readable by anyone who can read the mount, so the credentials
+// the client presents to the servers are only said to be set.
+func (dir *controlDir) configuration() []byte {
+	c := *dir.config
+	if c.Metadata.Secret != "" {
+		c.Metadata.Secret = redacted
+	}
+	if c.Blobs.Token != "" {
+		c.Blobs.Token = redacted
+	}
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	e.SetIndent("", "\t")
+	if err := e.Encode(&c); err != nil {
+		return []byte(err.Error() + "\n")
+	}
+	return buf.Bytes()
+}
+
+func (dir *controlDir) ctl(b []byte) error {
+	for _, line := range strings.Split(string(b), "\n") {
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		logger := log.WithField("command", line)
+		switch {
+		case args[0] == "flush" && len(args) == 1:
+			if err := dir.factory.flush(); err != nil {
+				return err
+			}
+		case args[0] == "loglevel" && len(args) == 2:
+			level, err := log.ParseLevel(args[1])
+			if err != nil {
+				return err
+			}
+			log.SetLevel(level)
+		default:
+			return fmt.Errorf("%q: unknown command", line)
+		}
+		logger.Info("Executed control command")
+	}
+	return nil
+}
+
+// A file in the control directory. Its content is generated each time it's
+// opened. If it can be written to, each write is interpreted as a command.
+type controlFile struct {
+	fs.Inode
+	mode     uint32
+	generate func() []byte
+	write    func([]byte) error
+}
+
+type controlHandle struct {
+	content []byte
+}
+
+func (file *controlFile) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = file.mode
+	if h, ok := f.(*controlHandle); ok {
+		out.Size = uint64(len(h.content))
+	}
+	return 0
+}
+
+// Setattr accepts (and ignores) truncation, so that the shell can open the
+// file for writing.
+func (file *controlFile) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = file.mode
+	return 0
+}
+
+func (file *controlFile) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 && file.write == nil {
+		return nil, 0, syscall.EACCES
+	}
+	// Direct I/O, because the size is not known in advance.
+	return &controlHandle{content: file.generate()}, fuse.FOPEN_DIRECT_IO, 0
+}
+
+func (file *controlFile) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	h, ok := f.(*controlHandle)
+	if !ok || off >= int64(len(h.content)) {
+		return fuse.ReadResultData(nil), 0
+	}
+	end := off + int64(len(dest))
+	if end > int64(len(h.content)) {
+		end = int64(len(h.content))
+	}
+	return fuse.ReadResultData(h.content[off:end]), 0
+}
+
+func (file *controlFile) Write(ctx context.Context, f fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	if file.write == nil {
+		return 0, syscall.EACCES
+	}
+	if err := file.write(data); err != nil {
+		log.WithField("err", err).Warn("Control command failed")
+		return 0, syscall.EINVAL
+	}
+	return uint32(len(data)), 0
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlDir(t *testing.T) {
+	rootdir, _, cleanup := testMount(t)
+	defer cleanup()
+	control := filepath.Join(rootdir, controlName)
+	t.Run("is listed in the root", func(t *testing.T) {
+		names, err := ioutil.ReadDir(rootdir)
+		require.Nil(t, err)
+		var found bool
+		for _, fi := range names {
+			found = found || fi.Name() == controlName && fi.IsDir()
+		}
+		assert.True(t, found)
+	})
+	t.Run("cannot be removed or replaced", func(t *testing.T) {
+		assert.NotNil(t, os.Remove(control))
+		assert.NotNil(t, os.Mkdir(control, 0755))
+		_, err := os.Stat(control)
+		assert.Nil(t, err)
+	})
+	t.Run("files can be read", func(t *testing.T) {
+		for _, name := range []string{"status", "queue", "cache", "config", "ctl"} {
+			b, err := ioutil.ReadFile(filepath.Join(control, name))
+			assert.Nil(t, err)
+			assert.NotEmpty(t, b, name)
+		}
+		b, err := ioutil.ReadFile(filepath.Join(control, "queue"))
+		require.Nil(t, err)
+		assert.Equal(t, "writeback\t0\n", string(b))
+	})
+	t.Run("read-only files cannot be written", func(t *testing.T) {
+		err := ioutil.WriteFile(filepath.Join(control, "status"), []byte("flush\n"), 0644)
+		assert.NotNil(t, err)
+	})
+	t.Run("accepts commands", func(t *testing.T) {
+		defer log.SetLevel(log.GetLevel())
+		ctl := filepath.Join(control, "ctl")
+		require.Nil(t, ioutil.WriteFile(ctl, []byte("loglevel error\n"), 0644))
+		assert.Equal(t, log.ErrorLevel, log.GetLevel())
+		assert.Nil(t, ioutil.WriteFile(ctl, []byte("flush\n"), 0644))
+		assert.NotNil(t, ioutil.WriteFile(ctl, []byte("self-destruct\n"), 0644))
+	})
+	t.Run("cache reports nodes", func(t *testing.T) {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(rootdir, "cached"), []byte("12345"), 0644))
+		b, err := ioutil.ReadFile(filepath.Join(control, "cache"))
+		require.Nil(t, err)
+		assert.True(t, strings.Contains(string(b), "content\t5 bytes\n"), string(b))
+	})
+}
+
+func TestControlConfigRedactsSecrets(t *testing.T) {
+	var c config
+	c.Metadata.Type = "dino"
+	c.Metadata.Secret = "metadata-s3cret"
+	c.Blobs.Token = "blobs-t0ken"
+	dir := newControlDir(nil, &c, nil)
+	b := string(dir.configuration())
+	assert.NotContains(t, b, "metadata-s3cret")
+	assert.NotContains(t, b, "blobs-t0ken")
+	assert.Contains(t, b, `"secret": "<set>"`)
+	assert.Contains(t, b, `"token": "<set>"`)
+	assert.Contains(t, b, `"type": "dino"`)
+	// The configuration in use is left alone.
+	assert.Equal(t, "metadata-s3cret", c.Metadata.Secret)
+}
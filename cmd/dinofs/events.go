@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/nicolagi/dino/storage"
+	"github.com/nicolagi/dino/volume"
+	log "github.com/sirupsen/logrus"
+)
+
+// Name of the Unix socket, in the data directory, that streams events about
+// changes made by other clients.
+const eventsName = "events.sock"
+
+// Kinds of events.
+const (
+	eventCreated    = "created"
+	eventRemoved    = "removed"
+	eventModified   = "modified"
+	eventRenamed    = "renamed"
+	eventAttributes = "attributes"
+)
+
+// An event is sent to subscribers as a line of JSON. Paths are relative to
+// the mountpoint.
+type event struct {
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	Path    string    `json:"path"`
+	OldPath string    `json:"old_path,omitempty"`
+	Origin  string    `json:"origin,omitempty"`
+}
+
+// Changes waiting to be turned into events, and events waiting to be sent to
+// each subscriber, are dropped beyond this many. A subscriber missing events
+// is disconnected, to find out.
+const eventQueueLen = 1024
+
+// What's known of a node, to compare with what's received.
+type nodeSnapshot struct {
+	path       string
+	version    uint64
+	user       uint32
+	group      uint32
+	mode       uint32
+	time       time.Time
+	contentKey []byte
+	inline     bool
+	xattrs     map[string][]byte
+	// Nil unless the node is a directory.
+	children map[string][nodeKeyLen]byte
+}
+
+type nodeChange struct {
+	key    [nodeKeyLen]byte
+	before nodeSnapshot
+}
+
+// The event feed turns changes received from other clients into events, and
+// streams them to the processes connected to a Unix socket. Events are
+// derived by comparing what was known of a node with its latest version, so
+// changes received in quick succession may be reported as fewer events. Only
+// nodes the kernel knows the path of are tracked.
+type eventFeed struct {
+	metadata storage.VersionedStore
+	pathname string
+	listener net.Listener
+	changes  chan nodeChange
+
+	// What was last received for each node, in case the node isn't reloaded
+	// before the next change is received. Only accessed by the run method.
+	last map[[nodeKeyLen]byte]nodeSnapshot
+
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+type subscriber struct {
+	conn   net.Conn
+	events chan []byte
+}
+
+// Listens on the Unix socket at the given pathname, unless another process
+// is listening on it already.
+func newEventFeed(metadata storage.VersionedStore, pathname string) (*eventFeed, error) {
+	if conn, err := net.Dial("unix", pathname); err == nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%q: already in use", pathname)
+	}
+	if err := os.Remove(pathname); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", pathname)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(pathname, 0600); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	f := &eventFeed{
+		metadata:    metadata,
+		pathname:    pathname,
+		listener:    listener,
+		changes:     make(chan nodeChange, eventQueueLen),
+		last:        make(map[[nodeKeyLen]byte]nodeSnapshot),
+		subscribers: make(map[*subscriber]struct{}),
+	}
+	go f.accept()
+	go f.run()
+	return f, nil
+}
+
+func (f *eventFeed) close() {
+	_ = f.listener.Close()
+	f.mu.Lock()
+	for s := range f.subscribers {
+		f.unsubscribeLocked(s)
+	}
+	f.mu.Unlock()
+}
+
+// Tells whether anyone is listening, so that changes needn't be tracked
+// otherwise.
+func (f *eventFeed) active() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.subscribers) > 0
+}
+
+func (f *eventFeed) enqueue(c nodeChange) {
+	select {
+	case f.changes <- c:
+	default:
+		log.WithField("key", fmt.Sprintf("%.10x", c.key[:])).Warn("Dropping change, event queue full")
+	}
+}
+
+func (f *eventFeed) accept() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			log.WithField("err", err).Debug("Stopped accepting event subscribers")
+			return
+		}
+		s := &subscriber{conn: conn, events: make(chan []byte, eventQueueLen)}
+		f.mu.Lock()
+		f.subscribers[s] = struct{}{}
+		f.mu.Unlock()
+		go f.serve(s)
+	}
+}
+
+func (f *eventFeed) serve(s *subscriber) {
+	go func() {
+		// Subscribers aren't expected to send anything, but notice when they
+		// go away.
+		_, _ = io.Copy(ioutil.Discard, s.conn)
+		f.unsubscribe(s)
+	}()
+	for b := range s.events {
+		if _, err := s.conn.Write(b); err != nil {
+			f.unsubscribe(s)
+		}
+	}
+	_ = s.conn.Close()
+}
+
+func (f *eventFeed) unsubscribe(s *subscriber) {
+	f.mu.Lock()
+	f.unsubscribeLocked(s)
+	f.mu.Unlock()
+}
+
+func (f *eventFeed) unsubscribeLocked(s *subscriber) {
+	if _, ok := f.subscribers[s]; ok {
+		delete(f.subscribers, s)
+		close(s.events)
+	}
+}
+
+func (f *eventFeed) publish(e event) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.WithField("err", err).Error("Could not encode event")
+		return
+	}
+	b = append(b, '\n')
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for s := range f.subscribers {
+		select {
+		case s.events <- b:
+		default:
+			log.Warn("Disconnecting slow event subscriber")
+			f.unsubscribeLocked(s)
+		}
+	}
+}
+
+func (f *eventFeed) run() {
+	for c := range f.changes {
+		version, b, err := f.metadata.Get(c.key[:])
+		var m volume.Metadata
+		if err == nil {
+			err = m.Decode(b)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"key": fmt.Sprintf("%.10x", c.key[:]),
+				"err": err,
+			}).Warn("Could not load changed node")
+			continue
+		}
+		before := c.before
+		if last, ok := f.last[c.key]; ok && last.version > before.version {
+			before = last
+		}
+		if version <= before.version {
+			continue
+		}
+		after := snapshotMetadata(before.path, version, &m)
+		now := time.Now()
+		for _, e := range diffSnapshots(&before, &after) {
+			e.Time = now
+			e.Origin = m.Origin
+			f.publish(e)
+		}
+		f.last[c.key] = after
+	}
+}
+
+func snapshotMetadata(path string, version uint64, m *volume.Metadata) nodeSnapshot {
+	s := nodeSnapshot{
+		path:       path,
+		version:    version,
+		user:       m.User,
+		group:      m.Group,
+		mode:       m.Mode,
+		time:       m.Time,
+		contentKey: m.ContentKey,
+		inline:     m.Inline,
+		xattrs:     m.Xattrs,
+	}
+	if m.Children != nil {
+		s.children = make(map[string][nodeKeyLen]byte, len(m.Children))
+		for name, key := range m.Children {
+			s.children[name] = key
+		}
+	}
+	return s
+}
+
+// Returns what's known of the node, unless it's not loaded or not reachable
+// from the root by the kernel. Must be called with the node locked.
+func (node *dinoNode) snapshot() (s nodeSnapshot, ok bool) {
+	if node.mode == modeNotLoaded {
+		return s, false
+	}
+	if s.path, ok = node.path(); !ok {
+		return s, false
+	}
+	s.version = node.version
+	s.user = node.user
+	s.group = node.group
+	s.mode = node.mode
+	s.time = node.time
+	s.contentKey = dup(node.contentKey)
+	s.inline = node.inline
+	s.xattrs = make(map[string][]byte, len(node.xattrs))
+	for attr, value := range node.xattrs {
+		s.xattrs[attr] = value
+	}
+	if node.children != nil {
+		s.children = make(map[string][nodeKeyLen]byte, len(node.children))
+		for name, child := range node.children {
+			s.children[name] = child.key
+		}
+	}
+	return s, true
+}
+
+// Returns the path of the node relative to the root, as known to the kernel.
+func (node *dinoNode) path() (string, bool) {
+	root := node.factory.root.EmbeddedInode()
+	var names []string
+	for p := node.EmbeddedInode(); p != root; {
+		name, parent := p.Parent()
+		if parent == nil {
+			return "", false
+		}
+		names = append(names, name)
+		p = parent
+	}
+	if len(names) == 0 {
+		return ".", true
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return strings.Join(names, "/"), true
+}
+
+// Derives the events that explain the change. Renames across directories
+// are changes to two directories, and look like a removal and a creation.
+func diffSnapshots(before, after *nodeSnapshot) (events []event) {
+	join := func(name string) string {
+		if before.path == "." {
+			return name
+		}
+		return before.path + "/" + name
+	}
+	isDir := after.mode&fuse.S_IFDIR != 0
+	if before.children != nil && after.children != nil {
+		added := make(map[[nodeKeyLen]byte]string)
+		for _, name := range sortedNames(after.children) {
+			if key := after.children[name]; before.children[name] != key {
+				added[key] = name
+			}
+		}
+		for _, name := range sortedNames(before.children) {
+			key := before.children[name]
+			if after.children[name] == key {
+				continue
+			}
+			if newName, ok := added[key]; ok {
+				events = append(events, event{Op: eventRenamed, Path: join(newName), OldPath: join(name)})
+				delete(added, key)
+			} else {
+				events = append(events, event{Op: eventRemoved, Path: join(name)})
+			}
+		}
+		for _, name := range sortedNames(after.children) {
+			if added[after.children[name]] == name {
+				events = append(events, event{Op: eventCreated, Path: join(name)})
+			}
+		}
+	} else if before.inline != after.inline || !bytes.Equal(before.contentKey, after.contentKey) {
+		return append(events, event{Op: eventModified, Path: before.path})
+	}
+	if before.user != after.user || before.group != after.group || before.mode != after.mode ||
+		(!isDir && !before.time.Equal(after.time)) || !equalXattrs(before.xattrs, after.xattrs) {
+		events = append(events, event{Op: eventAttributes, Path: before.path})
+	}
+	return events
+}
+
+func sortedNames(children map[string][nodeKeyLen]byte) []string {
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func equalXattrs(a, b map[string][]byte) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
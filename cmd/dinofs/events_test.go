@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/storage"
+	"github.com/nicolagi/dino/volume"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Tells the factory about each put, as the metadata server would.
+type broadcastingStore struct {
+	storage.VersionedStore
+	factory *dinoNodeFactory
+}
+
+func (s *broadcastingStore) Put(version uint64, key []byte, value []byte) error {
+	if err := s.VersionedStore.Put(version, key, value); err != nil {
+		return err
+	}
+	s.factory.invalidateCache(message.NewPutMessage(0, string(key), string(value), version))
+	return nil
+}
+
+func TestChangeEvents(t *testing.T) {
+	rootdir, factory, cleanup := testMount(t, func(factory *dinoNodeFactory) {
+		factory.metadata = storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	})
+	defer cleanup()
+	require.Nil(t, os.Mkdir(filepath.Join(rootdir, "dir"), 0755))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(rootdir, "dir/file"), []byte("hello"), 0644))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(rootdir, "dir/old"), nil, 0644))
+
+	datadir, err := ioutil.TempDir("", "dinofs-test-")
+	require.Nil(t, err)
+	defer func() { _ = os.RemoveAll(datadir) }()
+	pathname := filepath.Join(datadir, eventsName)
+	factory.events, err = newEventFeed(factory.metadata, pathname)
+	require.Nil(t, err)
+	defer factory.events.close()
+	_, err = newEventFeed(factory.metadata, pathname)
+	assert.NotNil(t, err, "socket should be in use")
+
+	conn, err := net.Dial("unix", pathname)
+	require.Nil(t, err)
+	defer func() { _ = conn.Close() }()
+	require.Eventually(t, factory.events.active, time.Second, 10*time.Millisecond)
+
+	teammate := volume.New(&broadcastingStore{factory.metadata, factory}, factory.blobs, volume.WithOrigin("teammate@elsewhere"))
+	scanner := bufio.NewScanner(conn)
+	// Changes to a node received in quick succession can result in fewer
+	// events, so wait for each before the next change.
+	expect := func(t *testing.T, want event) {
+		t.Helper()
+		require.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		require.True(t, scanner.Scan(), "expected %+v, got error %v", want, scanner.Err())
+		var got event
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), &got))
+		assert.False(t, got.Time.IsZero())
+		assert.Equal(t, "teammate@elsewhere", got.Origin)
+		got.Time, got.Origin = time.Time{}, ""
+		assert.Equal(t, want, got)
+	}
+
+	require.Nil(t, teammate.WriteFile("dir/file", []byte("hello, world"), 0644))
+	expect(t, event{Op: eventModified, Path: "dir/file"})
+	require.Nil(t, teammate.Rename("dir/old", "dir/new"))
+	expect(t, event{Op: eventRenamed, Path: "dir/new", OldPath: "dir/old"})
+	require.Nil(t, teammate.WriteFile("dir/created", nil, 0644))
+	expect(t, event{Op: eventCreated, Path: "dir/created"})
+	require.Nil(t, teammate.Remove("dir/new"))
+	expect(t, event{Op: eventRemoved, Path: "dir/new"})
+	require.Nil(t, teammate.Chmod("dir/file", 0600))
+	expect(t, event{Op: eventAttributes, Path: "dir/file"})
+	require.Nil(t, teammate.WriteFile("top", nil, 0644))
+	expect(t, event{Op: eventCreated, Path: "top"})
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/nicolagi/dino/quota"
+	"github.com/nicolagi/dino/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of problems found by the checker.
+const (
+	problemDangling     = "dangling"
+	problemMissingBlob  = "missing-blob"
+	problemMalformed    = "malformed"
+	problemInconsistent = "inconsistent"
+)
+
+// What the checker reports nodes not reachable from the root as.
+const orphan = "orphan"
+
+// Checks the consistency of a volume, optionally repairing it by committing
+// fixes through the metadata store.
+type checker struct {
+	metadata storage.VersionedStore
+	blobs    storage.BlobStore
+
+	// Whether to check that contents can be fetched, which means fetching all
+	// of them.
+	contents bool
+	repair   bool
+	// Whether to look for orphans, i.e., nodes not reachable from the root.
+	// They're not problems: dinofs doesn't delete nodes when unlinking them,
+	// and gc collects them.
+	orphans bool
+	// If not empty, in repair mode, orphans are linked into the directory
+	// with this name, under the root, created if needed.
+	lostFound string
+	out       io.Writer
+
+	// Used to decode and save nodes.
+	factory *dinoNodeFactory
+	// The keys of the nodes reachable from the root.
+	reached map[[nodeKeyLen]byte]bool
+
+	problems int
+	repaired int
+	found    int
+	linked   int
+}
+
+func fsckCommand(c *config, args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "commit fixes for the problems found, where possible")
+	orphans := flags.Bool("orphans", false, "report nodes not reachable from the root, e.g., deleted files not yet collected by gc")
+	lostFound := flags.String("lostfound", "", "with -orphans and -repair, link orphans into the directory with this name under the root, e.g., lost+found")
+	contents := flags.Bool("contents", true, "check that all contents can be fetched from the blob store")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *lostFound != "" && !*orphans {
+		return errors.New("-lostfound requires -orphans")
+	}
+	metadata, closeMetadata, err := c.VersionedStore(nil)
+	if err != nil {
+		return err
+	}
+	defer closeMetadata()
+	remote, err := c.RemoteStore()
+	if err != nil {
+		return err
+	}
+	blobs, err := c.BlobStore(remote)
+	if err != nil {
+		return err
+	}
+	fsck := &checker{
+		metadata:  metadata,
+		blobs:     blobs,
+		contents:  *contents,
+		repair:    *repair,
+		orphans:   *orphans,
+		lostFound: *lostFound,
+		out:       os.Stdout,
+	}
+	return fsck.run()
+}
+
+func (c *checker) run() error {
+	c.factory = &dinoNodeFactory{metadata: c.metadata}
+	c.reached = make(map[[nodeKeyLen]byte]bool)
+	var rootKey [nodeKeyLen]byte
+	root := c.factory.existingNode("root", rootKey)
+	c.factory.root = root
+	if err := root.loadMetadata(rootKey); errors.Is(err, storage.ErrNotFound) {
+		// An empty file system, although there could be orphans.
+		root.mode = fuse.S_IFDIR
+		root.children = make(map[string]*dinoNode)
+	} else if errors.Is(err, errMalformedNode) {
+		c.report(problemMalformed, "/", rootKey, false)
+		return fmt.Errorf("root node is malformed, can't check further")
+	} else if err != nil {
+		return err
+	} else {
+		c.reached[rootKey] = true
+		if err := c.checkNode(root, "/"); err != nil {
+			return err
+		}
+	}
+	if root.mode&fuse.S_IFDIR == 0 {
+		return fmt.Errorf("root node is not a directory, can't check further")
+	}
+	if err := c.checkDir(root, "/"); err != nil {
+		return err
+	}
+	if c.orphans {
+		if err := c.checkOrphans(root); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(c.out, "%d orphans, %d linked\n", c.found, c.linked); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(c.out, "%d problems, %d repaired\n", c.problems, c.repaired); err != nil {
+		return err
+	}
+	if c.problems > c.repaired {
+		return fmt.Errorf("%d problems not repaired", c.problems-c.repaired)
+	}
+	return nil
+}
+
+func (c *checker) report(kind string, pathname string, key [nodeKeyLen]byte, repaired bool) {
+	c.problems++
+	suffix := ""
+	if repaired {
+		c.repaired++
+		suffix = "\trepaired"
+	}
+	_, _ = fmt.Fprintf(c.out, "%s\t%s\t%x%s\n", kind, pathname, key, suffix)
+}
+
+// Checks the node itself (not its children), which is already loaded.
+func (c *checker) checkNode(node *dinoNode, pathname string) error {
+	isDir := node.mode&fuse.S_IFDIR != 0
+	if isDir && len(node.contentKey) > 0 {
+		// A directory with content, e.g., a file whose type got lost.
+		if c.repair {
+			node.contentKey = nil
+			node.inline = false
+			if err := node.saveMetadata(); err != nil {
+				return fmt.Errorf("%s: %w", pathname, err)
+			}
+		}
+		c.report(problemInconsistent, pathname, node.key, c.repair)
+	}
+	if !isDir && len(node.children) > 0 {
+		// A file with children. Dropping them makes them orphans, which can
+		// be linked into lost+found.
+		if c.repair {
+			node.children = nil
+			if err := node.saveMetadata(); err != nil {
+				return fmt.Errorf("%s: %w", pathname, err)
+			}
+		}
+		c.report(problemInconsistent, pathname, node.key, c.repair)
+	}
+	if c.contents && !node.inline && len(node.contentKey) > 0 {
+		if _, err := c.blobs.Get(node.contentKey); errors.Is(err, storage.ErrNotFound) {
+			// Nothing to repair: the content may not have been propagated yet.
+			c.report(problemMissingBlob, pathname, node.key, false)
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", pathname, err)
+		}
+	}
+	return nil
+}
+
+// Checks the children of the directory, recursively.
+func (c *checker) checkDir(dir *dinoNode, pathname string) error {
+	var names []string
+	for name := range dir.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var unlinked []string
+	for _, name := range names {
+		child := dir.children[name]
+		childPath := path.Join(pathname, name)
+		if c.reached[child.key] {
+			// Linked more than once, which dinofs never does, but it's
+			// harmless, and it would be a loop if it's an ancestor.
+			continue
+		}
+		c.reached[child.key] = true
+		if err := child.loadMetadata(child.key); errors.Is(err, storage.ErrNotFound) {
+			c.report(problemDangling, childPath, child.key, c.repair)
+			unlinked = append(unlinked, name)
+			continue
+		} else if errors.Is(err, errMalformedNode) {
+			// Unlinked, and discarded, if possible, so that it doesn't
+			// show up as an orphan next time.
+			if c.repair {
+				if _, err := c.discard(child.key); err != nil {
+					return fmt.Errorf("%s: %w", childPath, err)
+				}
+			}
+			c.report(problemMalformed, childPath, child.key, c.repair)
+			unlinked = append(unlinked, name)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", childPath, err)
+		}
+		if err := c.checkNode(child, childPath); err != nil {
+			return err
+		}
+		if child.mode&fuse.S_IFDIR != 0 {
+			if err := c.checkDir(child, childPath); err != nil {
+				return err
+			}
+		}
+	}
+	if len(unlinked) > 0 && c.repair {
+		for _, name := range unlinked {
+			delete(dir.children, name)
+		}
+		if err := dir.saveMetadata(); err != nil {
+			return fmt.Errorf("%s: %w", pathname, err)
+		}
+	}
+	return nil
+}
+
+// Reports nodes in the metadata store not reachable from the root, and, if
+// repairing, links them into lost+found. Orphans reachable from other orphans
+// are neither reported nor linked separately. Orphans don't count as problems.
+func (c *checker) checkOrphans(root *dinoNode) error {
+	var orphans [][nodeKeyLen]byte
+	err := storage.ForEachKey(storage.Undecorate(c.metadata), func(key []byte) error {
+		var k [nodeKeyLen]byte
+		if len(key) != nodeKeyLen || quota.IsKey(key) {
+			return nil
+		}
+		copy(k[:], key)
+		if !c.reached[k] {
+			orphans = append(orphans, k)
+		}
+		return nil
+	})
+	if errors.Is(err, storage.ErrNotSupported) {
+		log.WithField("err", err).Warn("Can't look for orphans")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	linkable := make(map[[nodeKeyLen]byte]bool)
+	referenced := make(map[[nodeKeyLen]byte]bool)
+	for _, key := range orphans {
+		node := &dinoNode{factory: c.factory}
+		if err := node.loadMetadata(key); errors.Is(err, errMalformedNode) {
+			discarded := false
+			if c.repair {
+				if discarded, err = c.discard(key); err != nil {
+					return err
+				}
+			}
+			c.report(problemMalformed, "", key, discarded)
+			continue
+		} else if errors.Is(err, storage.ErrNotFound) {
+			// Deleted meanwhile.
+			continue
+		} else if err != nil {
+			return err
+		}
+		linkable[key] = true
+		for _, child := range node.children {
+			referenced[child.key] = true
+		}
+	}
+	var lostFound *dinoNode
+	for _, key := range orphans {
+		if !linkable[key] || referenced[key] {
+			continue
+		}
+		link := c.repair && c.lostFound != ""
+		if link && lostFound == nil {
+			var err error
+			if lostFound, err = c.lostFoundDir(root); err != nil {
+				return err
+			}
+		}
+		suffix := ""
+		if link {
+			lostFound.children[fmt.Sprintf("%x", key)] = c.factory.existingNode("", key)
+			c.linked++
+			suffix = "\tlinked"
+		}
+		c.found++
+		if _, err := fmt.Fprintf(c.out, "%s\t\t%x%s\n", orphan, key, suffix); err != nil {
+			return err
+		}
+	}
+	if lostFound != nil {
+		if err := lostFound.saveMetadata(); err != nil {
+			return fmt.Errorf("%s: %w", c.lostFound, err)
+		}
+	}
+	return nil
+}
+
+// Deletes the node from the metadata store, if the latter supports deleting.
+func (c *checker) discard(key [nodeKeyLen]byte) (deleted bool, err error) {
+	err = storage.Delete(storage.Undecorate(c.metadata), key[:])
+	if errors.Is(err, storage.ErrNotSupported) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Returns the lost+found directory, creating it if needed.
+func (c *checker) lostFoundDir(root *dinoNode) (*dinoNode, error) {
+	if dir, ok := root.children[c.lostFound]; ok {
+		if dir.mode&fuse.S_IFDIR == 0 {
+			return nil, fmt.Errorf("%s: not a directory", c.lostFound)
+		}
+		return dir, nil
+	}
+	dir, err := c.factory.allocNode()
+	if err != nil {
+		return nil, err
+	}
+	dir.name = c.lostFound
+	dir.user = root.user
+	dir.group = root.group
+	dir.mode = fuse.S_IFDIR | 0700
+	dir.children = make(map[string]*dinoNode)
+	if err := dir.saveMetadata(); err != nil {
+		return nil, err
+	}
+	root.children[c.lostFound] = dir
+	if err := root.saveMetadata(); err != nil {
+		return nil, err
+	}
+	c.reached[dir.key] = true
+	return dir, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFsck(t *testing.T) {
+	metadataStore := storage.NewInMemoryStore()
+	metadata := storage.NewVersionedWrapper(metadataStore)
+	blobStore := storage.NewInMemoryStore()
+	blobs := storage.NewBlobStore(blobStore)
+	rootdir, factory, cleanup := testMount(t, func(factory *dinoNodeFactory) {
+		factory.metadata = metadata
+		factory.blobs = blobs
+	})
+	defer cleanup()
+
+	require.Nil(t, os.Mkdir(filepath.Join(rootdir, "dir"), 0755))
+	for _, name := range []string{"dangling", "malformed", "missing", "dir/ok"} {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(rootdir, name), []byte(name), 0644))
+	}
+	require.Nil(t, os.Symlink("ok", filepath.Join(rootdir, "dir/link")))
+
+	// Break things behind the file system's back.
+	danglingKey := lookupKey(t, factory, "dangling")
+	require.Nil(t, storage.Delete(metadataStore, danglingKey[:]))
+	malformedKey := lookupKey(t, factory, "malformed")
+	version, _, err := metadata.Get(malformedKey[:])
+	require.Nil(t, err)
+	require.Nil(t, metadata.Put(version+1, malformedKey[:], []byte("\xffdn\xff\x01\x03")))
+	missingKey := lookupKey(t, factory, "missing")
+	missing := loadNode(t, metadata, missingKey)
+	require.Nil(t, storage.Delete(blobStore, storage.StoredKey(blobs, missing.contentKey)))
+	// A directory with content.
+	dirKey := lookupKey(t, factory, "dir")
+	inconsistent := loadNode(t, metadata, dirKey)
+	inconsistent.contentKey = []byte("content")
+	inconsistent.inline = true
+	require.Nil(t, inconsistent.saveMetadata())
+	// An orphan directory with a child, as if its creation had been
+	// interrupted.
+	orphan := &dinoNode{factory: &dinoNodeFactory{metadata: metadata}}
+	orphan.key[0] = 1
+	orphan.mode = fuse.S_IFDIR | 0755
+	orphanChild := &dinoNode{factory: orphan.factory}
+	orphanChild.key[0] = 2
+	orphanChild.mode = fuse.S_IFREG | 0644
+	orphan.children = map[string]*dinoNode{"child": orphanChild}
+	require.Nil(t, orphan.saveMetadata())
+	require.Nil(t, orphanChild.saveMetadata())
+
+	fsck := func(repair bool) (string, error) {
+		var out bytes.Buffer
+		c := &checker{
+			metadata:  metadata,
+			blobs:     blobs,
+			contents:  true,
+			repair:    repair,
+			orphans:   true,
+			lostFound: "lost+found",
+			out:       &out,
+		}
+		err := c.run()
+		return out.String(), err
+	}
+
+	out, err := fsck(false)
+	assert.NotNil(t, err)
+	assert.Equal(t, fmt.Sprintf(""+
+		"dangling\t/dangling\t%x\n"+
+		"inconsistent\t/dir\t%x\n"+
+		"malformed\t/malformed\t%x\n"+
+		"missing-blob\t/missing\t%x\n"+
+		"orphan\t\t%x\n"+
+		"1 orphans, 0 linked\n"+
+		"4 problems, 0 repaired\n",
+		danglingKey, dirKey, malformedKey, missingKey, orphan.key), out)
+
+	out, err = fsck(true)
+	assert.NotNil(t, err)
+	assert.Equal(t, fmt.Sprintf(""+
+		"dangling\t/dangling\t%x\trepaired\n"+
+		"inconsistent\t/dir\t%x\trepaired\n"+
+		"malformed\t/malformed\t%x\trepaired\n"+
+		"missing-blob\t/missing\t%x\n"+
+		"orphan\t\t%x\tlinked\n"+
+		"1 orphans, 1 linked\n"+
+		"4 problems, 3 repaired\n",
+		danglingKey, dirKey, malformedKey, missingKey, orphan.key), out)
+
+	// The repairs are committed, and only the missing blob remains.
+	out, err = fsck(true)
+	assert.NotNil(t, err)
+	assert.Equal(t, fmt.Sprintf(""+
+		"missing-blob\t/missing\t%x\n"+
+		"0 orphans, 0 linked\n"+
+		"1 problems, 0 repaired\n",
+		missingKey), out)
+	root := loadNode(t, metadata, [nodeKeyLen]byte{})
+	require.Contains(t, root.children, "lost+found")
+	lostFound := loadNode(t, metadata, root.children["lost+found"].key)
+	assert.Contains(t, lostFound.children, fmt.Sprintf("%x", orphan.key))
+	assert.NotContains(t, root.children, "dangling")
+	assert.NotContains(t, root.children, "malformed")
+	_, _, err = metadata.Get(malformedKey[:])
+	assert.True(t, errors.Is(err, storage.ErrNotFound))
+
+	// Once the blob is back, all is well.
+	_, err = blobs.Put([]byte("missing"))
+	require.Nil(t, err)
+	out, err = fsck(false)
+	assert.Nil(t, err)
+	assert.Equal(t, "0 orphans, 0 linked\n0 problems, 0 repaired\n", out)
+}
+
+func TestFsckDeletedFiles(t *testing.T) {
+	metadata := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	blobs := storage.NewBlobStore(storage.NewInMemoryStore())
+	rootdir, factory, cleanup := testMount(t, func(factory *dinoNodeFactory) {
+		factory.metadata = metadata
+		factory.blobs = blobs
+	})
+	defer cleanup()
+	name := filepath.Join(rootdir, "deleted")
+	require.Nil(t, ioutil.WriteFile(name, []byte("deleted"), 0644))
+	key := lookupKey(t, factory, "deleted")
+	require.Nil(t, os.Remove(name))
+
+	fsck := func(orphans bool) (string, error) {
+		var out bytes.Buffer
+		c := &checker{
+			metadata:  metadata,
+			blobs:     blobs,
+			contents:  true,
+			repair:    true,
+			orphans:   orphans,
+			lostFound: "lost+found",
+			out:       &out,
+		}
+		err := c.run()
+		return out.String(), err
+	}
+
+	// The node of the deleted file is left for gc to collect, which is fine.
+	out, err := fsck(false)
+	assert.Nil(t, err)
+	assert.Equal(t, "0 problems, 0 repaired\n", out)
+	root := loadNode(t, metadata, [nodeKeyLen]byte{})
+	assert.Empty(t, root.children)
+
+	out, err = fsck(true)
+	assert.Nil(t, err)
+	assert.Equal(t, fmt.Sprintf(""+
+		"orphan\t\t%x\tlinked\n"+
+		"1 orphans, 1 linked\n"+
+		"0 problems, 0 repaired\n",
+		key), out)
+}
+
+func loadNode(t *testing.T, metadata storage.VersionedStore, key [nodeKeyLen]byte) *dinoNode {
+	t.Helper()
+	node := &dinoNode{factory: &dinoNodeFactory{metadata: metadata}}
+	require.Nil(t, node.loadMetadata(key))
+	return node
+}
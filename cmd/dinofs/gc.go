@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/nicolagi/dino/quota"
+	"github.com/nicolagi/dino/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// The keys reachable from the roots, as stored in the innermost metadata and
+// blob stores.
+type reachable struct {
+	nodes map[string]bool
+	blobs map[string]bool
+}
+
+// A mark-and-sweep garbage collector, deleting nodes and blobs not reachable
+// from the roots.
+type collector struct {
+	metadata storage.VersionedStore
+	blobs    storage.BlobStore
+	roots    [][nodeKeyLen]byte
+	grace    time.Duration
+	dryRun   bool
+	out      io.Writer
+
+	// The chunk keys of each content key, which are immutable, so that
+	// contents are fetched only once.
+	chunks map[string][][]byte
+}
+
+func gcCommand(c *config, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	grace := flags.Duration("grace", 10*time.Minute, "time to wait between the two marking phases, for in-flight changes to be committed")
+	dryRun := flags.Bool("n", false, "only report what would be deleted")
+	var roots rootsFlag
+	flags.Var(&roots, "root", "hex-encoded key of a node to keep, with its descendants, in addition to the root (can be repeated)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	metadata, closeMetadata, err := c.VersionedStore(nil)
+	if err != nil {
+		return err
+	}
+	defer closeMetadata()
+	remote, err := c.RemoteStore()
+	if err != nil {
+		return err
+	}
+	blobs, err := c.BlobStore(remote)
+	if err != nil {
+		return err
+	}
+	gc := &collector{
+		metadata: metadata,
+		blobs:    blobs,
+		roots:    append([][nodeKeyLen]byte{{}}, roots...),
+		grace:    *grace,
+		dryRun:   *dryRun,
+		out:      os.Stdout,
+		chunks:   make(map[string][][]byte),
+	}
+	return gc.run()
+}
+
+type rootsFlag [][nodeKeyLen]byte
+
+func (f *rootsFlag) String() string {
+	return fmt.Sprintf("%x", [][nodeKeyLen]byte(*f))
+}
+
+func (f *rootsFlag) Set(s string) error {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != nodeKeyLen {
+		return fmt.Errorf("%q: not a hex-encoded node key", s)
+	}
+	var key [nodeKeyLen]byte
+	copy(key[:], b)
+	*f = append(*f, key)
+	return nil
+}
+
+func (gc *collector) run() error {
+	// Only keys listed before marking are candidates for deletion. Nodes and
+	// blobs put afterwards, e.g., by a client writing back changes, are never
+	// deleted.
+	nodes, err := listKeys(storage.Undecorate(gc.metadata))
+	if err != nil {
+		return fmt.Errorf("listing metadata: %w", err)
+	}
+	blobs, err := listKeys(storage.Undecorate(gc.blobs))
+	if err != nil {
+		return fmt.Errorf("listing blobs: %w", err)
+	}
+	// A blob can be put before the node referencing it is committed, and a node
+	// before its parent is, so that they're not reachable yet. Marking again
+	// after the grace period finds them, if they've been committed by then.
+	live, err := gc.mark()
+	if err != nil {
+		return err
+	}
+	if gc.grace > 0 {
+		log.WithField("grace", gc.grace).Info("Waiting before marking again")
+		time.Sleep(gc.grace)
+	}
+	again, err := gc.mark()
+	if err != nil {
+		return err
+	}
+	for key := range again.nodes {
+		live.nodes[key] = true
+	}
+	for key := range again.blobs {
+		live.blobs[key] = true
+	}
+	var deletedNodes, deletedBlobs int
+	for _, key := range nodes {
+		// Other keys, e.g., for quotas, are not nodes.
+		if len(key) != nodeKeyLen || quota.IsKey(key) || live.nodes[string(key)] {
+			continue
+		}
+		if err := gc.delete(gc.metadata, "node", key); err != nil {
+			return err
+		}
+		deletedNodes++
+	}
+	for _, key := range blobs {
+		if live.blobs[string(key)] {
+			continue
+		}
+		if err := gc.delete(gc.blobs, "blob", key); err != nil {
+			return err
+		}
+		deletedBlobs++
+	}
+	verb := "deleted"
+	if gc.dryRun {
+		verb = "would delete"
+	}
+	_, err = fmt.Fprintf(gc.out, "nodes\t%d reachable\t%s %d\nblobs\t%d reachable\t%s %d\n",
+		len(live.nodes), verb, deletedNodes, len(live.blobs), verb, deletedBlobs)
+	return err
+}
+
+func listKeys(store interface{}) (keys [][]byte, err error) {
+	err = storage.ForEachKey(store, func(key []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
+}
+
+func (gc *collector) delete(store interface{}, kind string, key []byte) error {
+	log.WithFields(log.Fields{
+		"kind":    kind,
+		"key":     fmt.Sprintf("%x", key),
+		"dry-run": gc.dryRun,
+	}).Debug("Unreachable")
+	if gc.dryRun {
+		return nil
+	}
+	if err := storage.Delete(storage.Undecorate(store), key); err != nil {
+		return fmt.Errorf("deleting %s %x: %w", kind, key, err)
+	}
+	return nil
+}
+
+// Walks the tree from the roots. Any error other than a missing node aborts
+// the collection, as deleting keys based on an incomplete walk could delete
+// reachable ones.
+func (gc *collector) mark() (live reachable, err error) {
+	live = reachable{
+		nodes: make(map[string]bool),
+		blobs: make(map[string]bool),
+	}
+	// A throwaway factory, only used to decode nodes.
+	factory := &dinoNodeFactory{metadata: gc.metadata}
+	pending := append([][nodeKeyLen]byte(nil), gc.roots...)
+	for len(pending) > 0 {
+		key := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if live.nodes[string(key[:])] {
+			continue
+		}
+		node := &dinoNode{factory: factory}
+		if err := node.loadMetadata(key); errors.Is(err, storage.ErrNotFound) {
+			log.WithField("key", fmt.Sprintf("%x", key)).Warn("Node not found")
+			continue
+		} else if err != nil {
+			return live, err
+		}
+		live.nodes[string(key[:])] = true
+		for _, child := range node.children {
+			pending = append(pending, child.key)
+		}
+		if node.inline || len(node.contentKey) == 0 {
+			continue
+		}
+		if err := gc.markContent(live, node.contentKey); err != nil {
+			return live, fmt.Errorf("node %x: %w", key, err)
+		}
+	}
+	return live, nil
+}
+
+func (gc *collector) markContent(live reachable, key []byte) error {
+	live.blobs[string(storage.StoredKey(gc.blobs, key))] = true
+	chunked, ok := gc.blobs.(*storage.ChunkedBlobStore)
+	if !ok {
+		return nil
+	}
+	chunks, ok := gc.chunks[string(key)]
+	if !ok {
+		var err error
+		chunks, err = chunked.ChunkKeys(key)
+		if errors.Is(err, storage.ErrNotFound) {
+			log.WithField("key", fmt.Sprintf("%x", key)).Warn("Content not found")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		gc.chunks[string(key)] = chunks
+	}
+	for _, chunk := range chunks {
+		live.blobs[string(storage.StoredKey(gc.blobs, chunk))] = true
+	}
+	return nil
+}
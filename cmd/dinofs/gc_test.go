@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGarbageCollection(t *testing.T) {
+	metadataStore := storage.NewInMemoryStore()
+	metadata := storage.NewVersionedWrapper(metadataStore)
+	blobStore := storage.NewInMemoryStore()
+	blobs, err := storage.NewChunkedBlobStore(
+		storage.NewBlobStore(blobStore),
+		storage.ChunkSizes{Min: 256, Avg: 1024, Max: 4096},
+	)
+	require.Nil(t, err)
+	rootdir, factory, cleanup := testMount(t, func(factory *dinoNodeFactory) {
+		factory.metadata = metadata
+		factory.blobs = blobs
+	})
+	defer cleanup()
+
+	big := make([]byte, 64<<10)
+	rand.New(rand.NewSource(42)).Read(big)
+	write := func(name string, content []byte) {
+		t.Helper()
+		require.Nil(t, ioutil.WriteFile(filepath.Join(rootdir, name), content, 0644))
+	}
+	require.Nil(t, os.Mkdir(filepath.Join(rootdir, "dir"), 0755))
+	write("dir/kept", []byte("kept"))
+	write("dir/removed", []byte("removed"))
+	write("big", big)
+	write("overwritten", []byte("old"))
+	write("overwritten", []byte("new"))
+	require.Nil(t, os.Remove(filepath.Join(rootdir, "dir/removed")))
+	// Something that's not a node.
+	require.Nil(t, metadata.Put(1, []byte("quota/usage/volume"), []byte("usage")))
+
+	gc := func(dryRun bool) string {
+		t.Helper()
+		var out bytes.Buffer
+		collector := &collector{
+			metadata: metadata,
+			blobs:    blobs,
+			roots:    [][nodeKeyLen]byte{factory.root.key},
+			dryRun:   dryRun,
+			out:      &out,
+			chunks:   make(map[string][][]byte),
+		}
+		require.Nil(t, collector.run())
+		return out.String()
+	}
+	countKeys := func(store storage.Lister) (n int) {
+		t.Helper()
+		require.Nil(t, storage.ForEachKey(store, func([]byte) error {
+			n++
+			return nil
+		}))
+		return n
+	}
+
+	// Unreachable are the removed node, and the blobs of the removed file, of
+	// the overwritten content, and of the empty content files are created with.
+	nodesBefore, blobsBefore := countKeys(metadataStore), countKeys(blobStore)
+	assert.Equal(t, "nodes\t5 reachable\twould delete 1\nblobs\t52 reachable\twould delete 3\n", gc(true))
+	assert.Equal(t, nodesBefore, countKeys(metadataStore))
+	assert.Equal(t, blobsBefore, countKeys(blobStore))
+
+	assert.Equal(t, "nodes\t5 reachable\tdeleted 1\nblobs\t52 reachable\tdeleted 3\n", gc(false))
+	assert.Equal(t, nodesBefore-1, countKeys(metadataStore))
+	assert.Equal(t, blobsBefore-3, countKeys(blobStore))
+	assert.Equal(t, "nodes\t5 reachable\tdeleted 0\nblobs\t52 reachable\tdeleted 0\n", gc(false))
+
+	// Reachable contents are still there.
+	for name, want := range map[string][]byte{
+		"dir/kept":    []byte("kept"),
+		"big":         big,
+		"overwritten": []byte("new"),
+	} {
+		var node dinoNode
+		node.factory = &dinoNodeFactory{metadata: metadata}
+		require.Nil(t, node.loadMetadata(lookupKey(t, factory, name)))
+		got, err := blobs.Get(node.contentKey)
+		require.Nil(t, err, name)
+		assert.Equal(t, want, got, name)
+	}
+}
+
+// Returns the key of the node at the given slash-separated path, relative to
+// the root.
+func lookupKey(t *testing.T, factory *dinoNodeFactory, name string) [nodeKeyLen]byte {
+	t.Helper()
+	node := factory.root
+	for _, elem := range strings.Split(name, "/") {
+		node.mu.Lock()
+		child := node.children[elem]
+		node.mu.Unlock()
+		require.NotNil(t, child, name)
+		node = child
+	}
+	return node.key
+}
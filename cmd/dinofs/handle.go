@@ -0,0 +1,85 @@
+package main
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+)
+
+// How many times to retry an append that failed, e.g., because another client
+// changed the file meanwhile.
+const maxAppendAttempts = 3
+
+// dinoHandle is the file handle for regular files and symlinks, carrying the
+// flags the file was opened with.
+type dinoHandle struct {
+	flags uint32
+}
+
+// Call with lock held. Returns the handle for the given open flags, and the
+// flags to return to the kernel.
+func (node *dinoNode) newHandle(flags uint32) (*dinoHandle, uint32) {
+	var fuseFlags uint32
+	if flags&syscall.O_DIRECT != 0 || node.factory.directIO {
+		// Bypass the page cache, so that reads see writes from other clients.
+		fuseFlags |= fuse.FOPEN_DIRECT_IO
+	}
+	return &dinoHandle{flags: flags}, fuseFlags
+}
+
+// Call with lock held.
+func (node *dinoNode) truncate() syscall.Errno {
+	rbcontent, rbtime := node.content, node.time
+	node.content = []byte{}
+	node.time = time.Now()
+	node.shouldSaveContent = true
+	node.shouldSaveMetadata = true
+	errno := node.sync()
+	if errno != 0 {
+		// Rollback.
+		node.content = rbcontent
+		node.time = rbtime
+	}
+	return errno
+}
+
+// Call with lock held. Appends data to the latest content, saving it right
+// away, so that appends from different clients don't overwrite each other. If
+// another client changed the file meanwhile, the put fails, and the append is
+// retried after reloading. (With write-behind, puts don't fail, and concurrent
+// appends from different clients can be lost.)
+func (node *dinoNode) append(data []byte) (written uint32, errno syscall.Errno) {
+	for attempt := 1; ; attempt++ {
+		if errno := node.reloadIfNeeded(); errno != 0 {
+			return 0, errno
+		}
+		if errno := node.ensureContentLoaded(); errno != 0 {
+			return 0, errno
+		}
+		if errno := node.checkGrowth(int64(len(node.content) + len(data))); errno != 0 {
+			return 0, errno
+		}
+		rbcontent, rbtime := node.content, node.time
+		content := make([]byte, 0, len(node.content)+len(data))
+		node.content = append(append(content, node.content...), data...)
+		node.time = time.Now()
+		node.shouldSaveContent = true
+		errno = node.sync()
+		if errno == 0 {
+			return uint32(len(data)), 0
+		}
+		node.content = rbcontent
+		node.time = rbtime
+		// What's saved, if anything, is not known.
+		node.shouldReloadMetadata = true
+		if attempt == maxAppendAttempts {
+			return 0, errno
+		}
+		log.WithFields(log.Fields{
+			"name":    node.name,
+			"attempt": attempt,
+		}).Debug("Retrying append")
+	}
+}
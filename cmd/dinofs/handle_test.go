@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenFlags(t *testing.T) {
+	rootdir, factory, cleanup := testMount(t, func(factory *dinoNodeFactory) {
+		factory.metadata = storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	})
+	defer cleanup()
+	pathname := filepath.Join(rootdir, "file")
+	require.Nil(t, ioutil.WriteFile(pathname, []byte("hello"), 0644))
+	lookup := func() *dinoNode {
+		factory.root.mu.Lock()
+		defer factory.root.mu.Unlock()
+		return factory.root.children["file"]
+	}
+
+	t.Run("append writes go at the end of the latest content", func(t *testing.T) {
+		f, err := os.OpenFile(pathname, os.O_WRONLY|os.O_APPEND, 0)
+		require.Nil(t, err)
+		defer f.Close()
+		// Another client appended meanwhile, and we haven't heard of it.
+		node := lookup()
+		node.mu.Lock()
+		remote := &dinoNode{factory: factory}
+		err = remote.unserialize(node.serialize())
+		if err == nil {
+			remote.content = []byte("hello, world")
+			remote.contentKey, err = factory.blobs.Put(remote.content)
+		}
+		if err == nil {
+			err = factory.metadata.Put(node.version+1, node.key[:], remote.serialize())
+		}
+		node.mu.Unlock()
+		require.Nil(t, err)
+		_, err = f.Write([]byte("!"))
+		require.Nil(t, err)
+		require.Nil(t, f.Close())
+		b, err := ioutil.ReadFile(pathname)
+		require.Nil(t, err)
+		assert.Equal(t, "hello, world!", string(b))
+	})
+	t.Run("truncate on open", func(t *testing.T) {
+		node := lookup()
+		fh, _, errno := node.Open(context.Background(), syscall.O_WRONLY|syscall.O_TRUNC)
+		require.Equal(t, syscall.Errno(0), errno)
+		assert.Equal(t, uint32(syscall.O_WRONLY|syscall.O_TRUNC), fh.(*dinoHandle).flags)
+		fi, err := os.Stat(pathname)
+		require.Nil(t, err)
+		assert.Equal(t, int64(0), fi.Size())
+		node.mu.Lock()
+		_, value, err := factory.metadata.Get(node.key[:])
+		node.mu.Unlock()
+		require.Nil(t, err)
+		saved := &dinoNode{factory: factory}
+		require.Nil(t, saved.unserialize(value))
+		b, err := factory.blobs.Get(saved.contentKey)
+		require.Nil(t, err)
+		assert.Empty(t, b)
+	})
+	t.Run("direct I/O", func(t *testing.T) {
+		node := lookup()
+		_, fuseFlags, errno := node.Open(context.Background(), syscall.O_RDONLY)
+		require.Equal(t, syscall.Errno(0), errno)
+		assert.Zero(t, fuseFlags&fuse.FOPEN_DIRECT_IO)
+		_, fuseFlags, errno = node.Open(context.Background(), syscall.O_RDONLY|syscall.O_DIRECT)
+		require.Equal(t, syscall.Errno(0), errno)
+		assert.NotZero(t, fuseFlags&fuse.FOPEN_DIRECT_IO)
+		f, err := os.OpenFile(pathname, os.O_RDWR|syscall.O_DIRECT, 0)
+		require.Nil(t, err)
+		_, err = f.WriteAt([]byte("direct"), 0)
+		require.Nil(t, err)
+		b := make([]byte, 16)
+		n, err := f.ReadAt(b, 0)
+		require.Equal(t, 6, n)
+		assert.Equal(t, "direct", string(b[:n]))
+		require.Nil(t, f.Close())
+	})
+}
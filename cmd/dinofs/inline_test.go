@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Counts calls to the wrapped blob store.
+type countingBlobStore struct {
+	storage.BlobStore
+
+	mu   sync.Mutex
+	puts int
+	gets int
+}
+
+func (s *countingBlobStore) Put(value []byte) ([]byte, error) {
+	s.mu.Lock()
+	s.puts++
+	s.mu.Unlock()
+	return s.BlobStore.Put(value)
+}
+
+func (s *countingBlobStore) Get(key []byte) ([]byte, error) {
+	s.mu.Lock()
+	s.gets++
+	s.mu.Unlock()
+	return s.BlobStore.Get(key)
+}
+
+func (s *countingBlobStore) counts() (puts, gets int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.puts, s.gets
+}
+
+func TestInlineContent(t *testing.T) {
+	blobs := &countingBlobStore{
+		BlobStore: storage.NewBlobStore(storage.NewInMemoryStore()),
+	}
+	rootdir, factory, cleanup := testMount(t, func(factory *dinoNodeFactory) {
+		factory.metadata = storage.NewVersionedWrapper(storage.NewInMemoryStore())
+		factory.blobs = blobs
+		factory.inlineThreshold = 64
+	})
+	defer cleanup()
+
+	small := filepath.Join(rootdir, "small")
+	require.Nil(t, ioutil.WriteFile(small, []byte("tiny"), 0644))
+	link := filepath.Join(rootdir, "link")
+	require.Nil(t, os.Symlink("small", link))
+	puts, _ := blobs.counts()
+	assert.Equal(t, 0, puts)
+
+	big := filepath.Join(rootdir, "big")
+	content := bytes.Repeat([]byte("x"), 64)
+	require.Nil(t, ioutil.WriteFile(big, content, 0644))
+	puts, _ = blobs.counts()
+	assert.Equal(t, 1, puts)
+
+	// Forget the contents, as if the nodes had been changed by another client.
+	factory.root.mu.Lock()
+	var nodes []*dinoNode
+	for _, child := range factory.root.children {
+		nodes = append(nodes, child)
+	}
+	factory.root.mu.Unlock()
+	for _, node := range nodes {
+		node.mu.Lock()
+		node.shouldReloadMetadata = true
+		node.mu.Unlock()
+	}
+
+	b, err := ioutil.ReadFile(small)
+	require.Nil(t, err)
+	assert.Equal(t, "tiny", string(b))
+	target, err := os.Readlink(link)
+	require.Nil(t, err)
+	assert.Equal(t, "small", target)
+	_, gets := blobs.counts()
+	assert.Equal(t, 0, gets)
+
+	b, err = ioutil.ReadFile(big)
+	require.Nil(t, err)
+	assert.Equal(t, content, b)
+}
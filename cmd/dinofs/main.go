@@ -6,11 +6,13 @@ import (
 	"fmt"
 	golog "log"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/google/gops/agent"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
-	"github.com/nicolagi/dino/metadata/client"
+	"github.com/nicolagi/dino/quota"
 	"github.com/nicolagi/dino/storage"
 	log "github.com/sirupsen/logrus"
 )
@@ -18,6 +20,11 @@ import (
 func main() {
 	defaultConfigFile := os.ExpandEnv("$HOME/lib/dino/fs-default.config")
 	configFile := flag.String("c", defaultConfigFile, "location of configuration file, or an alias to expand to $HOME/lib/dino/fs-ALIAS.config")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-c config] [command [args...]]\n", os.Args[0])
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Without a command, mounts the file system. Commands: %s.\n", commandNames())
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	log.SetFormatter(&log.TextFormatter{
@@ -36,6 +43,13 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	if flag.NArg() > 0 {
+		if err := runCommand(config, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	cleanup := redirectLogging(config)
 	defer cleanup()
 
@@ -48,10 +62,23 @@ func main() {
 	var factory dinoNodeFactory
 
 	var metadataClose func()
-	factory.metadata, metadataClose = versionedStoreImpl(config, &factory)
+	factory.metadata, metadataClose, err = config.VersionedStore(factory.invalidateCache)
+	if err != nil {
+		log.WithField("err", err).Fatal("Could not build metadata store")
+	}
 	defer metadataClose()
+	if config.Quota {
+		factory.quotas = quota.NewTracker(factory.metadata)
+	}
+	if config.Metadata.WriteBehind != "" {
+		window, err := time.ParseDuration(config.Metadata.WriteBehind)
+		if err != nil {
+			log.WithField("err", err).Fatal("Could not parse metadata write-behind window")
+		}
+		factory.commits = newCommitter(&factory, window)
+	}
 
-	remote, err := storeImpl(config)
+	remote, err := config.RemoteStore()
 	if err != nil {
 		log.WithField("err", err).Fatal("Could not build store")
 	}
@@ -59,7 +86,21 @@ func main() {
 		storage.NewDiskStore(os.ExpandEnv(config.DataPath)),
 		remote,
 	)
-	factory.blobs = storage.NewBlobStore(pairedStore)
+	factory.blobs, err = config.BlobStore(pairedStore)
+	if err != nil {
+		log.WithField("err", err).Fatal("Could not build blob store")
+	}
+	factory.paired = &pairedStore
+	factory.directIO = config.DirectIO
+	if config.InlineThreshold > maxInlineThreshold {
+		log.WithFields(log.Fields{
+			"threshold": config.InlineThreshold,
+			"max":       maxInlineThreshold,
+		}).Fatal("Inline threshold too large")
+	}
+	factory.inlineThreshold = config.InlineThreshold
+	factory.origin = config.Origin
+	factory.control = newControlDir(&factory, config, remote)
 
 	g := newInodeNumbersGenerator()
 	go g.start()
@@ -78,22 +119,44 @@ func main() {
 	if err := root.loadMetadata(root.key); err != nil {
 		if errors.Is(err, storage.ErrNotFound) {
 			log.Infof("Serving an empty file system (no metadata found for root node)")
-			root.mode |= fuse.S_IFDIR
+			root.mode = fuse.S_IFDIR | 0755
 			root.children = make(map[string]*dinoNode)
 		} else {
 			log.Fatalf("Could not load root node metadata: %v", err)
 		}
 	}
 
+	drainTimeout, err := time.ParseDuration(config.DrainTimeout)
+	if err != nil {
+		log.WithField("err", err).Fatal("Could not parse drain timeout")
+	}
+
 	mount := os.ExpandEnv(config.Mountpoint)
 	server, err := fs.Mount(mount, root, &fsopts)
 	if err != nil {
 		log.Fatalf("Could not mount on %q: %v", mount, err)
 	}
+	go handleSignals(server, &factory, drainTimeout)
+
+	dataPath := os.ExpandEnv(config.DataPath)
+	if err := os.MkdirAll(dataPath, 0700); err != nil {
+		log.WithField("err", err).Warn("Could not create data directory")
+	}
+	if factory.events, err = newEventFeed(factory.metadata, filepath.Join(dataPath, eventsName)); err != nil {
+		log.WithField("err", err).Warn("Could not serve change events")
+	} else {
+		defer factory.events.close()
+	}
 
 	// The following call returns when the filesystem is unmounted (e.g.,
-	// with "fusermount -u /n/dino").
+	// with "fusermount -u /n/dino", or upon SIGTERM).
 	server.Wait()
+
+	// Changes could have been made after draining upon a signal, or the file
+	// system could have been unmounted externally. The metadata store is
+	// stopped after this, by the deferred call.
+	factory.drain(drainTimeout)
+	log.Info("Unmounted")
 }
 
 func redirectLogging(c *config) (cleanup func()) {
@@ -116,45 +179,3 @@ func redirectLogging(c *config) (cleanup func()) {
 		}
 	}
 }
-
-func storeImpl(c *config) (storage.Store, error) {
-	switch c.Blobs.Type {
-	case "dino":
-		return storage.NewRemoteStore(c.Blobs.Address), nil
-	case "s3":
-		return storage.NewS3Store(
-			c.Blobs.Profile,
-			c.Blobs.Region,
-			c.Blobs.Bucket,
-		)
-	default:
-		log.WithField("type", c.Blobs.Type).Fatal("Unknown blobs type")
-		panic("not reached")
-	}
-}
-
-func versionedStoreImpl(c *config, factory *dinoNodeFactory) (store storage.VersionedStore, close func()) {
-	switch c.Metadata.Type {
-	case "dino":
-		s := storage.NewRemoteVersionedStore(
-			client.New(client.WithAddress(c.Metadata.Address)),
-			storage.WithChangeListener(factory.invalidateCache),
-		)
-		s.Start()
-		return s, s.Stop
-	case "dynamodb":
-		s, err := storage.NewDynamoDBVersionedStore(
-			c.Metadata.Profile,
-			c.Metadata.Region,
-			c.Metadata.Table,
-			storage.WithChangeListener(factory.invalidateCache),
-		)
-		if err != nil {
-			log.WithField("err", err).Fatal("Could not initialize DynamoDB versioned store")
-		}
-		return s, func() {}
-	default:
-		log.WithField("type", c.Metadata.Type).Fatal("Unknown metadata type")
-		panic("not reached")
-	}
-}
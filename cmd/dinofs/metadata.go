@@ -2,87 +2,91 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"syscall"
-	"time"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
-	"github.com/nicolagi/dino/bits"
+	"github.com/nicolagi/dino/volume"
 	log "github.com/sirupsen/logrus"
 )
 
+var errMalformedNode = volume.ErrMalformed
+
 func (node *dinoNode) serialize() []byte {
-	// Could use a pool of buffers, to be reused, instead of putting pressure on
-	// the GC.
-	size := 24 + len(node.contentKey)
-	for attr, value := range node.xattrs {
-		size += 4 + len(attr) + len(value)
-	}
-	for childName := range node.children {
-		size += 4 + nodeKeyLen + len(childName)
-	}
-	buf := make([]byte, size)
-	b := buf
-	b = bits.Put32(b, node.user)
-	b = bits.Put32(b, node.group)
-	b = bits.Put32(b, node.mode)
-	b = bits.Put64(b, uint64(node.time.UnixNano()))
-	b = bits.Putb(b, node.contentKey)
-	b = bits.Put16(b, uint16(len(node.xattrs)))
-	for attr, value := range node.xattrs {
-		b = bits.Puts(b, attr)
-		b = bits.Putb(b, value)
+	m := node.metadata()
+	return m.Encode()
+}
+
+func (node *dinoNode) metadata() volume.Metadata {
+	m := volume.Metadata{
+		User:       node.user,
+		Group:      node.group,
+		Mode:       node.mode,
+		Time:       node.time,
+		ContentKey: node.contentKey,
+		Inline:     node.inline,
+		Xattrs:     node.xattrs,
+		Origin:     node.factory.origin,
+		Unknown:    node.unknownFields,
 	}
-	for childName, childNode := range node.children {
-		b = bits.Puts(b, childName)
-		b = bits.Putb(b, childNode.key[:])
+	if node.children != nil {
+		m.Children = make(map[string]volume.Key, len(node.children))
+		for name, child := range node.children {
+			m.Children[name] = child.key
+		}
 	}
-	return buf
+	return m
 }
 
-func (node *dinoNode) unserialize(b []byte) {
-	node.user, b = bits.Get32(b)
-	node.group, b = bits.Get32(b)
-	node.mode, b = bits.Get32(b)
-	var unixnano uint64
-	unixnano, b = bits.Get64(b)
-	node.time = time.Unix(0, int64(unixnano))
-	node.contentKey, b = bits.Getb(b)
-	if node.mode&fuse.S_IFDIR != 0 {
-		node.children = make(map[string]*dinoNode)
+func (node *dinoNode) unserialize(b []byte) error {
+	var m volume.Metadata
+	if err := m.Decode(b); err != nil {
+		return err
 	}
-	var nxattr uint16
-	nxattr, b = bits.Get16(b)
-	if nxattr > 0 {
-		node.xattrs = make(map[string][]byte)
+	node.user = m.User
+	node.group = m.Group
+	node.mode = m.Mode
+	node.time = m.Time
+	node.contentKey = m.ContentKey
+	node.inline = m.Inline
+	node.xattrs = m.Xattrs
+	node.unknownFields = m.Unknown
+	node.children = nil
+	if m.Children != nil || node.mode&fuse.S_IFDIR != 0 {
+		node.children = make(map[string]*dinoNode, len(m.Children))
 	}
-	for ; nxattr > 0; nxattr-- {
-		var attr string
-		var value []byte
-		attr, b = bits.Gets(b)
-		value, b = bits.Getb(b)
-		node.xattrs[attr] = value
+	for name, key := range m.Children {
+		node.children[name] = node.factory.existingNode(name, key)
 	}
-	if len(b) > 0 {
-		var childName string
-		var childKey []byte
-		for len(b) > 0 {
-			childName, b = bits.Gets(b)
-			childKey, b = bits.Getb(b)
-			var key [nodeKeyLen]byte
-			copy(key[:], childKey)
-			node.children[childName] = node.factory.existingNode(childName, key)
-		}
+	if node.inline {
+		node.content = dup(node.contentKey)
 	}
+	return nil
 }
 
+// Saves the node, or enqueues it with write-behind, and charges quotas for the
+// difference with what was charged last, and for the refunds of removed
+// children, once saved.
 func (node *dinoNode) saveMetadata() error {
-	value := node.serialize()
-	err := node.factory.metadata.Put(node.version+1, node.key[:], value)
-	if err != nil {
-		return err
+	want, charges := node.recharge()
+	charges = append(charges, node.refunds...)
+	if node.factory.commits != nil {
+		node.version = node.factory.commits.enqueue(node, charges)
+	} else {
+		info := &volume.NodeInfo{
+			Key:      node.key,
+			Version:  node.version,
+			Metadata: node.metadata(),
+		}
+		if err := node.factory.volume().Save(info); err != nil {
+			return err
+		}
+		node.version = info.Version
+		node.factory.charge(charges)
 	}
-	node.version++
+	node.charged = want
+	node.refunds = nil
 	return nil
 }
 
@@ -91,25 +95,48 @@ func (node *dinoNode) loadMetadata(key [nodeKeyLen]byte) error {
 	if err != nil {
 		return err
 	}
+	return node.setMetadata(key, version, b)
+}
+
+func (node *dinoNode) setMetadata(key [nodeKeyLen]byte, version uint64, b []byte) error {
 	node.key = key
 	node.version = version
-	node.unserialize(b)
+	if err := node.unserialize(b); err != nil {
+		// Try again next time.
+		node.mode = modeNotLoaded
+		return fmt.Errorf("node %x version %d: %w", key, version, err)
+	}
+	// Whoever created the node charged quotas for it. The size of content
+	// that's not inline is only known once loaded, see chargedBytes.
+	node.charged = charge{user: node.user, bytes: unknownBytes, inodes: 1}
+	if node.inline || len(node.contentKey) == 0 {
+		node.charged.bytes = int64(len(node.content))
+	}
 	return nil
 }
 
 func (node *dinoNode) sync() syscall.Errno {
+	saved := node.shouldSaveContent || node.shouldSaveMetadata
+	if saved && node.factory.quotas != nil {
+		// What's been charged must be known before the content key changes,
+		// to charge the difference afterwards.
+		if _, errno := node.chargedBytes(); errno != 0 {
+			return errno
+		}
+	}
 	if node.shouldSaveContent {
-		var err error
-		prev := node.contentKey
-		node.contentKey, err = node.factory.blobs.Put(node.content)
-		if err != nil {
+		prev, prevInline := node.contentKey, node.inline
+		var stored volume.Metadata
+		if err := node.factory.volume().StoreContent(&stored, node.content); err != nil {
 			log.WithFields(log.Fields{
 				"err": err,
 			}).Error("Could not save content")
 			return syscall.EIO
 		}
+		node.contentKey = stored.ContentKey
+		node.inline = stored.Inline
 		node.shouldSaveContent = false
-		if !bytes.Equal(prev, node.contentKey) {
+		if prevInline != node.inline || !bytes.Equal(prev, node.contentKey) {
 			node.shouldSaveMetadata = true
 		}
 	}
@@ -125,3 +152,12 @@ func (node *dinoNode) sync() syscall.Errno {
 	}
 	return fs.OK
 }
+
+func dup(p []byte) []byte {
+	if p == nil {
+		return nil
+	}
+	q := make([]byte, len(p))
+	copy(q, p)
+	return q
+}
@@ -34,6 +34,7 @@ func TestNodeSerialization(t *testing.T) {
 		assert.Equal(t, before.version, after.version)
 		assert.EqualValues(t, before.key, after.key)
 		assert.EqualValues(t, before.contentKey, after.contentKey)
+		assert.Equal(t, before.inline, after.inline)
 	}
 }
 
@@ -43,6 +44,7 @@ func randomNode(t *testing.T, factory *dinoNodeFactory) *dinoNode {
 	node.user = rand.Uint32()
 	node.group = rand.Uint32()
 	node.mode = rand.Uint32()
+	node.inline = rand.Intn(2) == 0
 	node.time = time.Unix(rand.Int63(), rand.Int63())
 	keyLen := rand.Intn(10)
 	node.contentKey = make([]byte, keyLen)
@@ -12,12 +12,16 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/nicolagi/dino/volume"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	nodeKeyLen    int    = 20
+	nodeKeyLen    int    = volume.KeyLen
 	modeNotLoaded uint32 = 0xffffffff
+
+	// Upper limit for the inline threshold, to keep metadata values small.
+	maxInlineThreshold = volume.MaxInlineThreshold
 )
 
 type dinoNode struct {
@@ -51,12 +55,25 @@ type dinoNode struct {
 
 	xattrs map[string][]byte
 
-	// Only makes sense for regular files or symlinks:
+	// Only makes sense for regular files or symlinks. If inline is true,
+	// contentKey is the content itself, stored with the metadata, rather than
+	// the key of the blob containing it.
 	contentKey []byte
 	content    []byte
+	inline     bool
 
 	// Only makes sense for directories:
 	children map[string]*dinoNode
+
+	// Serialized fields this client doesn't know about, saved back as they are.
+	unknownFields []byte
+
+	// What's been charged to quotas for this node (not persisted).
+	charged charge
+
+	// Refunds for removed children, to make once this node is saved (not
+	// persisted).
+	refunds []charge
 }
 
 func (node *dinoNode) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
@@ -82,6 +99,9 @@ func (node *dinoNode) Setxattr(ctx context.Context, attr string, data []byte, fl
 	//
 	// XATTR_REPLACE Perform a pure replace operation, which fails if the named
 	// attribute does not already exist.
+	if isVirtualXattr(attr) {
+		return syscall.EPERM
+	}
 	node.mu.Lock()
 	defer node.mu.Unlock()
 	if node.xattrs == nil {
@@ -119,11 +139,10 @@ func (node *dinoNode) Setxattr(ctx context.Context, attr string, data []byte, fl
 func (node *dinoNode) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
 	node.mu.Lock()
 	defer node.mu.Unlock()
-	if node.xattrs == nil {
-		return 0, syscall.ENODATA
-	}
-	value, ok := node.xattrs[attr]
-	if !ok {
+	var value []byte
+	if compute, ok := virtualXattrs[attr]; ok {
+		value = []byte(compute(node))
+	} else if value, ok = node.xattrs[attr]; !ok {
 		return 0, syscall.ENODATA
 	}
 	if len(value) > len(dest) {
@@ -132,7 +151,27 @@ func (node *dinoNode) Getxattr(ctx context.Context, attr string, dest []byte) (u
 	return uint32(copy(dest, value)), 0
 }
 
+// OnAdd adds the control directory to the root, if configured.
+func (node *dinoNode) OnAdd(ctx context.Context) {
+	control := node.factory.control
+	if node != node.factory.root || control == nil {
+		return
+	}
+	node.AddChild(controlName, node.NewPersistentInode(ctx, control, fs.StableAttr{
+		Mode: fuse.S_IFDIR,
+		Ino:  node.factory.inogen.next(),
+	}), false)
+}
+
+// Tells whether name, a child of node, is the control directory.
+func (node *dinoNode) isControl(name string) bool {
+	return node == node.factory.root && node.factory.control != nil && name == controlName
+}
+
 func (node *dinoNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	if node.isControl(name) {
+		return syscall.EPERM
+	}
 	node.mu.Lock()
 	defer node.mu.Unlock()
 	child := node.children[name]
@@ -150,25 +189,41 @@ func (node *dinoNode) Rmdir(ctx context.Context, name string) syscall.Errno {
 		return syscall.ENOTEMPTY
 	}
 	delete(node.children, name)
+	node.refunds = child.discharge()
 	node.shouldSaveMetadata = true
 	errno := node.sync()
 	// Rollback.
 	if errno != 0 {
 		node.children[name] = child
+		node.refunds = nil
+	} else {
+		child.charged = charge{}
 	}
 	return errno
 }
 
 func (node *dinoNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	if node.isControl(name) {
+		return syscall.EPERM
+	}
 	node.mu.Lock()
 	defer node.mu.Unlock()
 	child := node.children[name]
 	delete(node.children, name)
+	if child != nil {
+		child.mu.Lock()
+		defer child.mu.Unlock()
+		node.refunds = child.discharge()
+	}
 	node.shouldSaveMetadata = true
 	errno := node.sync()
 	// Rollback.
 	if errno != 0 && child != nil {
 		node.children[name] = child
+		node.refunds = nil
+	}
+	if errno == 0 && child != nil {
+		child.charged = charge{}
 	}
 	return errno
 }
@@ -201,11 +256,19 @@ func (node *dinoNode) reloadIfNeeded() syscall.Errno {
 		node.version = nn.version
 	}
 	node.xattrs = nn.xattrs
-	if !bytes.Equal(node.contentKey, nn.contentKey) {
+	node.unknownFields = nn.unknownFields
+	if node.inline != nn.inline || !bytes.Equal(node.contentKey, nn.contentKey) {
 		logger.Debug("Content changed, marking for lazy reload")
 		node.contentKey = nn.contentKey
+		node.inline = nn.inline
 		node.content = nil
 	}
+	// The client that made the change charged quotas accordingly. The size of
+	// content that's not inline is only known once loaded, which sets it.
+	node.charged = nn.charged
+	if node.content != nil {
+		node.charged.bytes = int64(len(node.content))
+	}
 
 	// Children are by far the hardest part to reload. I've spent way too many
 	// hours trying to make this work.
@@ -244,15 +307,18 @@ func (node *dinoNode) Opendir(ctx context.Context) syscall.Errno {
 	if errno := node.reloadIfNeeded(); errno != 0 {
 		return errno
 	}
+	children := make([]*dinoNode, 0, len(node.children))
 	for _, childNode := range node.children {
-		if errno := node.ensureChildLoaded(ctx, childNode); errno != 0 {
-			return errno
-		}
+		children = append(children, childNode)
 	}
-	return 0
+	return node.ensureChildrenLoaded(ctx, children)
 }
 
 func (node *dinoNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if node.isControl(name) {
+		out.Mode = fuse.S_IFDIR | 0555
+		return node.GetChild(controlName), 0
+	}
 	node.mu.Lock()
 	defer node.mu.Unlock()
 	if errno := node.reloadIfNeeded(); errno != 0 {
@@ -272,6 +338,8 @@ func (node *dinoNode) Lookup(ctx context.Context, name string, out *fuse.EntryOu
 	// In the below, if we don't report the size, any read to a mmap-ed file
 	// whose *dinoNode content hasn't been loaded would cause a SIGBUS.
 	// We wouldn't even get i/o calls to the *dinoNode.
+	child.mu.Lock()
+	defer child.mu.Unlock()
 	if errno := child.ensureContentLoaded(); errno != 0 {
 		return nil, errno
 	}
@@ -298,21 +366,80 @@ func (node *dinoNode) ensureChildLoaded(ctx context.Context, childNode *dinoNode
 		}).Error("could not load metadata")
 		return syscall.EIO
 	}
+	node.addLoadedChild(ctx, childNode)
+	return 0
+}
+
+// Call with lock held. Like ensureChildLoaded, but getting the metadata of all
+// children in as few round trips as possible.
+func (node *dinoNode) ensureChildrenLoaded(ctx context.Context, children []*dinoNode) syscall.Errno {
+	var pending []*dinoNode
+	var keys [][]byte
+	for _, childNode := range children {
+		if childNode.mode == modeNotLoaded {
+			pending = append(pending, childNode)
+			keys = append(keys, childNode.key[:])
+		}
+	}
+	if len(keys) == 0 {
+		return 0
+	}
+	values, err := node.factory.metadata.GetMany(keys)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"parent": node.fullPath(),
+		}).Error("could not load metadata")
+		return syscall.EIO
+	}
+	for i, childNode := range pending {
+		if err := values[i].Err; err != nil {
+			log.WithFields(log.Fields{
+				"err":    err,
+				"child":  childNode.name,
+				"parent": node.fullPath(),
+			}).Error("could not load metadata")
+			return syscall.EIO
+		}
+		if err := childNode.setMetadata(childNode.key, values[i].Version, values[i].Value); err != nil {
+			log.WithFields(log.Fields{
+				"err":    err,
+				"child":  childNode.name,
+				"parent": node.fullPath(),
+			}).Error("could not load metadata")
+			return syscall.EIO
+		}
+		node.addLoadedChild(ctx, childNode)
+	}
+	return 0
+}
+
+// Call with lock held.
+func (node *dinoNode) addLoadedChild(ctx context.Context, childNode *dinoNode) {
 	node.AddChild(childNode.name, node.NewInode(ctx, childNode, fs.StableAttr{
 		Mode: childNode.mode,
 		Ino:  node.factory.inogen.next(),
 	}), false)
-	return 0
 }
 
+// Flush saves what's been written. As other clients opening the file after
+// it's closed should see that, changes written behind are committed too.
 func (node *dinoNode) Flush(ctx context.Context, f fs.FileHandle) syscall.Errno {
+	if errno := node.syncWrites(); errno != 0 {
+		return errno
+	}
+	return node.factory.commitPending()
+}
+
+func (node *dinoNode) syncWrites() syscall.Errno {
 	node.mu.Lock()
 	defer node.mu.Unlock()
-	prev := node.contentKey
+	prev, prevInline := node.contentKey, node.inline
 	errno := node.sync()
-	if errno != 0 && !bytes.Equal(prev, node.contentKey) {
+	if errno != 0 && (prevInline != node.inline || !bytes.Equal(prev, node.contentKey)) {
 		// Rollback.
 		node.contentKey = prev
+		node.inline = prevInline
 		node.content = nil
 	}
 	return errno
@@ -363,7 +490,8 @@ func (node *dinoNode) Create(ctx context.Context, name string, flags uint32, mod
 		rollback()
 		return nil, nil, 0, errno
 	}
-	return child.EmbeddedInode(), nil, 0, 0
+	fh, fuseFlags := child.newHandle(flags)
+	return child.EmbeddedInode(), fh, fuseFlags, 0
 }
 
 func (node *dinoNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
@@ -412,6 +540,16 @@ func (node *dinoNode) Symlink(ctx context.Context, target, name string, out *fus
 }
 
 func (node *dinoNode) createLockedChild(ctx context.Context, name string, mode uint32, orMode uint32) (child *dinoNode, rollback func(), errno syscall.Errno) {
+	if node.isControl(name) {
+		return nil, nil, syscall.EEXIST
+	}
+	var user, group uint32
+	if caller, ok := fuse.FromContext(ctx); ok {
+		user, group = caller.Uid, caller.Gid
+	}
+	if errno := node.checkQuota(user, 0, 1); errno != 0 {
+		return nil, nil, errno
+	}
 	id := fs.StableAttr{
 		Mode: mode | orMode,
 		Ino:  node.factory.inogen.next(),
@@ -427,6 +565,8 @@ func (node *dinoNode) createLockedChild(ctx context.Context, name string, mode u
 	}
 	child.name = name
 	child.mode = id.Mode
+	child.user = user
+	child.group = group
 	node.children[name] = child
 	// Lock before adding to the tree. Caller will unlock.
 	child.mu.Lock()
@@ -443,7 +583,18 @@ func (node *dinoNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle,
 	if errno := node.reloadIfNeeded(); errno != 0 {
 		return nil, 0, errno
 	}
-	return nil, 0, node.ensureContentLoaded()
+	// The kernel only passes O_TRUNC if atomic truncation on open is enabled.
+	// Otherwise, it truncates with a separate Setattr.
+	if flags&syscall.O_TRUNC != 0 && flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		errno = node.truncate()
+	} else {
+		errno = node.ensureContentLoaded()
+	}
+	if errno != 0 {
+		return nil, 0, errno
+	}
+	fh, fuseFlags = node.newHandle(flags)
+	return fh, fuseFlags, 0
 }
 
 func (node *dinoNode) ensureContentLoaded() syscall.Errno {
@@ -462,6 +613,11 @@ func (node *dinoNode) ensureContentLoaded() syscall.Errno {
 	if len(node.content) != 0 {
 		return 0
 	}
+	if node.inline {
+		node.content = dup(node.contentKey)
+		node.charged.bytes = int64(len(node.content))
+		return 0
+	}
 	value, err := node.factory.blobs.Get(node.contentKey)
 	if err != nil {
 		logger.WithField("err", err).Error("Could not load content")
@@ -469,6 +625,7 @@ func (node *dinoNode) ensureContentLoaded() syscall.Errno {
 	}
 	logger.WithField("size", len(value)).Debug("Content loaded")
 	node.content = value
+	node.charged.bytes = int64(len(value))
 	return 0
 }
 
@@ -490,19 +647,39 @@ func (node *dinoNode) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
 }
 
 func (node *dinoNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	newParentNode, ok := newParent.EmbeddedInode().Operations().(*dinoNode)
+	if !ok {
+		// E.g., moving into the control directory.
+		return syscall.EXDEV
+	}
+	if node.isControl(name) || newParentNode.isControl(newName) {
+		return syscall.EPERM
+	}
 	node.mu.Lock()
 	defer node.mu.Unlock()
 
 	child := node.GetChild(name).Operations().(*dinoNode)
 	child.mu.Lock()
 	defer child.mu.Unlock()
-	child.name = newName
 
-	newParentNode := newParent.EmbeddedInode().Operations().(*dinoNode)
 	if node.key != newParentNode.key {
 		newParentNode.mu.Lock()
 		defer newParentNode.mu.Unlock()
 	}
+	replaced := newParentNode.children[newName]
+	if replaced == child {
+		replaced = nil
+	}
+	if replaced != nil {
+		replaced.mu.Lock()
+		defer replaced.mu.Unlock()
+		moved, r := child.metadata(), replaced.metadata()
+		if err := volume.CheckReplace(&moved, &r); err != nil {
+			return err.(syscall.Errno)
+		}
+		newParentNode.refunds = replaced.discharge()
+	}
+	child.name = newName
 	newParentNode.children[newName] = child
 	delete(node.children, name)
 
@@ -510,15 +687,17 @@ func (node *dinoNode) Rename(ctx context.Context, name string, newParent fs.Inod
 	newParentNode.shouldSaveMetadata = true
 	node.shouldSaveMetadata = true
 	if errno := child.sync(); errno != 0 {
+		newParentNode.refunds = nil
 		return errno
 	}
 	if errno := newParentNode.sync(); errno != 0 {
+		newParentNode.refunds = nil
 		return errno
 	}
-	if errno := node.sync(); errno != 0 {
-		return errno
+	if replaced != nil {
+		replaced.charged = charge{}
 	}
-	return 0
+	return node.sync()
 }
 
 func (node *dinoNode) resize(size uint64) (previous []byte) {
@@ -607,8 +786,17 @@ func (node *dinoNode) Write(ctx context.Context, f fs.FileHandle, data []byte, o
 	node.mu.Lock()
 	defer node.mu.Unlock()
 
+	if h, ok := f.(*dinoHandle); ok && h.flags&syscall.O_APPEND != 0 {
+		// The offset is the file size according to the kernel, which might not
+		// know about appends from other clients.
+		return node.append(data)
+	}
+
 	sz := int64(len(data))
 	if off+sz > int64(len(node.content)) {
+		if errno := node.checkGrowth(off + sz); errno != 0 {
+			return 0, errno
+		}
 		node.resize(uint64(off + sz))
 	}
 	copy(node.content[off:], data)
@@ -50,6 +50,14 @@ func (s *fakeVersionedStore) Put(uint64, []byte, []byte) error {
 	return s.err
 }
 
+func (s *fakeVersionedStore) PutMany(puts []storage.VersionedPut) ([]error, error) {
+	return storage.PutEach(s, puts)
+}
+
+func (s *fakeVersionedStore) GetMany(keys [][]byte) ([]storage.VersionedValue, error) {
+	return storage.GetEach(s, keys)
+}
+
 func (s *fakeVersionedStore) setErr(err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -397,7 +405,67 @@ func TestNodeMetadataRollback(t *testing.T) {
 	})
 }
 
-func testMount(t *testing.T) (mountpoint string, factory *dinoNodeFactory, cleanup func()) {
+func TestOpendirPrefetchesChildren(t *testing.T) {
+	store := &countingVersionedStore{
+		VersionedStore: storage.NewVersionedWrapper(storage.NewInMemoryStore()),
+	}
+	rootdir, _, cleanup := testMount(t, func(factory *dinoNodeFactory) {
+		factory.metadata = store
+	})
+	dir := filepath.Join(rootdir, "dir")
+	require.Nil(t, os.Mkdir(dir, 0755))
+	for i := 0; i < 20; i++ {
+		require.Nil(t, ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), nil, 0644))
+	}
+	cleanup()
+
+	// Another client, knowing nothing but the root.
+	rootdir, _, cleanup = testMount(t, func(factory *dinoNodeFactory) {
+		factory.metadata = store
+		require.Nil(t, factory.root.loadMetadata(factory.root.key))
+	})
+	defer cleanup()
+	_, err := os.Stat(filepath.Join(rootdir, "dir"))
+	require.Nil(t, err)
+	gets, getMany := store.getCounts()
+	names, err := ioutil.ReadDir(filepath.Join(rootdir, "dir"))
+	require.Nil(t, err)
+	assert.Len(t, names, 20)
+	after, afterMany := store.getCounts()
+	assert.Equal(t, gets, after)
+	assert.Equal(t, append(getMany, 20), afterMany)
+}
+
+func TestRenameReplacing(t *testing.T) {
+	rootdir, _, cleanup := testMount(t, func(factory *dinoNodeFactory) {
+		factory.metadata = storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	})
+	defer cleanup()
+	for _, name := range []string{"empty", "full", "moved"} {
+		require.Nil(t, os.Mkdir(filepath.Join(rootdir, name), 0755))
+	}
+	require.Nil(t, ioutil.WriteFile(filepath.Join(rootdir, "full", "file"), nil, 0644))
+
+	// Unlike rename(2), os.Rename refuses to replace directories. The error
+	// isn't checked, as go-fuse reports any failed rename as ENOTSUP.
+	err := syscall.Rename(filepath.Join(rootdir, "moved"), filepath.Join(rootdir, "full"))
+	assert.NotNil(t, err)
+	_, err = os.Stat(filepath.Join(rootdir, "full", "file"))
+	assert.Nil(t, err)
+
+	require.Nil(t, syscall.Rename(filepath.Join(rootdir, "moved"), filepath.Join(rootdir, "empty")))
+	entries, err := ioutil.ReadDir(rootdir)
+	require.Nil(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.Equal(t, []string{".dino", "empty", "full"}, names)
+}
+
+// Mounts a file system backed by in-memory stores. The setup functions can
+// customize the factory before the mount.
+func testMount(t *testing.T, setup ...func(*dinoNodeFactory)) (mountpoint string, factory *dinoNodeFactory, cleanup func()) {
 	t.Helper()
 
 	dir, err := ioutil.TempDir("", "dinofs-test-")
@@ -411,12 +479,16 @@ func testMount(t *testing.T) (mountpoint string, factory *dinoNodeFactory, clean
 
 	factory.metadata = &fakeVersionedStore{}
 	factory.blobs = storage.NewBlobStore(storage.NewInMemoryStore())
+	factory.control = newControlDir(factory, &config{}, nil)
 
 	var zero [nodeKeyLen]byte
 	root := factory.existingNode("root", zero)
-	root.mode |= fuse.S_IFDIR
+	root.mode = fuse.S_IFDIR | 0755
 	root.children = make(map[string]*dinoNode)
 	factory.root = root
+	for _, f := range setup {
+		f(factory)
+	}
 
 	server, err := fs.Mount(dir, root, &fs.Options{
 		UID: uint32(os.Getuid()),
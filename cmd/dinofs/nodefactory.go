@@ -7,7 +7,9 @@ import (
 	"time"
 
 	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/quota"
 	"github.com/nicolagi/dino/storage"
+	"github.com/nicolagi/dino/volume"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -15,12 +17,56 @@ type dinoNodeFactory struct {
 	root     *dinoNode
 	inogen   *inodeNumbersGenerator
 	metadata storage.VersionedStore
-	blobs    *storage.BlobStoreWrapper
+	blobs    storage.BlobStore
+
+	// The store underlying blobs, propagating blobs to the remote in the
+	// background. Nil if blobs are not propagated.
+	paired *storage.Paired
+
+	// Nil unless quotas are enabled.
+	quotas *quota.Tracker
+
+	// Nil unless metadata write-behind is enabled.
+	commits *committer
+
+	// Whether files should be opened with direct I/O, bypassing the page cache.
+	directIO bool
+
+	// Contents (of files and symlinks) smaller than this many bytes are stored
+	// inline in the node metadata, rather than in blobs.
+	inlineThreshold int
+
+	// If not nil, added to the root node (see controlName).
+	control *controlDir
+
+	// Saved in the nodes this client changes, to tell other clients who
+	// changed them.
+	origin string
+
+	// Nil unless change events are served.
+	events *eventFeed
+
+	// Built from the fields above on first use, see volume.
+	volumeOnce sync.Once
+	vol        *volume.FS
 
 	mu    sync.Mutex
 	known map[[nodeKeyLen]byte]*dinoNode
 }
 
+// Returns the volume the nodes belong to. Contents are stored, nodes saved and
+// quotas charged through it, the same way other clients of the volume (e.g.,
+// dinodav) do. The tree of nodes, which caches what's loaded, is dinofs's own.
+func (factory *dinoNodeFactory) volume() *volume.FS {
+	factory.volumeOnce.Do(func() {
+		factory.vol = volume.New(factory.metadata, factory.blobs,
+			volume.WithInlineThreshold(factory.inlineThreshold),
+			volume.WithOrigin(factory.origin),
+			volume.WithQuotas(factory.quotas))
+	})
+	return factory.vol
+}
+
 func (factory *dinoNodeFactory) allocNode() (*dinoNode, error) {
 	var node dinoNode
 	node.factory = factory
@@ -73,11 +119,59 @@ func (factory *dinoNodeFactory) getKnown(key [nodeKeyLen]byte) *dinoNode {
 	return factory.known[key]
 }
 
+func (factory *dinoNodeFactory) knownNodes() []*dinoNode {
+	factory.mu.Lock()
+	defer factory.mu.Unlock()
+	nodes := make([]*dinoNode, 0, len(factory.known))
+	for _, node := range factory.known {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// Saves all pending changes, e.g., writes to files that haven't been closed yet.
+func (factory *dinoNodeFactory) flush() error {
+	var failed int
+	for _, node := range factory.knownNodes() {
+		node.mu.Lock()
+		if node.sync() != 0 {
+			failed++
+		}
+		node.mu.Unlock()
+	}
+	if failed > 0 {
+		return fmt.Errorf("could not sync %d nodes", failed)
+	}
+	if factory.commits != nil {
+		return factory.commits.flush()
+	}
+	return nil
+}
+
+// Returns the number of nodes known and the size of the file contents loaded
+// in memory.
+func (factory *dinoNodeFactory) cacheSizes() (nodes int, contentBytes int) {
+	for _, node := range factory.knownNodes() {
+		node.mu.Lock()
+		contentBytes += len(node.content)
+		node.mu.Unlock()
+		nodes++
+	}
+	return nodes, contentBytes
+}
+
 func (factory *dinoNodeFactory) invalidateCache(mutation message.Message) {
 	logger := log.WithFields(log.Fields{
 		"op":       "import",
 		"mutation": mutation.String(),
 	})
+	if quota.IsKey([]byte(mutation.Key())) {
+		if factory.quotas != nil {
+			logger.Debug("Invalidating quota counters")
+			factory.quotas.Invalidate([]byte(mutation.Key()))
+		}
+		return
+	}
 	if len(mutation.Key()) != nodeKeyLen {
 		logger.Debug("Not updating (not a metadata key)")
 		return
@@ -101,4 +195,9 @@ func (factory *dinoNodeFactory) invalidateCache(mutation message.Message) {
 	}
 	logger.Debug("Marking for update")
 	node.shouldReloadMetadata = true
+	if factory.events != nil && factory.events.active() {
+		if before, ok := node.snapshot(); ok {
+			factory.events.enqueue(nodeChange{key: key, before: before})
+		}
+	}
 }
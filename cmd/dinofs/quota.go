@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/nicolagi/dino/quota"
+	"github.com/nicolagi/dino/volume"
+	log "github.com/sirupsen/logrus"
+)
+
+// What's been charged to quotas for a node, and to whom.
+type charge struct {
+	user   uint32
+	bytes  int64
+	inodes int64
+}
+
+// The bytes charged for a node loaded from the metadata store, whose content
+// isn't inline, until the content is loaded.
+const unknownBytes = -1
+
+const (
+	statfsBlockSize = 4096
+
+	// What's reported as the total for file systems without limits.
+	unlimitedBlocks = 1 << 40
+	unlimitedFiles  = 1 << 32
+)
+
+// Call with lock held, when saving the node. Returns what should be charged
+// for the node as it is, and the charges that make up the difference with what
+// was charged last, to make once the node is committed (see saveMetadata).
+func (node *dinoNode) recharge() (want charge, charges []charge) {
+	if node.factory.quotas == nil {
+		return node.charged, nil
+	}
+	want = charge{
+		user:   node.user,
+		bytes:  node.charged.bytes,
+		inodes: 1,
+	}
+	// Only if the content is loaded do we know its size.
+	if node.content != nil || len(node.contentKey) == 0 {
+		want.bytes = int64(len(node.content))
+	} else if node.inline {
+		want.bytes = int64(len(node.contentKey))
+	}
+	return want, difference(node.charged, want)
+}
+
+// Call with lock held, when removing the node from its parent. Returns the
+// refunds for the node, to make once the parent is committed, which the caller
+// adds to the parent's (see dinoNode.refunds).
+func (node *dinoNode) discharge() []charge {
+	if node.factory.quotas == nil {
+		return nil
+	}
+	if _, errno := node.chargedBytes(); errno != 0 {
+		// Refund the inode, at least.
+		node.charged.bytes = 0
+	}
+	return difference(node.charged, charge{user: node.charged.user})
+}
+
+// Returns the charges that turn what's charged from one amount to another,
+// refunding the previous owner and charging the new one if they differ.
+func difference(from, to charge) []charge {
+	switch {
+	case from == to:
+		return nil
+	case from.user != to.user:
+		return []charge{
+			{user: from.user, bytes: -from.bytes, inodes: -from.inodes},
+			to,
+		}
+	default:
+		return []charge{
+			{user: to.user, bytes: to.bytes - from.bytes, inodes: to.inodes - from.inodes},
+		}
+	}
+}
+
+// Charges (or refunds) the owners and the volume, after the changes the
+// charges are for have been committed.
+func (factory *dinoNodeFactory) charge(charges []charge) {
+	if factory.quotas == nil {
+		return
+	}
+	for _, c := range charges {
+		factory.volume().Charge(c.user, c.bytes, c.inodes)
+		log.WithField("charge", c).Debug("Updated quota usage")
+	}
+}
+
+// Call with lock held. Returns the bytes charged for the node's content. If
+// not known yet, they're the size of the content the node had when charged,
+// which is fetched (as volume.FS does) unless inline.
+func (node *dinoNode) chargedBytes() (int64, syscall.Errno) {
+	if node.charged.bytes != unknownBytes {
+		return node.charged.bytes, 0
+	}
+	used, err := node.factory.volume().Usage(&volume.Metadata{
+		ContentKey: node.contentKey,
+		Inline:     node.inline,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"name": node.name,
+			"err":  err,
+		}).Error("Could not determine quota usage")
+		return 0, syscall.EIO
+	}
+	node.charged.bytes = used
+	return used, 0
+}
+
+// Call with lock held. Returns EDQUOT if growing the node's content to the
+// given size would exceed its owner's or the volume's limits. Usage is charged
+// when syncing, so the growth is relative to what was charged then.
+func (node *dinoNode) checkGrowth(size int64) syscall.Errno {
+	if node.factory.quotas == nil {
+		return 0
+	}
+	charged, errno := node.chargedBytes()
+	if errno != 0 {
+		return errno
+	}
+	return node.checkQuota(node.user, size-charged, 0)
+}
+
+// Returns EDQUOT if charging the given user and the volume for the given
+// amounts would exceed their limits.
+func (node *dinoNode) checkQuota(user uint32, bytes, inodes int64) syscall.Errno {
+	if node.factory.quotas == nil {
+		return 0
+	}
+	err := node.factory.volume().CheckQuota(user, bytes, inodes)
+	if errors.Is(err, syscall.EDQUOT) {
+		log.WithField("user", user).Debug("Quota exceeded")
+		return syscall.EDQUOT
+	}
+	if err != nil {
+		log.WithField("err", err).Error("Could not check quota")
+		return syscall.EIO
+	}
+	return 0
+}
+
+// Statfs reports the volume limits and usage, or those of the calling user, if
+// more restrictive.
+func (node *dinoNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	out.Bsize = statfsBlockSize
+	out.Frsize = statfsBlockSize
+	out.NameLen = 255
+	out.Blocks = unlimitedBlocks
+	out.Bfree = unlimitedBlocks
+	out.Bavail = unlimitedBlocks
+	out.Files = unlimitedFiles
+	out.Ffree = unlimitedFiles
+	q := node.factory.quotas
+	if q == nil {
+		return 0
+	}
+	subjects := []quota.Subject{quota.Volume}
+	if caller, ok := fuse.FromContext(ctx); ok {
+		subjects = append(subjects, quota.User(caller.Uid))
+	}
+	var blocksSet, filesSet bool
+	for _, s := range subjects {
+		usage, err := q.Usage(s)
+		if err != nil {
+			log.WithField("err", err).Error("Could not get quota usage")
+			return syscall.EIO
+		}
+		limits, err := q.Limits(s)
+		if err != nil {
+			log.WithField("err", err).Error("Could not get quota limits")
+			return syscall.EIO
+		}
+		if limits.Bytes > 0 {
+			total := uint64(limits.Bytes) / statfsBlockSize
+			free := uint64(nonNegative(limits.Bytes-usage.Bytes)) / statfsBlockSize
+			if !blocksSet || free < out.Bfree {
+				out.Blocks, out.Bfree, out.Bavail = total, free, free
+				blocksSet = true
+			}
+		}
+		if limits.Inodes > 0 {
+			total := uint64(limits.Inodes)
+			free := uint64(nonNegative(limits.Inodes - usage.Inodes))
+			if !filesSet || free < out.Ffree {
+				out.Files, out.Ffree = total, free
+				filesSet = true
+			}
+		}
+	}
+	return 0
+}
+
+func nonNegative(n int64) int64 {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// The quota command shows usage and limits for the volume and optionally a
+// user, and sets limits if requested.
+func quotaCommand(c *config, args []string) error {
+	flags := flag.NewFlagSet("quota", flag.ContinueOnError)
+	uid := flags.Int64("uid", -1, "show or set limits for this user, rather than for the volume")
+	bytes := flags.Int64("bytes", -1, "set the bytes limit (0 for unlimited)")
+	inodes := flags.Int64("inodes", -1, "set the inodes limit (0 for unlimited)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	store, closeStore, err := c.VersionedStore(nil)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+	q := quota.NewTracker(store)
+	subject := quota.Volume
+	if *uid >= 0 {
+		subject = quota.User(uint32(*uid))
+	}
+	if *bytes >= 0 || *inodes >= 0 {
+		limits, err := q.Limits(subject)
+		if err != nil {
+			return err
+		}
+		if *bytes >= 0 {
+			limits.Bytes = *bytes
+		}
+		if *inodes >= 0 {
+			limits.Inodes = *inodes
+		}
+		if err := q.SetLimits(subject, limits); err != nil {
+			return err
+		}
+	}
+	usage, err := q.Usage(subject)
+	if err != nil {
+		return err
+	}
+	limits, err := q.Limits(subject)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(os.Stdout, "%s\tusage\t%v\n%s\tlimits\t%v\n", subject, usage, subject, limits)
+	return err
+}
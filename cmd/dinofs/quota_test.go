@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/nicolagi/dino/quota"
+	"github.com/nicolagi/dino/storage"
+	"github.com/nicolagi/dino/volume"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuotaEnforcement(t *testing.T) {
+	rootdir, factory, cleanup := testMount(t, func(factory *dinoNodeFactory) {
+		factory.metadata = storage.NewVersionedWrapper(storage.NewInMemoryStore())
+		factory.quotas = quota.NewTracker(factory.metadata)
+	})
+	defer cleanup()
+	const limit = 1 << 20
+	require.Nil(t, factory.quotas.SetLimits(quota.Volume, quota.Counters{Bytes: limit, Inodes: 4}))
+
+	content := bytes.Repeat([]byte("x"), 600<<10)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(rootdir, "first"), content, 0644))
+	usage, err := factory.quotas.Usage(quota.Volume)
+	require.Nil(t, err)
+	// The root counts too.
+	assert.Equal(t, quota.Counters{Bytes: int64(len(content)), Inodes: 2}, usage)
+
+	t.Run("statfs reports limits", func(t *testing.T) {
+		var st syscall.Statfs_t
+		require.Nil(t, syscall.Statfs(rootdir, &st))
+		assert.EqualValues(t, limit/statfsBlockSize, st.Blocks)
+		assert.EqualValues(t, (limit-len(content))/statfsBlockSize, st.Bavail)
+		assert.EqualValues(t, 4, st.Files)
+		assert.EqualValues(t, 2, st.Ffree)
+	})
+	t.Run("writes beyond the bytes limit fail", func(t *testing.T) {
+		err := ioutil.WriteFile(filepath.Join(rootdir, "second"), content, 0644)
+		assert.True(t, errors.Is(err, syscall.EDQUOT), "got %v", err)
+	})
+	t.Run("creation beyond the inodes limit fails", func(t *testing.T) {
+		require.Nil(t, os.Mkdir(filepath.Join(rootdir, "third"), 0755))
+		err := os.Mkdir(filepath.Join(rootdir, "fourth"), 0755)
+		assert.True(t, errors.Is(err, syscall.EDQUOT), "got %v", err)
+	})
+	t.Run("removal gives back usage", func(t *testing.T) {
+		require.Nil(t, os.Remove(filepath.Join(rootdir, "first")))
+		usage, err := factory.quotas.Usage(quota.Volume)
+		require.Nil(t, err)
+		// What's left is the root, the "second" file (written up to the limit)
+		// and the "third" directory.
+		fi, err := os.Stat(filepath.Join(rootdir, "second"))
+		require.Nil(t, err)
+		assert.Equal(t, quota.Counters{Bytes: fi.Size(), Inodes: 3}, usage)
+	})
+}
+
+func TestQuotaAfterRemoteChange(t *testing.T) {
+	rootdir, factory, cleanup := testMount(t, func(factory *dinoNodeFactory) {
+		factory.metadata = storage.NewVersionedWrapper(storage.NewInMemoryStore())
+		factory.quotas = quota.NewTracker(factory.metadata)
+		factory.inlineThreshold = 64
+	})
+	defer cleanup()
+	require.Nil(t, ioutil.WriteFile(filepath.Join(rootdir, "small"), []byte("tiny"), 0644))
+	factory.root.mu.Lock()
+	node := factory.root.children["small"]
+	factory.root.mu.Unlock()
+	require.NotNil(t, node)
+
+	// Another client grows the content, and charges quotas for it.
+	node.mu.Lock()
+	version, b, err := factory.metadata.Get(node.key[:])
+	require.Nil(t, err)
+	var m volume.Metadata
+	require.Nil(t, m.Decode(b))
+	m.ContentKey = []byte("not so tiny anymore")
+	require.Nil(t, factory.metadata.Put(version+1, node.key[:], m.Encode()))
+	require.Nil(t, factory.quotas.Charge(quota.User(m.User), 15, 0))
+	require.Nil(t, factory.quotas.Charge(quota.Volume, 15, 0))
+	node.shouldReloadMetadata = true
+
+	// A change of attributes here mustn't charge for the content again.
+	require.Zero(t, node.reloadIfNeeded())
+	node.mode = node.mode&^0777 | 0600
+	node.shouldSaveMetadata = true
+	require.Zero(t, node.sync())
+	node.mu.Unlock()
+
+	usage, err := factory.quotas.Usage(quota.Volume)
+	require.Nil(t, err)
+	assert.Equal(t, quota.Counters{Bytes: 19, Inodes: 2}, usage)
+}
+
+func TestQuotaRefundOfContentNotLoaded(t *testing.T) {
+	metadata := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	blobs := storage.NewBlobStore(storage.NewInMemoryStore())
+	setup := func(factory *dinoNodeFactory) {
+		factory.metadata = metadata
+		factory.blobs = blobs
+		factory.quotas = quota.NewTracker(metadata)
+	}
+	rootdir, factory, cleanup := testMount(t, setup)
+	require.Nil(t, os.Mkdir(filepath.Join(rootdir, "dir"), 0755))
+	start, err := factory.quotas.Usage(quota.Volume)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(rootdir, "dir", "file"), bytes.Repeat([]byte("x"), 100), 0644))
+	cleanup()
+
+	// Another client, which loads the file's metadata but not its content.
+	_, factory, cleanup = testMount(t, setup, func(factory *dinoNodeFactory) {
+		require.Nil(t, factory.root.loadMetadata(factory.root.key))
+	})
+	defer cleanup()
+	dir := factory.root.children["dir"]
+	require.Nil(t, dir.loadMetadata(dir.key))
+	file := dir.children["file"]
+	require.Nil(t, file.loadMetadata(file.key))
+	require.Nil(t, file.content)
+
+	require.Zero(t, dir.Unlink(context.Background(), "file"))
+	usage, err := factory.quotas.Usage(quota.Volume)
+	require.Nil(t, err)
+	assert.Equal(t, start, usage)
+}
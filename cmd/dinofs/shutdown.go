@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+)
+
+// Saves all pending changes and waits, up to the given timeout, for blobs to be
+// propagated to the remote store.
+func (factory *dinoNodeFactory) drain(timeout time.Duration) {
+	if err := factory.flush(); err != nil {
+		log.WithField("err", err).Error("Could not save all pending changes")
+	}
+	if factory.paired != nil {
+		if err := factory.paired.Drain(timeout); err != nil {
+			log.WithField("err", err).Error("Could not propagate all blobs to the remote")
+		}
+	}
+}
+
+// Drains and unmounts upon SIGINT or SIGTERM. If the file system is busy and
+// can't be unmounted, it keeps being served until the next signal.
+func handleSignals(server *fuse.Server, factory *dinoNodeFactory, timeout time.Duration) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range c {
+		log.WithField("signal", sig).Info("Shutting down")
+		factory.drain(timeout)
+		if err := server.Unmount(); err != nil {
+			log.WithField("err", err).Error("Could not unmount")
+		}
+	}
+}
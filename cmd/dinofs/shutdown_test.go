@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrainSavesPendingChanges(t *testing.T) {
+	store := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	rootdir, factory, cleanup := testMount(t, func(factory *dinoNodeFactory) {
+		factory.metadata = store
+		factory.commits = newCommitter(factory, time.Hour)
+	})
+	defer cleanup()
+	f, err := os.Create(filepath.Join(rootdir, "file"))
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+	}()
+	_, err = f.Write([]byte("not closed yet"))
+	require.Nil(t, err)
+
+	factory.drain(time.Second)
+
+	factory.root.mu.Lock()
+	node := factory.root.children["file"]
+	factory.root.mu.Unlock()
+	node.mu.Lock()
+	key, contentKey := node.key, node.contentKey
+	node.mu.Unlock()
+	_, b, err := store.Get(key[:])
+	require.Nil(t, err)
+	saved := dinoNode{factory: factory}
+	require.Nil(t, saved.unserialize(b))
+	assert.NotEmpty(t, contentKey)
+	assert.Equal(t, contentKey, saved.contentKey)
+	content, err := factory.blobs.Get(contentKey)
+	require.Nil(t, err)
+	assert.Equal(t, "not closed yet", string(content))
+}
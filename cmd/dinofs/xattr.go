@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/nicolagi/dino/storage"
+)
+
+// Extended attributes with this prefix are computed from the node's state,
+// for debugging purposes, and never persisted.
+const virtualXattrPrefix = "dino."
+
+var virtualXattrs = map[string]func(*dinoNode) string{
+	"dino.key": func(node *dinoNode) string {
+		return fmt.Sprintf("%x", node.key)
+	},
+	"dino.version": func(node *dinoNode) string {
+		return strconv.FormatUint(node.version, 10)
+	},
+	"dino.content": func(node *dinoNode) string {
+		if node.inline {
+			return "inline"
+		}
+		return fmt.Sprintf("%x", node.contentKey)
+	},
+	"dino.dirty": func(node *dinoNode) string {
+		dirty := node.shouldSaveMetadata || node.shouldSaveContent
+		if c := node.factory.commits; c != nil && !dirty {
+			dirty = c.isPending(node.key)
+		}
+		return strconv.FormatBool(dirty)
+	},
+	// Whether the content has been propagated to the remote blob store.
+	"dino.uploaded": func(node *dinoNode) string {
+		if node.shouldSaveContent {
+			return "false"
+		}
+		paired := node.factory.paired
+		if paired == nil || node.inline || len(node.contentKey) == 0 {
+			return "true"
+		}
+		keys := [][]byte{node.contentKey}
+		if chunked, ok := node.factory.blobs.(*storage.ChunkedBlobStore); ok {
+			chunks, err := chunked.ChunkKeys(node.contentKey)
+			if err != nil {
+				return "false"
+			}
+			keys = append(keys, chunks...)
+		}
+		for _, key := range keys {
+			if paired.IsPending(key) {
+				return "false"
+			}
+		}
+		return "true"
+	},
+}
+
+func isVirtualXattr(attr string) bool {
+	return strings.HasPrefix(attr, virtualXattrPrefix)
+}
+
+// Listxattr should read all attributes (null terminated) into `dest`. If the
+// `dest` buffer is too small, it should return ERANGE and the correct size.
+func (node *dinoNode) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	var names []string
+	for attr := range node.xattrs {
+		names = append(names, attr)
+	}
+	for attr := range virtualXattrs {
+		names = append(names, attr)
+	}
+	sort.Strings(names)
+	var b []byte
+	for _, attr := range names {
+		b = append(b, attr...)
+		b = append(b, 0)
+	}
+	if len(b) > len(dest) {
+		return uint32(len(b)), syscall.ERANGE
+	}
+	return uint32(copy(dest, b)), 0
+}
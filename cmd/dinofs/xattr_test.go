@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestVirtualXattrs(t *testing.T) {
+	rootdir, _, cleanup := testMount(t)
+	defer cleanup()
+	p := filepath.Join(rootdir, "file")
+	content := []byte("some content")
+	require.Nil(t, ioutil.WriteFile(p, content, 0644))
+	getxattr := func(attr string) string {
+		buf := make([]byte, 256)
+		n, err := unix.Getxattr(p, attr, buf)
+		require.Nil(t, err, attr)
+		return string(buf[:n])
+	}
+	t.Run("are computed from the node", func(t *testing.T) {
+		assert.Len(t, getxattr("dino.key"), 2*nodeKeyLen)
+		assert.NotEqual(t, "0", getxattr("dino.version"))
+		assert.Equal(t, fmt.Sprintf("%x", sha1.Sum(content)), getxattr("dino.content"))
+		assert.Equal(t, "false", getxattr("dino.dirty"))
+		assert.Equal(t, "true", getxattr("dino.uploaded"))
+	})
+	t.Run("are listed along with the others", func(t *testing.T) {
+		require.Nil(t, unix.Setxattr(p, "user.color", []byte("blue"), 0))
+		buf := make([]byte, 1024)
+		n, err := unix.Listxattr(p, buf)
+		require.Nil(t, err)
+		names := strings.Split(strings.TrimRight(string(buf[:n]), "\x00"), "\x00")
+		assert.Equal(t, []string{"dino.content", "dino.dirty", "dino.key", "dino.uploaded", "dino.version", "user.color"}, names)
+	})
+	t.Run("cannot be written", func(t *testing.T) {
+		err := unix.Setxattr(p, "dino.version", []byte("42"), 0)
+		assert.Equal(t, syscall.EPERM, err)
+		assert.NotEqual(t, "42", getxattr("dino.version"))
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nicolagi/dino/metadata/server"
+)
+
+// Prints the records of the audit log matching the given flags, e.g.,
+//
+//	metadataserver audit -key 6b3d
+//	metadataserver audit -client glenda@plan9 -rejected
+func auditCommand(opts *options, args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	key := flags.String("key", "", "only puts to keys starting with this hex `prefix`")
+	client := flags.String("client", "", "only puts from the client with this `name`, or from this remote address")
+	rejected := flags.Bool("rejected", false, "only rejected puts")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	f, err := os.Open(os.ExpandEnv(opts.AuditLog))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	decoder := json.NewDecoder(f)
+	for {
+		var r server.AuditRecord
+		if err := decoder.Decode(&r); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%q: %w", opts.AuditLog, err)
+		}
+		if !strings.HasPrefix(r.Key, strings.ToLower(*key)) {
+			continue
+		}
+		if *client != "" && r.Client != *client && r.Remote != *client {
+			continue
+		}
+		if *rejected && r.Accepted {
+			continue
+		}
+		outcome := "accepted"
+		if !r.Accepted {
+			outcome = "rejected: " + r.Err
+		}
+		name := r.Client
+		if name == "" {
+			name = "-"
+		}
+		fmt.Printf("%s %s %s %s %d %d %s\n", r.Time.Format(time.RFC3339Nano), name, r.Remote, r.Key, r.Version, r.Size, outcome)
+	}
+}
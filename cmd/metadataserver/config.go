@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 
+	"github.com/nicolagi/dino/metadata/server"
 	"github.com/rogpeppe/rjson"
 )
 
@@ -10,6 +11,30 @@ type options struct {
 	Name           string `json:"name"`
 	MetadataServer string `json:"metadata_server"`
 	Debug          bool   `json:"debug"`
+
+	// Where each put, accepted or rejected, is appended as a line of JSON.
+	// Defaults to $HOME/lib/dino/audit-NAME.log.
+	AuditLog string `json:"audit_log"`
+
+	// If set, clients must authenticate with the secret associated with the
+	// name they identify themselves with (the origin, in the fs config), e.g.,
+	// secrets: {"alice@laptop": "..."}.
+	Secrets map[string]string `json:"secrets"`
+
+	// If cert and key are set, serve over TLS only, and if client_ca is also
+	// set, require clients to present certificates signed by it, identifying
+	// them by their common names.
+	TLS struct {
+		Cert     string `json:"cert"`
+		Key      string `json:"key"`
+		ClientCA string `json:"client_ca"`
+	} `json:"tls"`
+
+	// If set, the server is one of a replicated group made of these servers,
+	// itself included, by name, e.g.,
+	// peers: [{name: "a", raft: "host-a:6670", address: "host-a:6660"}, ...].
+	// Only the leader serves clients, the others redirect them to it.
+	Peers []server.Peer `json:"peers"`
 }
 
 func loadOptions(pathname string) (*options, error) {
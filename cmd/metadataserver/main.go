@@ -11,11 +11,16 @@ import (
 	"github.com/google/gops/agent"
 	"github.com/nicolagi/dino/metadata/server"
 	"github.com/nicolagi/dino/storage"
+	"github.com/nicolagi/dino/tlsconfig"
 	log "github.com/sirupsen/logrus"
 )
 
 func main() {
 	optsFile := flag.String("config", os.ExpandEnv("$HOME/lib/dino/metadataserver.config"), "location of configuration file")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-config file] [audit [-key prefix] [-client name] [-rejected]]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	log.SetFormatter(&log.TextFormatter{
@@ -32,16 +37,39 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	dir := os.ExpandEnv("$HOME/lib/dino")
+	if opts.AuditLog == "" {
+		opts.AuditLog = filepath.Join(dir, fmt.Sprintf("audit-%s.log", opts.Name))
+	}
+
+	if flag.NArg() > 0 {
+		if flag.Arg(0) != "audit" {
+			log.Fatalf("%q: unknown command (known: audit)", flag.Arg(0))
+		}
+		if err := auditCommand(opts, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if err := agent.Listen(agent.Options{}); err != nil {
 		log.WithField("err", err).Warn("Could not start gops agent")
 	} else {
 		defer agent.Close()
 	}
 
-	dir := os.ExpandEnv("$HOME/lib/dino")
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		log.Fatalf("Could not ensure directory %q exists: %v", dir, err)
 	}
+	auditLog, err := os.OpenFile(os.ExpandEnv(opts.AuditLog), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Fatalf("Could not open audit log %q: %v", opts.AuditLog, err)
+	}
+	defer func() {
+		if err := auditLog.Close(); err != nil {
+			log.Warnf("Could not close audit log: %v", err)
+		}
+	}()
 	file := filepath.Join(dir, fmt.Sprintf("storage-%s.db", opts.Name))
 	db, err := bolt.Open(file, 0600, nil)
 	if err != nil {
@@ -58,7 +86,31 @@ func main() {
 		}
 	}()
 
-	srv := server.New(server.WithAddress(opts.MetadataServer), server.WithVersionedStore(metadataStore))
+	if len(opts.Secrets) == 0 && opts.TLS.ClientCA == "" {
+		log.Warn("No secrets or client CA configured, any client can connect")
+	}
+	secrets := make(map[string][]byte, len(opts.Secrets))
+	for name, secret := range opts.Secrets {
+		secrets[name] = []byte(secret)
+	}
+	serverOpts := []server.Option{
+		server.WithAddress(opts.MetadataServer),
+		server.WithVersionedStore(metadataStore),
+		server.WithAuditLog(auditLog),
+		server.WithSecrets(secrets),
+	}
+	if opts.TLS.Cert != "" {
+		config, err := tlsconfig.Server(os.ExpandEnv(opts.TLS.Cert), os.ExpandEnv(opts.TLS.Key), os.ExpandEnv(opts.TLS.ClientCA))
+		if err != nil {
+			log.Fatalf("Could not load TLS configuration: %v", err)
+		}
+		serverOpts = append(serverOpts, server.WithTLS(config))
+	}
+	if len(opts.Peers) > 0 {
+		raftDir := filepath.Join(dir, fmt.Sprintf("raft-%s", opts.Name))
+		serverOpts = append(serverOpts, server.WithReplication(opts.Name, opts.Peers, raftDir))
+	}
+	srv := server.New(serverOpts...)
 	addr, err := srv.Listen()
 	if err != nil {
 		log.Fatal(err)
@@ -1,16 +1,19 @@
 module github.com/nicolagi/dino
 
-go 1.13
+go 1.16
 
 require (
+	9fans.net/go v0.0.2
 	github.com/aws/aws-sdk-go v1.24.5
 	github.com/boltdb/bolt v1.3.1
 	github.com/google/gops v0.3.6
 	github.com/hanwen/go-fuse/v2 v2.0.3-0.20191004183040-1266c0dcb6ed
+	github.com/hashicorp/raft v1.3.11
+	github.com/hashicorp/raft-boltdb v0.0.0-20230125174641-2a8082862702
 	github.com/rogpeppe/rjson v0.0.0-20151026200957-77220b71d327
 	github.com/sirupsen/logrus v1.4.2
 	github.com/stretchr/testify v1.4.0
-	golang.org/x/net v0.0.0-20190923162816-aa69164e4478 // indirect
-	golang.org/x/sys v0.0.0-20190907184412-d223b2b6db03
+	golang.org/x/net v0.0.0-20190923162816-aa69164e4478
+	golang.org/x/sys v0.0.0-20200122134326-e047566fdf82
 	golang.org/x/time v0.0.0-20190921001708-c4c64cad1fd0
 )
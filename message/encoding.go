@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"sync"
 
 	"github.com/nicolagi/dino/bits"
@@ -39,8 +40,40 @@ func (e *Encoder) Encode(w io.Writer, m Message) error {
 	e.makeroom(3)
 	e.put8(uint8(m.kind))
 	e.put16(m.tag)
+	if m.kind == KindList {
+		e.makeroom(e.off + 2 + len(m.key))
+		e.puts(m.key)
+	}
+	if m.kind.hasEntries() {
+		if len(m.entries) > math.MaxUint16 {
+			return ErrBadMessage
+		}
+		e.makeroom(e.off + 2)
+		e.put16(uint16(len(m.entries)))
+		for _, entry := range m.entries {
+			e.makeroom(e.off + 1)
+			e.put8(uint8(entry.kind))
+			if err := e.encodeBody(entry); err != nil {
+				return err
+			}
+		}
+	} else if err := e.encodeBody(m); err != nil {
+		return err
+	}
+	n, err := w.Write(e.buf[:e.off])
+	if err != nil {
+		return err
+	}
+	if n != e.off {
+		return fmt.Errorf("wrote %d of %d bytes: %w", n, e.off, ErrUnderflow)
+	}
+	return nil
+}
+
+// Encodes what follows the kind and tag for messages not carrying others.
+func (e *Encoder) encodeBody(m Message) error {
 	switch m.kind {
-	case KindGet:
+	case KindGet, KindDelete:
 		e.makeroom(e.off + 2 + len(m.key))
 		e.puts(m.key)
 	case KindPut:
@@ -48,19 +81,12 @@ func (e *Encoder) Encode(w io.Writer, m Message) error {
 		e.puts(m.key)
 		e.puts(m.value)
 		e.put64(m.version)
-	case KindError:
+	case KindError, KindHello, KindAuth, KindRedirect:
 		e.makeroom(e.off + 2 + len(m.value))
 		e.puts(m.value)
 	default:
 		return ErrBadMessage
 	}
-	n, err := w.Write(e.buf[:e.off])
-	if err != nil {
-		return err
-	}
-	if n != e.off {
-		return fmt.Errorf("wrote %d of %d bytes: %w", n, e.off, ErrUnderflow)
-	}
 	return nil
 }
 
@@ -68,7 +94,12 @@ func (e *Encoder) makeroom(required int) {
 	if len(e.buf) >= required {
 		return
 	}
-	larger := make([]byte, required)
+	// Grow geometrically, as put-many messages are encoded a bit at a time.
+	size := 2 * len(e.buf)
+	if size < required {
+		size = required
+	}
+	larger := make([]byte, size)
 	copy(larger, e.buf)
 	e.buf = larger
 }
@@ -113,11 +144,42 @@ func (d *Decoder) Decode(r io.Reader, m *Message) error {
 	d.Lock()
 	defer d.Unlock()
 	d.err = nil
+	*m = Message{}
 	d.read(r, 5)
 	m.kind = Kind(d.get8())
 	m.tag = d.get16()
+	if m.kind == KindList {
+		n := d.get16()
+		d.read(r, n+2)
+		m.key = d.gets(n)
+	}
+	if m.kind.hasEntries() {
+		count := d.get16()
+		if count > 0 {
+			m.entries = make([]Message, count)
+		}
+		for i := range m.entries {
+			if d.err != nil {
+				break
+			}
+			d.read(r, 3)
+			m.entries[i].kind = Kind(d.get8())
+			if m.entries[i].kind.hasEntries() {
+				return ErrBadMessage
+			}
+			d.decodeBody(r, &m.entries[i])
+		}
+	} else {
+		d.decodeBody(r, m)
+	}
+	return d.err
+}
+
+// Decodes what follows the kind and tag for messages not carrying others,
+// assuming the first two bytes have been read already.
+func (d *Decoder) decodeBody(r io.Reader, m *Message) {
 	switch m.kind {
-	case KindGet:
+	case KindGet, KindDelete:
 		n := d.get16()
 		d.read(r, n)
 		m.key = d.gets(n)
@@ -129,12 +191,11 @@ func (d *Decoder) Decode(r io.Reader, m *Message) error {
 		d.read(r, n+8)
 		m.value = d.gets(n)
 		m.version = d.get64()
-	case KindError:
+	case KindError, KindHello, KindAuth, KindRedirect:
 		n := d.get16()
 		d.read(r, n)
 		m.value = d.gets(n)
 	}
-	return d.err
 }
 
 func (d *Decoder) get8() uint8 {
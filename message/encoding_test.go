@@ -61,4 +61,77 @@ func TestMessageWhatYouEncodeIsWhatYouDecode(t *testing.T) {
 			test(t, encoder, decoder, &buf, m)
 		}
 	})
+
+	t.Run("pack and unpack put-many messages", func(t *testing.T) {
+		for i := 0; i < iters; i++ {
+			entries := make([]message.Message, 1+rand.Intn(8))
+			for j := range entries {
+				if rand.Intn(2) == 0 {
+					entries[j] = message.NewPutMessage(0, message.RandomString(), message.RandomString(), message.RandomVersion())
+				} else {
+					entries[j] = message.NewErrorMessage(0, message.RandomString())
+				}
+			}
+			m := message.NewPutManyMessage(message.RandomTag(), entries)
+			testWithNewEncoderAndDecoder(t, m)
+			test(t, encoder, decoder, &buf, m)
+		}
+	})
+
+	t.Run("pack and unpack get-many messages", func(t *testing.T) {
+		for i := 0; i < iters; i++ {
+			entries := make([]message.Message, 1+rand.Intn(8))
+			for j := range entries {
+				entries[j] = message.NewGetMessage(0, message.RandomString())
+			}
+			m := message.NewGetManyMessage(message.RandomTag(), entries)
+			testWithNewEncoderAndDecoder(t, m)
+			test(t, encoder, decoder, &buf, m)
+		}
+	})
+
+	t.Run("pack and unpack list messages", func(t *testing.T) {
+		for i := 0; i < iters; i++ {
+			// Requests carry no entries.
+			var entries []message.Message
+			for j := rand.Intn(8); j > 0; j-- {
+				entries = append(entries, message.NewGetMessage(0, message.RandomString()))
+			}
+			m := message.NewListMessage(message.RandomTag(), message.RandomString(), entries)
+			testWithNewEncoderAndDecoder(t, m)
+			test(t, encoder, decoder, &buf, m)
+		}
+	})
+
+	t.Run("pack and unpack delete messages", func(t *testing.T) {
+		for i := 0; i < iters; i++ {
+			m := message.NewDeleteMessage(message.RandomTag(), message.RandomString())
+			testWithNewEncoderAndDecoder(t, m)
+			test(t, encoder, decoder, &buf, m)
+		}
+	})
+
+	t.Run("pack and unpack hello messages", func(t *testing.T) {
+		for i := 0; i < iters; i++ {
+			m := message.NewHelloMessage(message.RandomTag(), message.RandomString())
+			testWithNewEncoderAndDecoder(t, m)
+			test(t, encoder, decoder, &buf, m)
+		}
+	})
+
+	t.Run("pack and unpack auth messages", func(t *testing.T) {
+		for i := 0; i < iters; i++ {
+			m := message.NewAuthMessage(message.RandomTag(), message.RandomString())
+			testWithNewEncoderAndDecoder(t, m)
+			test(t, encoder, decoder, &buf, m)
+		}
+	})
+
+	t.Run("pack and unpack redirect messages", func(t *testing.T) {
+		for i := 0; i < iters; i++ {
+			m := message.NewRedirectMessage(message.RandomTag(), message.RandomString())
+			testWithNewEncoderAndDecoder(t, m)
+			test(t, encoder, decoder, &buf, m)
+		}
+	})
 }
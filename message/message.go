@@ -1,6 +1,8 @@
 package message
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"fmt"
 	"math/rand"
 	"unicode"
@@ -34,8 +36,52 @@ const (
 	// possibly redo the put with the correct version, or give up the put). Other
 	// error conditions might arise.
 	KindError
+	// KindPutMany is a message carrying many put messages, sent from the client
+	// to the server to save round trips. The server applies the puts in order, as
+	// if they had been sent separately, and responds with a KindPutMany message
+	// carrying, for each put, the put itself if accepted or an error message.
+	// Accepted puts are fanned out as separate KindPut messages.
+	KindPutMany
+	// KindGetMany is a message carrying many get messages, sent from the client
+	// to the server to save round trips. The server responds with a KindGetMany
+	// message carrying, for each get, the put or error message it would have
+	// sent in response to the get alone.
+	KindGetMany
+	// KindList is a message from the client to the server, asking for the keys
+	// greater than the message key, e.g., for garbage collection. The server
+	// responds with a KindList message carrying get messages for some of those
+	// keys, in increasing order, or none if there are no more.
+	KindList
+	// KindDelete is a message from the client to the server, asking to delete
+	// a key, e.g., for garbage collection. The server responds with the same
+	// message if the key was deleted (or wasn't there), or an error message.
+	// Deletions are not fanned out.
+	KindDelete
+	// KindHello is a message from the client to the server, sent first on each
+	// connection, carrying the name the client identifies itself with (e.g.,
+	// "user@host") as its value. The server responds with the same message.
+	// Clients need not send it, in which case they remain anonymous, unless
+	// the server requires authentication, in which case it responds with a
+	// KindAuth message first.
+	KindHello
+	// KindAuth is a message the server sends in response to a hello message,
+	// if it requires authentication, carrying a random challenge as its value.
+	// The client responds with a KindAuth message carrying AuthResponse for
+	// the challenge. The server then responds to the hello message, or with an
+	// error message and closes the connection.
+	KindAuth
+	// KindRedirect is a message a replicated server sends when it's not the
+	// leader of its group, carrying the address of the leader, for clients to
+	// connect to instead, or the empty string if the leader is not known, e.g.,
+	// during an election. The server then closes the connection.
+	KindRedirect
 )
 
+// Tells whether messages of this kind carry other messages.
+func (k Kind) hasEntries() bool {
+	return k == KindPutMany || k == KindGetMany || k == KindList
+}
+
 // String implements fmt.Stringer.
 func (k Kind) String() string {
 	switch k {
@@ -45,6 +91,20 @@ func (k Kind) String() string {
 		return "PUT"
 	case KindError:
 		return "ERROR"
+	case KindPutMany:
+		return "PUTMANY"
+	case KindGetMany:
+		return "GETMANY"
+	case KindList:
+		return "LIST"
+	case KindDelete:
+		return "DELETE"
+	case KindHello:
+		return "HELLO"
+	case KindAuth:
+		return "AUTH"
+	case KindRedirect:
+		return "REDIRECT"
 	default:
 		return "unknown message kind"
 	}
@@ -69,6 +129,9 @@ type Message struct {
 
 	// Version of the value. Meaningful only for put messages.
 	version uint64
+	// The messages carried by put-many and get-many messages. Their tags are
+	// not meaningful.
+	entries []Message
 }
 
 func repr(any string) string {
@@ -91,6 +154,12 @@ func repr(any string) string {
 // if they contain any non-printable character. Also, they will be clipped at 10
 // runes (not necessarily 10 bytes).
 func (m Message) String() string {
+	if m.kind == KindList {
+		return fmt.Sprintf("kind=%v tag=%d key=%s entries=%d", m.kind, m.tag, repr(m.key), len(m.entries))
+	}
+	if m.kind.hasEntries() {
+		return fmt.Sprintf("kind=%v tag=%d entries=%d", m.kind, m.tag, len(m.entries))
+	}
 	return fmt.Sprintf("kind=%v tag=%d key=%s value=%s version=%d",
 		m.kind, m.tag, repr(m.key), repr(m.value), m.version)
 }
@@ -108,10 +177,10 @@ func (m Message) Tag() uint16 {
 }
 
 // Key returns a key-value pair's key from the message. Call only for
-// KindGet and KindPut, else it'll panic.
+// KindGet, KindPut, KindList and KindDelete, else it'll panic.
 func (m Message) Key() string {
 	switch m.kind {
-	case KindGet, KindPut:
+	case KindGet, KindPut, KindList, KindDelete:
 		return m.key
 	default:
 		panic(m.accessorPanic("Key"))
@@ -119,10 +188,10 @@ func (m Message) Key() string {
 }
 
 // Value returns a key-value pair's value from the message. Call only for
-// KindError and KindPut, else it'll panic.
+// KindError, KindPut, KindHello, KindAuth and KindRedirect, else it'll panic.
 func (m Message) Value() string {
 	switch m.kind {
-	case KindError, KindPut:
+	case KindError, KindPut, KindHello, KindAuth, KindRedirect:
 		return m.value
 	default:
 		panic(m.accessorPanic("Value"))
@@ -140,6 +209,17 @@ func (m Message) Version() uint64 {
 	}
 }
 
+// Entries returns the messages carried by a KindPutMany, KindGetMany or
+// KindList message. Call only for those kinds, or it'll panic.
+func (m Message) Entries() []Message {
+	switch m.kind {
+	case KindPutMany, KindGetMany, KindList:
+		return m.entries
+	default:
+		panic(m.accessorPanic("Entries"))
+	}
+}
+
 func (m Message) accessorPanic(accessorName string) string {
 	return fmt.Sprintf("cannot call .%s for message of kind %v", accessorName, m.kind)
 }
@@ -173,6 +253,83 @@ func NewErrorMessage(tag uint16, message string) Message {
 	}
 }
 
+// NewPutManyMessage constructs a message of KindPutMany kind. The entries
+// should be put messages in requests, put or error messages in responses.
+func NewPutManyMessage(tag uint16, entries []Message) Message {
+	return Message{
+		kind:    KindPutMany,
+		tag:     tag,
+		entries: entries,
+	}
+}
+
+// NewGetManyMessage constructs a message of KindGetMany kind. The entries
+// should be get messages in requests, put or error messages in responses.
+func NewGetManyMessage(tag uint16, entries []Message) Message {
+	return Message{
+		kind:    KindGetMany,
+		tag:     tag,
+		entries: entries,
+	}
+}
+
+// NewListMessage constructs a message of KindList kind, for the keys after
+// the given one. The entries should be empty in requests, get messages in
+// responses.
+func NewListMessage(tag uint16, after string, entries []Message) Message {
+	return Message{
+		kind:    KindList,
+		tag:     tag,
+		key:     after,
+		entries: entries,
+	}
+}
+
+// NewDeleteMessage constructs a message of KindDelete kind.
+func NewDeleteMessage(tag uint16, key string) Message {
+	return Message{
+		kind: KindDelete,
+		tag:  tag,
+		key:  key,
+	}
+}
+
+// NewHelloMessage constructs a message of KindHello kind.
+func NewHelloMessage(tag uint16, name string) Message {
+	return Message{
+		kind:  KindHello,
+		tag:   tag,
+		value: name,
+	}
+}
+
+// NewAuthMessage constructs a message of KindAuth kind.
+func NewAuthMessage(tag uint16, value string) Message {
+	return Message{
+		kind:  KindAuth,
+		tag:   tag,
+		value: value,
+	}
+}
+
+// NewRedirectMessage constructs a message of KindRedirect kind.
+func NewRedirectMessage(tag uint16, leader string) Message {
+	return Message{
+		kind:  KindRedirect,
+		tag:   tag,
+		value: leader,
+	}
+}
+
+// AuthResponse proves to the server that the client with the given name knows
+// the secret it shares with the server, without revealing it.
+func AuthResponse(secret []byte, challenge string, name string) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte(challenge))
+	_, _ = mac.Write([]byte(name))
+	return string(mac.Sum(nil))
+}
+
 // ForBroadcast returns a copy of the message that's suitable to be broadcasted to
 // many connections.
 func (m Message) ForBroadcast() Message {
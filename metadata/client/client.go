@@ -1,9 +1,12 @@
 package client
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/nicolagi/dino/message"
 	log "github.com/sirupsen/logrus"
@@ -11,17 +14,70 @@ import (
 
 var (
 	ErrTimeout = errors.New("timeout")
+
+	// ErrRedirected is returned when the server is a replica that's not the
+	// leader of its group. The client connects to the leader next.
+	ErrRedirected = errors.New("redirected to the leader")
+
+	// ErrNoLeader is returned when the server is a replica that's not the
+	// leader of its group, and doesn't know which is, e.g., during an election.
+	ErrNoLeader = errors.New("no leader")
+
+	// ErrUnavailable is returned when the client failed to connect to all the
+	// servers it knows of, and is backing off from them.
+	ErrUnavailable = errors.New("no server available")
 )
 
+// How long the server has to respond to the hello message.
+const helloTimeout = 5 * time.Second
+
+// How many times Send follows redirections before giving up, e.g., during an
+// election.
+const maxRedirects = 3
+
 type options struct {
-	address string
+	addresses []string
+	name      string
+	secret    []byte
+	tls       *tls.Config
 }
 
 type Option func(*options)
 
 func WithAddress(value string) Option {
+	return WithAddresses(value)
+}
+
+// WithAddresses sets the servers the client can connect to, e.g., those of a
+// replicated group, in order of preference. The client connects to the first
+// one it can, and fails over to the next ones if it loses it, backing off from
+// the servers it failed to connect to, or get responses from.
+func WithAddresses(values ...string) Option {
+	return func(o *options) {
+		o.addresses = values
+	}
+}
+
+// WithName sets the name the client identifies itself with at each
+// connection, e.g., "user@host". Without it, the client is anonymous.
+func WithName(value string) Option {
 	return func(o *options) {
-		o.address = value
+		o.name = value
+	}
+}
+
+// WithTLS makes the client connect over TLS.
+func WithTLS(value *tls.Config) Option {
+	return func(o *options) {
+		o.tls = value
+	}
+}
+
+// WithSecret sets the secret shared with the server, to authenticate the name
+// set with WithName, if the server requires it.
+func WithSecret(value []byte) Option {
+	return func(o *options) {
+		o.secret = value
 	}
 }
 
@@ -39,16 +95,31 @@ type Client struct {
 
 	mu   sync.Mutex
 	conn net.Conn
+
+	// The servers the client knows of, in order of preference, and the one
+	// it's connected to, if any. Replicated servers add to these as they
+	// redirect the client to their leader.
+	endpoints []*endpoint
+	current   *endpoint
+
+	// Broadcasts received while waiting for the response to the hello
+	// message, to be returned by Receive.
+	pending []message.Message
 }
 
 func New(opts ...Option) *Client {
 	var c Client
-	c.opts.address = "127.0.0.1:6660"
 	c.encoder = new(message.Encoder)
 	c.decoder = new(message.Decoder)
 	for _, o := range opts {
 		o(&c.opts)
 	}
+	if len(c.opts.addresses) == 0 {
+		c.opts.addresses = []string{"127.0.0.1:6660"}
+	}
+	for _, address := range c.opts.addresses {
+		c.endpoints = append(c.endpoints, &endpoint{address: address})
+	}
 	return &c
 }
 
@@ -79,20 +150,79 @@ func (c *Client) closeBoth(cached net.Conn) {
 			logger.WithField("err", err).Warn("Could not close current connection")
 		}
 		c.conn = nil
+		c.current = nil
+	}
+}
+
+// Abandon closes the connection, so that the client connects again, e.g.,
+// after requests timed out. If another server is available, it also backs off
+// from this one, so that the client fails over to the other.
+func (c *Client) Abandon() {
+	c.mu.Lock()
+	if e := c.current; e != nil && c.otherAvailable(e, time.Now()) {
+		log.WithFields(log.Fields{
+			"address": e.address,
+			"backoff": e.failed(time.Now()),
+		}).Warn("Abandoning metadata server")
+	}
+	c.mu.Unlock()
+	c.closeBoth(nil)
+}
+
+// CanFailOver tells whether the client is connected, and knows of another
+// server available to connect to.
+func (c *Client) CanFailOver() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.current != nil && c.otherAvailable(c.current, time.Now())
+}
+
+// Tells whether a server other than the given one is available. The client
+// never backs off from the last one available, as it would then have to wait
+// for a server to be available again, even if that one came back sooner. Call
+// with c.mu held.
+func (c *Client) otherAvailable(e *endpoint, now time.Time) bool {
+	for _, other := range c.endpoints {
+		if other != e && other.available(now) {
+			return true
+		}
 	}
+	return false
 }
 
-// Send sends the message to the server.
+// Send sends the message to the server, following redirections to the leader
+// of a replicated group on connecting.
 func (c *Client) Send(m message.Message) error {
-	return c.doWithConn(func(conn net.Conn) error {
+	send := func(conn net.Conn) error {
 		return c.encoder.Encode(conn, m)
-	})
+	}
+	err := c.doWithConn(send)
+	for i := 0; i < maxRedirects && errors.Is(err, ErrRedirected); i++ {
+		err = c.doWithConn(send)
+	}
+	return err
 }
 
 // Receive receives a message from the server.
 func (c *Client) Receive(m *message.Message) error {
 	return c.doWithConn(func(conn net.Conn) error {
-		return c.decoder.Decode(conn, m)
+		c.mu.Lock()
+		if len(c.pending) > 0 {
+			*m = c.pending[0]
+			c.pending = c.pending[1:]
+			c.mu.Unlock()
+			return nil
+		}
+		c.mu.Unlock()
+		if err := c.decoder.Decode(conn, m); err != nil {
+			return err
+		}
+		if m.Kind() == message.KindRedirect {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.follow(m.Value())
+		}
+		return nil
 	})
 }
 
@@ -115,10 +245,147 @@ func (c *Client) getCachedConn() (net.Conn, error) {
 	if c.conn != nil {
 		return c.conn, nil
 	}
-	conn, err := net.Dial("tcp", c.opts.address)
+	now := time.Now()
+	var err error
+	var retryAt time.Time
+	// Redirections replace c.endpoints, but end the loop.
+	for _, e := range c.endpoints {
+		if !e.available(now) {
+			if retryAt.IsZero() || e.retryAt.Before(retryAt) {
+				retryAt = e.retryAt
+			}
+			continue
+		}
+		var conn net.Conn
+		conn, err = c.connect(e.address)
+		if err == nil {
+			e.succeeded()
+			c.conn, c.current = conn, e
+			log.WithField("address", e.address).Info("Connected to metadata server")
+			return conn, nil
+		}
+		if errors.Is(err, ErrRedirected) {
+			return nil, err
+		}
+		fields := log.Fields{
+			"address": e.address,
+			"err":     err,
+		}
+		if c.otherAvailable(e, now) {
+			fields["backoff"] = e.failed(now)
+		}
+		log.WithFields(fields).Warn("Could not connect to metadata server")
+	}
+	if err == nil {
+		err = fmt.Errorf("%w, retrying in %v", ErrUnavailable, retryAt.Sub(now).Round(time.Millisecond))
+	}
+	return nil, err
+}
+
+// Dials the server and says hello, if the client has a name. Call with c.mu
+// held.
+func (c *Client) connect(address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	if c.opts.tls != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, c.opts.tls)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
 	if err != nil {
 		return nil, err
 	}
-	c.conn = conn
+	if c.opts.name != "" {
+		if err := c.hello(conn); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
 	return conn, nil
 }
+
+// Identifies the client to the server, authenticating if the server requires
+// it. Call with c.mu held.
+func (c *Client) hello(conn net.Conn) error {
+	if err := conn.SetDeadline(time.Now().Add(helloTimeout)); err != nil {
+		return err
+	}
+	if err := c.encoder.Encode(conn, message.NewHelloMessage(0, c.opts.name)); err != nil {
+		return err
+	}
+	for {
+		var m message.Message
+		if err := c.decoder.Decode(conn, &m); err != nil {
+			return err
+		}
+		switch m.Kind() {
+		case message.KindHello:
+			return conn.SetDeadline(time.Time{})
+		case message.KindAuth:
+			if len(c.opts.secret) == 0 {
+				return errors.New("hello: server requires a secret")
+			}
+			response := message.AuthResponse(c.opts.secret, m.Value(), c.opts.name)
+			if err := c.encoder.Encode(conn, message.NewAuthMessage(0, response)); err != nil {
+				return err
+			}
+		case message.KindError:
+			return fmt.Errorf("hello: %s", m.Value())
+		case message.KindRedirect:
+			return c.follow(m.Value())
+		default:
+			c.pending = append(c.pending, m)
+		}
+	}
+}
+
+// Makes the client connect to the leader at the given address next, if known,
+// and returns why the client has to reconnect. Call with c.mu held.
+func (c *Client) follow(leader string) error {
+	if leader == "" {
+		return ErrNoLeader
+	}
+	log.WithField("leader", leader).Info("Following the leader")
+	var e *endpoint
+	var others []*endpoint
+	for _, known := range c.endpoints {
+		if known.address == leader {
+			e = known
+		} else {
+			others = append(others, known)
+		}
+	}
+	if e == nil {
+		e = &endpoint{address: leader}
+	}
+	// Another server vouches for it.
+	e.succeeded()
+	c.endpoints = append([]*endpoint{e}, others...)
+	return ErrRedirected
+}
+
+// Address returns the address of the metadata server the client is connected
+// to, or will try to connect to next.
+func (c *Client) Address() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.current != nil {
+		return c.current.address
+	}
+	now := time.Now()
+	for _, e := range c.endpoints {
+		if e.available(now) {
+			return e.address
+		}
+	}
+	return c.endpoints[0].address
+}
+
+// Connected tells whether the client is currently connected to the server.
+// Not being connected is not an error: the client connects lazily.
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Bounds of how long the client waits before connecting again to a server it
+// failed to connect to, or get responses from. The wait doubles with each
+// consecutive failure.
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+// How long the client waits for a connection to a server to be established,
+// before trying the next one.
+const dialTimeout = 3 * time.Second
+
+// A server the client knows of, and how reachable it's been lately.
+type endpoint struct {
+	address string
+
+	// Consecutive failures to connect to the server, or to get responses from
+	// it, and until when not to try again because of them.
+	failures int
+	retryAt  time.Time
+}
+
+func (e *endpoint) available(now time.Time) bool {
+	return !now.Before(e.retryAt)
+}
+
+// Records a failure, and returns how long to back off for.
+func (e *endpoint) failed(now time.Time) time.Duration {
+	e.failures++
+	d := backoff(e.failures)
+	e.retryAt = now.Add(d)
+	return d
+}
+
+func (e *endpoint) succeeded() {
+	e.failures = 0
+	e.retryAt = time.Time{}
+}
+
+// Returns how long to wait after the given number of consecutive failures,
+// randomized between half and all of the exponential backoff, so that clients
+// that lost the same server don't all come back at once.
+func backoff(failures int) time.Duration {
+	d := maxBackoff
+	if failures < 16 {
+		if b := minBackoff << (failures - 1); b < d {
+			d = b
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,52 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	for failures, max := range map[int]time.Duration{
+		1:    minBackoff,
+		2:    2 * minBackoff,
+		5:    16 * minBackoff,
+		20:   maxBackoff,
+		1000: maxBackoff,
+	} {
+		for i := 0; i < 100; i++ {
+			d := backoff(failures)
+			assert.True(t, d >= max/2 && d <= max, "%d failures: %v not in [%v, %v]", failures, d, max/2, max)
+		}
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	now := time.Now()
+	e := &endpoint{address: "localhost:6660"}
+	assert.True(t, e.available(now))
+	d := e.failed(now)
+	assert.False(t, e.available(now))
+	assert.True(t, e.available(now.Add(d)))
+	e.failed(now)
+	assert.Equal(t, 2, e.failures)
+	e.succeeded()
+	assert.True(t, e.available(now))
+	assert.Equal(t, 0, e.failures)
+}
+
+func TestAbandon(t *testing.T) {
+	c := New(WithAddresses("localhost:6660", "localhost:6661"))
+	first, second := c.endpoints[0], c.endpoints[1]
+	c.current = first
+	assert.True(t, c.CanFailOver())
+	c.Abandon()
+	assert.False(t, first.available(time.Now()))
+	// The last server available is never backed off from.
+	c.current = second
+	assert.False(t, c.CanFailOver())
+	c.Abandon()
+	assert.True(t, second.available(time.Now()))
+	assert.Equal(t, 0, second.failures)
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/nicolagi/dino/message"
+	log "github.com/sirupsen/logrus"
+)
+
+// AuditRecord is what the audit log contains about each put, accepted or
+// rejected, as a line of JSON.
+type AuditRecord struct {
+	Time time.Time `json:"time"`
+
+	// The name the client identified itself with, empty if it didn't, and
+	// the connection it put through.
+	Client string `json:"client,omitempty"`
+	Conn   uint16 `json:"conn"`
+	Remote string `json:"remote"`
+
+	// Hex-encoded.
+	Key     string `json:"key"`
+	Version uint64 `json:"version"`
+	Size    int    `json:"size"`
+
+	Accepted bool `json:"accepted"`
+	// Why the put was rejected.
+	Err string `json:"err,omitempty"`
+}
+
+// Records the outcome of a put or put-many request, if auditing is enabled.
+func (sc *serverConn) audit(request, response message.Message) {
+	if sc.server.opts.audit == nil {
+		return
+	}
+	now := time.Now()
+	var puts, outcomes []message.Message
+	switch {
+	case request.Kind() == message.KindPut:
+		puts = []message.Message{request}
+		outcomes = []message.Message{response}
+	case request.Kind() == message.KindPutMany && response.Kind() == message.KindPutMany:
+		puts = request.Entries()
+		outcomes = response.Entries()
+	case request.Kind() == message.KindPutMany:
+		// The whole request was rejected.
+		puts = request.Entries()
+		outcomes = make([]message.Message, len(puts))
+		for i := range outcomes {
+			outcomes[i] = response
+		}
+	default:
+		return
+	}
+	s := sc.server
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	for i, put := range puts {
+		if put.Kind() != message.KindPut || i >= len(outcomes) {
+			continue
+		}
+		r := AuditRecord{
+			Time:     now,
+			Client:   sc.name,
+			Conn:     sc.id,
+			Remote:   sc.conn.RemoteAddr().String(),
+			Key:      hex.EncodeToString([]byte(put.Key())),
+			Version:  put.Version(),
+			Size:     len(put.Value()),
+			Accepted: outcomes[i].Kind() == message.KindPut,
+		}
+		if outcomes[i].Kind() == message.KindError {
+			r.Err = outcomes[i].Value()
+		}
+		b, err := json.Marshal(r)
+		if err != nil {
+			log.WithField("err", err).Error("Could not encode audit record")
+			continue
+		}
+		if _, err := s.opts.audit.Write(append(b, '\n')); err != nil {
+			log.WithField("err", err).Error("Could not write audit record")
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/tlsconfig"
+)
+
+// How long clients have to authenticate, once connected.
+const authTimeout = 10 * time.Second
+
+var errAuthFailed = errors.New("authentication failed")
+
+// WithSecrets makes the server require clients to authenticate, proving they
+// know the secret associated with the name they send in the hello message.
+func WithSecrets(value map[string][]byte) Option {
+	return func(o *options) {
+		o.secrets = value
+	}
+}
+
+func (s *Server) authRequired() bool {
+	return len(s.opts.secrets) > 0
+}
+
+// Runs the challenge-response handshake, before any other message is handled.
+// Clients not knowing any secret are challenged anyway, so that they can't
+// tell which names are known.
+func (sc *serverConn) authenticate() error {
+	if err := sc.conn.SetReadDeadline(time.Now().Add(authTimeout)); err != nil {
+		return err
+	}
+	var hello message.Message
+	if err := sc.decoder.Decode(sc.conn, &hello); err != nil {
+		return err
+	}
+	if hello.Kind() != message.KindHello || hello.Value() == "" {
+		return sc.reject(hello.Tag(), errors.New("authentication required"))
+	}
+	var challenge [32]byte
+	if _, err := rand.Read(challenge[:]); err != nil {
+		return sc.reject(hello.Tag(), err)
+	}
+	if err := sc.encoder.Encode(sc.conn, message.NewAuthMessage(hello.Tag(), string(challenge[:]))); err != nil {
+		return err
+	}
+	var response message.Message
+	if err := sc.decoder.Decode(sc.conn, &response); err != nil {
+		return err
+	}
+	secret, ok := sc.server.opts.secrets[hello.Value()]
+	if response.Kind() != message.KindAuth || !ok {
+		return sc.reject(hello.Tag(), fmt.Errorf("%q: %w", hello.Value(), errAuthFailed))
+	}
+	expected := message.AuthResponse(secret, string(challenge[:]), hello.Value())
+	if !hmac.Equal([]byte(expected), []byte(response.Value())) {
+		return sc.reject(hello.Tag(), fmt.Errorf("%q: %w", hello.Value(), errAuthFailed))
+	}
+	if err := sc.conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	sc.name = hello.Value()
+	sc.server.mu.Lock()
+	sc.authenticated = true
+	sc.server.mu.Unlock()
+	return sc.encoder.Encode(sc.conn, hello)
+}
+
+// Completes the TLS handshake, if the connection is over TLS, and identifies
+// the client by its certificate, if it presented one, which also
+// authenticates it.
+func (sc *serverConn) identifyByCertificate() error {
+	conn, ok := sc.conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if err := conn.SetDeadline(time.Now().Add(authTimeout)); err != nil {
+		return err
+	}
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	if name := tlsconfig.Identity(conn.ConnectionState()); name != "" {
+		sc.name = name
+		sc.server.mu.Lock()
+		sc.authenticated = true
+		sc.server.mu.Unlock()
+	}
+	return nil
+}
+
+// Tells the client why it's being rejected, without revealing more than
+// necessary, and returns the reason.
+func (sc *serverConn) reject(tag uint16, reason error) error {
+	text := reason.Error()
+	if errors.Is(reason, errAuthFailed) {
+		text = errAuthFailed.Error()
+	}
+	_ = sc.encoder.Encode(sc.conn, message.NewErrorMessage(tag, text))
+	return reason
+}
@@ -5,7 +5,6 @@ import (
 	"net"
 
 	"github.com/nicolagi/dino/message"
-	"github.com/nicolagi/dino/storage"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -13,6 +12,13 @@ type serverConn struct {
 	id     uint16
 	server *Server
 
+	// What the client says it is, if it sent a hello message.
+	name string
+
+	// Whether messages can be exchanged, i.e., the client authenticated, or
+	// the server doesn't require it. Guarded by the server's mutex.
+	authenticated bool
+
 	conn    net.Conn
 	encoder *message.Encoder
 	decoder *message.Decoder
@@ -20,17 +26,50 @@ type serverConn struct {
 
 func (s *Server) wrapConn(conn net.Conn) *serverConn {
 	return &serverConn{
-		id:      s.connIDs.Next(),
-		server:  s,
-		conn:    conn,
-		encoder: new(message.Encoder),
-		decoder: new(message.Decoder),
+		id:            s.connIDs.Next(),
+		server:        s,
+		conn:          conn,
+		encoder:       new(message.Encoder),
+		decoder:       new(message.Decoder),
+		authenticated: !s.authRequired(),
 	}
 }
 
 // To be run in a separate goroutine, which will exit when the connection is
 // closed or reset.
 func (sc *serverConn) handleInput() {
+	if err := sc.identifyByCertificate(); err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"id":     sc.id,
+			"remote": sc.conn.RemoteAddr(),
+		}).Warn("TLS handshake failed")
+		sc.close()
+		sc.server.removeConn(sc)
+		return
+	}
+	// Only this goroutine sets the flag.
+	if !sc.authenticated {
+		if err := sc.authenticate(); err != nil {
+			log.WithFields(log.Fields{
+				"err":    err,
+				"id":     sc.id,
+				"remote": sc.conn.RemoteAddr(),
+			}).Warn("Client rejected")
+			sc.close()
+			sc.server.removeConn(sc)
+			return
+		}
+		log.WithFields(log.Fields{
+			"id":     sc.id,
+			"name":   sc.name,
+			"remote": sc.conn.RemoteAddr(),
+		}).Info("Client authenticated")
+	}
+	if leader, redirect := sc.server.redirection(); redirect {
+		sc.redirect(message.NewRedirectMessage(0, leader))
+		return
+	}
 	for {
 		var input message.Message
 		if err := sc.decoder.Decode(sc.conn, &input); err != nil {
@@ -58,22 +97,61 @@ func (sc *serverConn) handleInput() {
 			log.Warn(err)
 			continue
 		}
-		output := storage.ApplyMessage(sc.server.opts.store, input)
+		if input.Kind() == message.KindHello {
+			sc.hello(input)
+			continue
+		}
+		output := sc.server.apply(sc.id, input)
+		if output.Kind() == message.KindRedirect {
+			sc.redirect(output)
+			return
+		}
 		if err := sc.encoder.Encode(sc.conn, output); err != nil {
 			log.Warn(err)
 		}
-		if input.Kind() == message.KindPut && output.Kind() == message.KindPut {
-			// All these goroutines will serialize on the fan-out mutex. It might be
-			// better to use a buffered channel to write to here instead of piling up
-			// goroutines.
-			go sc.server.broadcast(sc.id, output)
-		}
+		sc.audit(input, output)
 	}
 	// Since we're no longer handling input, deregister this connection from
 	// notification.
 	sc.server.removeConn(sc)
 }
 
+func (sc *serverConn) hello(input message.Message) {
+	output := input
+	switch {
+	case input.Value() == "":
+		output = message.NewErrorMessage(input.Tag(), "empty client name")
+	case sc.name == input.Value():
+		// Already identified, e.g., by the client certificate.
+	case sc.name != "":
+		output = message.NewErrorMessage(input.Tag(), "already identified")
+	default:
+		sc.name = input.Value()
+		log.WithFields(log.Fields{
+			"id":     sc.id,
+			"name":   sc.name,
+			"remote": sc.conn.RemoteAddr(),
+		}).Info("Client identified")
+	}
+	if err := sc.encoder.Encode(sc.conn, output); err != nil {
+		log.Warn(err)
+	}
+}
+
+// Sends the client to the leader of the group, and closes the connection.
+func (sc *serverConn) redirect(m message.Message) {
+	log.WithFields(log.Fields{
+		"id":     sc.id,
+		"remote": sc.conn.RemoteAddr(),
+		"leader": m.Value(),
+	}).Info("Client redirected")
+	if err := sc.encoder.Encode(sc.conn, m); err != nil {
+		log.Warn(err)
+	}
+	sc.close()
+	sc.server.removeConn(sc)
+}
+
 func (sc *serverConn) close() {
 	if err := sc.conn.Close(); err != nil {
 		log.WithFields(log.Fields{
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/storage"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long the leader waits for a put to be committed.
+const applyTimeout = 10 * time.Second
+
+// Peer is one of the servers of a replicated group.
+type Peer struct {
+	// Identifies the server within the group. It must not change.
+	Name string `json:"name"`
+
+	// Where the server talks to the other servers of the group, e.g.,
+	// "host:6670". The host can't be left out.
+	Raft string `json:"raft"`
+
+	// Where clients connect to the server, e.g., "host:6660". The leader's is
+	// sent to clients connecting to the other servers.
+	Address string `json:"address"`
+}
+
+type replication struct {
+	name  string
+	peers []Peer
+	dir   string
+}
+
+// WithReplication makes the server one of the given group of peers, which
+// must include one with the given name, replicating the versioned store with
+// Raft. Only the leader of the group serves clients, redirecting them to it
+// if it's another server; mutations are committed to a log, kept in dir, that
+// all servers apply, in the same order, to their own store, which must not be
+// written to otherwise. The store must implement storage.Lister and
+// storage.Deleter, for snapshots of the log.
+func WithReplication(name string, peers []Peer, dir string) Option {
+	return func(o *options) {
+		o.replication = &replication{
+			name:  name,
+			peers: peers,
+			dir:   dir,
+		}
+	}
+}
+
+func (r *replication) self() (Peer, error) {
+	for _, p := range r.peers {
+		if p.Name == r.name {
+			return p, nil
+		}
+	}
+	return Peer{}, fmt.Errorf("%q: not one of the peers", r.name)
+}
+
+// Joins the group, bootstrapping it on first start.
+func (s *Server) startReplication() error {
+	r := s.opts.replication
+	self, err := r.self()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return err
+	}
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(self.Name)
+	config.LogOutput = log.StandardLogger().Out
+	config.LogLevel = "INFO"
+	if log.IsLevelEnabled(log.DebugLevel) {
+		config.LogLevel = "DEBUG"
+	}
+	leaderc := make(chan bool, 1)
+	config.NotifyCh = leaderc
+	advertise, err := net.ResolveTCPAddr("tcp", self.Raft)
+	if err != nil {
+		return err
+	}
+	transport, err := raft.NewTCPTransport(self.Raft, advertise, 3, 10*time.Second, config.LogOutput)
+	if err != nil {
+		return err
+	}
+	logs, err := raftboltdb.NewBoltStore(filepath.Join(r.dir, "raft.db"))
+	if err != nil {
+		_ = transport.Close()
+		return err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(r.dir, 2, config.LogOutput)
+	if err != nil {
+		_ = transport.Close()
+		_ = logs.Close()
+		return err
+	}
+	s.closeReplication = func() error {
+		err := s.raft.Shutdown().Error()
+		close(leaderc)
+		if e := transport.Close(); err == nil {
+			err = e
+		}
+		if e := logs.Close(); err == nil {
+			err = e
+		}
+		return err
+	}
+	existing, err := raft.HasExistingState(logs, logs, snapshots)
+	if err == nil && !existing {
+		var servers []raft.Server
+		for _, p := range r.peers {
+			servers = append(servers, raft.Server{
+				ID:      raft.ServerID(p.Name),
+				Address: raft.ServerAddress(p.Raft),
+			})
+		}
+		err = raft.BootstrapCluster(config, logs, logs, snapshots, transport, raft.Configuration{Servers: servers})
+	}
+	if err == nil {
+		s.raft, err = raft.NewRaft(config, (*fsm)(s), logs, logs, snapshots, transport)
+	}
+	if err != nil {
+		_ = transport.Close()
+		_ = logs.Close()
+		return err
+	}
+	go s.followLeadership(leaderc)
+	return nil
+}
+
+// Starts serving clients when the server becomes the leader, and redirects
+// them to the new leader when it steps down.
+func (s *Server) followLeadership(leaderc <-chan bool) {
+	for leader := range leaderc {
+		if leader {
+			log.Info("Became the leader")
+			s.catchUp()
+			continue
+		}
+		log.Info("No longer the leader")
+		address, _ := s.redirection()
+		s.mu.Lock()
+		s.caughtUp = false
+		for _, conn := range s.conns {
+			_ = conn.encoder.Encode(conn.conn, message.NewRedirectMessage(0, address))
+			conn.close()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// A new leader may not have applied all the entries committed by the
+// previous one yet, and would serve stale values until it does. The barrier
+// waits for those to be applied, retried until it succeeds, for as long as
+// the server is the leader.
+func (s *Server) catchUp() {
+	for s.raft.State() == raft.Leader {
+		if err := s.raft.Barrier(applyTimeout).Error(); err != nil {
+			log.WithField("err", err).Warn("Could not apply the entries committed by previous leaders")
+			continue
+		}
+		s.mu.Lock()
+		s.caughtUp = true
+		s.mu.Unlock()
+		log.Info("Serving clients")
+		return
+	}
+}
+
+// Tells whether clients should be redirected to another server, and its
+// address, if known. A leader that hasn't caught up yet redirects them
+// without an address, so that they try again later.
+func (s *Server) redirection() (address string, redirect bool) {
+	if s.raft == nil {
+		return "", false
+	}
+	if s.raft.State() == raft.Leader {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return "", !s.caughtUp
+	}
+	_, id := s.raft.LeaderWithID()
+	for _, p := range s.opts.replication.peers {
+		if p.Name == string(id) {
+			return p.Address, true
+		}
+	}
+	return "", true
+}
+
+// Commits the mutation to the log, and returns the outcome of applying it.
+// The origin of the request, a hello message with the name of the server,
+// tagged with the connection, precedes it in the log entry.
+func (s *Server) replicate(conn uint16, input message.Message) message.Message {
+	var buf bytes.Buffer
+	var encoder message.Encoder
+	if err := encoder.Encode(&buf, message.NewHelloMessage(conn, s.opts.replication.name)); err != nil {
+		return message.NewErrorMessage(input.Tag(), err.Error())
+	}
+	if err := encoder.Encode(&buf, input); err != nil {
+		return message.NewErrorMessage(input.Tag(), err.Error())
+	}
+	future := s.raft.Apply(buf.Bytes(), applyTimeout)
+	if err := future.Error(); errors.Is(err, raft.ErrNotLeader) {
+		address, _ := s.redirection()
+		return message.NewRedirectMessage(input.Tag(), address)
+	} else if err != nil {
+		return message.NewErrorMessage(input.Tag(), err.Error())
+	}
+	return future.Response().(message.Message)
+}
+
+// The state machine replicated by Raft: the versioned store.
+type fsm Server
+
+// Apply implements raft.FSM. It applies a committed mutation to the store, and
+// notifies the clients of this server of the accepted puts.
+func (f *fsm) Apply(entry *raft.Log) interface{} {
+	s := (*Server)(f)
+	r := bytes.NewReader(entry.Data)
+	var decoder message.Decoder
+	var origin, input message.Message
+	if err := decoder.Decode(r, &origin); err != nil {
+		return message.NewErrorMessage(0, err.Error())
+	}
+	if err := decoder.Decode(r, &input); err != nil {
+		return message.NewErrorMessage(origin.Tag(), err.Error())
+	}
+	output := storage.ApplyMessage(s.opts.store, input)
+	// No connection has the zero id.
+	var excluded uint16
+	if origin.Value() == s.opts.replication.name {
+		excluded = origin.Tag()
+	}
+	s.notify(excluded, input, output)
+	return output
+}
+
+// Snapshot implements raft.FSM. It copies the whole store to memory, as
+// Apply can't run concurrently with it but can with persisting the snapshot.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	store := f.opts.store
+	var snapshot fsmSnapshot
+	err := storage.ForEachKey(store, func(key []byte) error {
+		version, value, err := store.Get(key)
+		if err != nil {
+			return err
+		}
+		snapshot = append(snapshot, message.NewPutMessage(0, string(key), string(value), version))
+		return nil
+	})
+	return snapshot, err
+}
+
+// Restore implements raft.FSM. It replaces the contents of the store with
+// those of the snapshot.
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	store := f.opts.store
+	var keys [][]byte
+	if err := storage.ForEachKey(store, func(key []byte) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := storage.Delete(store, key); err != nil {
+			return err
+		}
+	}
+	var decoder message.Decoder
+	for {
+		var m message.Message
+		if err := decoder.Decode(rc, &m); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := store.Put(m.Version(), []byte(m.Key()), []byte(m.Value())); err != nil {
+			return err
+		}
+	}
+}
+
+// The contents of the store, as put messages.
+type fsmSnapshot []message.Message
+
+// Persist implements raft.FSMSnapshot.
+func (snapshot fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	var encoder message.Encoder
+	for _, m := range snapshot {
+		if err := encoder.Encode(sink, m); err != nil {
+			_ = sink.Cancel()
+			return err
+		}
+	}
+	return sink.Close()
+}
+
+// Release implements raft.FSMSnapshot.
+func (snapshot fsmSnapshot) Release() {}
@@ -0,0 +1,167 @@
+package server_test
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/dino/message"
+	"github.com/nicolagi/dino/metadata/client"
+	"github.com/nicolagi/dino/metadata/server"
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplication(t *testing.T) {
+	const n = 3
+	peers, stores, servers := listenReplicas(t, n)
+	errcs := make([]chan error, n)
+	for i := range servers {
+		errcs[i] = make(chan error, 1)
+		go func(i int) {
+			errcs[i] <- servers[i].Serve()
+		}(i)
+	}
+	stopped := make([]bool, n)
+	defer func() {
+		for i := range servers {
+			if !stopped[i] {
+				assert.Nil(t, servers[i].Shutdown())
+				assert.Nil(t, <-errcs[i])
+			}
+		}
+	}()
+	newStore := func(address string, opts ...storage.Option) (*storage.RemoteVersionedStore, *client.Client) {
+		c := client.New(client.WithAddress(address), client.WithName("glenda@plan9"))
+		s := storage.NewRemoteVersionedStore(c, append([]storage.Option{storage.WithRequestTimeout(time.Second)}, opts...)...)
+		s.Start()
+		return s, c
+	}
+	key := []byte("color")
+	// Accepts stale puts too, as the put might have been committed even though
+	// the response was lost, e.g., to a failover.
+	put := func(s storage.VersionedStore, version uint64, value string) func() bool {
+		return func() bool {
+			err := s.Put(version, key, []byte(value))
+			return err == nil || err == storage.ErrStalePut
+		}
+	}
+	replicated := func(i int, version uint64, value string) func() bool {
+		return func() bool {
+			v, b, err := stores[i].Get(key)
+			return err == nil && v == version && string(b) == value
+		}
+	}
+
+	// Find the leader, as a client does, to connect the next clients to
+	// followers, which will redirect them.
+	probe, probeClient := newStore(peers[0].Address)
+	require.True(t, eventually(func() bool {
+		_, _, err := probe.Get(key)
+		return err == storage.ErrNotFound
+	}, 10*time.Second))
+	leader := -1
+	for i, p := range peers {
+		if p.Address == probeClient.Address() {
+			leader = i
+		}
+	}
+	require.NotEqual(t, -1, leader)
+	followers := []int{(leader + 1) % n, (leader + 2) % n}
+
+	glenda, glendaClient := newStore(peers[followers[0]].Address)
+	require.True(t, eventually(put(glenda, 1, "red"), 10*time.Second))
+	assert.Equal(t, peers[leader].Address, glendaClient.Address())
+	for i := range stores {
+		assert.True(t, eventually(replicated(i, 1, "red"), 5*time.Second), "replica%d", i)
+	}
+
+	received := make(chan message.Message, 16)
+	watcher, _ := newStore(peers[followers[1]].Address, storage.WithChangeListener(func(m message.Message) {
+		received <- m
+	}))
+	require.True(t, eventually(func() bool {
+		_, _, err := watcher.Get(key)
+		return err == nil
+	}, 10*time.Second))
+	require.Nil(t, glenda.Put(2, key, []byte("green")))
+	select {
+	case m := <-received:
+		assert.Equal(t, "green", m.Value())
+		assert.Equal(t, uint64(2), m.Version())
+	case <-time.After(5 * time.Second):
+		t.Error("put not broadcast from the committed entry")
+	}
+
+	// Glenda's client fails over to the new leader, via the follower it knows.
+	assert.Nil(t, servers[leader].Shutdown())
+	assert.Nil(t, <-errcs[leader])
+	stopped[leader] = true
+	require.True(t, eventually(put(glenda, 3, "blue"), 20*time.Second))
+	assert.NotEqual(t, peers[leader].Address, glendaClient.Address())
+	for _, i := range followers {
+		assert.True(t, eventually(replicated(i, 3, "blue"), 5*time.Second), "replica%d", i)
+	}
+}
+
+// Polls the condition until it's true, or the timeout expires. (The testify
+// version of this can't cope with conditions taking longer than the tick.)
+func eventually(condition func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// Returns an address nothing listens on, likely to stay free for a while.
+// Makes n replicas listen on addresses that were free. If one has been taken
+// meanwhile, e.g., as the local address of a connection made by a test running
+// in parallel, it tries again with other addresses.
+func listenReplicas(t *testing.T, n int) ([]server.Peer, []storage.VersionedStore, []*server.Server) {
+	for attempt := 1; ; attempt++ {
+		peers := make([]server.Peer, n)
+		for i := range peers {
+			peers[i] = server.Peer{
+				Name:    fmt.Sprintf("replica%d", i),
+				Raft:    freeAddress(t),
+				Address: freeAddress(t),
+			}
+		}
+		stores := make([]storage.VersionedStore, n)
+		servers := make([]*server.Server, n)
+		var err error
+		for i, p := range peers {
+			stores[i] = storage.NewVersionedWrapper(storage.NewInMemoryStore())
+			servers[i] = server.New(
+				server.WithAddress(p.Address),
+				server.WithVersionedStore(stores[i]),
+				server.WithReplication(p.Name, peers, t.TempDir()),
+			)
+			if _, err = servers[i].Listen(); err != nil {
+				for _, s := range servers[:i] {
+					_ = s.Shutdown()
+				}
+				break
+			}
+		}
+		if err == nil {
+			return peers, stores, servers
+		}
+		if attempt == 3 {
+			require.Nil(t, err)
+		}
+	}
+}
+
+func freeAddress(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
@@ -1,10 +1,13 @@
 package server
 
 import (
+	"crypto/tls"
 	"errors"
+	"io"
 	"net"
 	"sync"
 
+	"github.com/hashicorp/raft"
 	"github.com/nicolagi/dino/message"
 	"github.com/nicolagi/dino/storage"
 	log "github.com/sirupsen/logrus"
@@ -15,6 +18,11 @@ type Option func(*options)
 type options struct {
 	address string
 	store   storage.VersionedStore
+	audit   io.Writer
+	secrets map[string][]byte
+	tls     *tls.Config
+
+	replication *replication
 }
 
 func WithAddress(value string) Option {
@@ -29,12 +37,37 @@ func WithVersionedStore(value storage.VersionedStore) Option {
 	}
 }
 
+// WithTLS makes the server accept TLS connections only. If the configuration
+// requires client certificates, clients are identified, and authenticated, by
+// the common name of theirs (see tlsconfig.Identity).
+func WithTLS(value *tls.Config) Option {
+	return func(o *options) {
+		o.tls = value
+	}
+}
+
+// WithAuditLog makes the server record each put, accepted or rejected, to
+// the given writer (see AuditRecord).
+func WithAuditLog(value io.Writer) Option {
+	return func(o *options) {
+		o.audit = value
+	}
+}
+
 type Server struct {
 	opts    options
 	ln      net.Listener
 	connIDs *message.MonotoneTags
 	mu      sync.Mutex
 	conns   []*serverConn
+	auditMu sync.Mutex
+
+	// Set if the server is replicated.
+	raft             *raft.Raft
+	closeReplication func() error
+	// Whether the server, as the leader, has applied the entries committed by
+	// previous leaders. Guarded by mu.
+	caughtUp bool
 }
 
 func New(opts ...Option) *Server {
@@ -53,6 +86,15 @@ func (s *Server) Listen() (addr string, err error) {
 	if err != nil {
 		return
 	}
+	if s.opts.tls != nil {
+		s.ln = tls.NewListener(s.ln, s.opts.tls)
+	}
+	if s.opts.replication != nil {
+		if err = s.startReplication(); err != nil {
+			_ = s.ln.Close()
+			return
+		}
+	}
 	addr = s.ln.Addr().String()
 	return
 }
@@ -101,12 +143,55 @@ func (s *Server) removeConn(sc *serverConn) {
 	s.conns = newConns
 }
 
-func (s *Server) broadcast(excluded uint16, m message.Message) {
+// Applies the request, notifying the clients, but the sender, of the accepted
+// puts. Mutations of a replicated store are applied as they're committed, by
+// all servers in the group.
+func (s *Server) apply(conn uint16, input message.Message) message.Message {
+	switch input.Kind() {
+	case message.KindPut, message.KindPutMany, message.KindDelete:
+		if s.raft != nil {
+			return s.replicate(conn, input)
+		}
+		output := storage.ApplyMessage(s.opts.store, input)
+		s.notify(conn, input, output)
+		return output
+	default:
+		return storage.ApplyMessage(s.opts.store, input)
+	}
+}
+
+// Broadcasts the puts accepted in response to the request.
+func (s *Server) notify(excluded uint16, input, output message.Message) {
+	if input.Kind() == message.KindPut && output.Kind() == message.KindPut {
+		// All these goroutines will serialize on the fan-out mutex. It might be
+		// better to use a buffered channel to write to here instead of piling up
+		// goroutines.
+		go s.broadcast(excluded, output)
+	}
+	if input.Kind() == message.KindPutMany && output.Kind() == message.KindPutMany {
+		var accepted []message.Message
+		for _, outcome := range output.Entries() {
+			if outcome.Kind() == message.KindPut {
+				accepted = append(accepted, outcome)
+			}
+		}
+		go s.broadcast(excluded, accepted...)
+	}
+}
+
+func (s *Server) broadcast(excluded uint16, messages ...message.Message) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	for _, m := range messages {
+		s.broadcastLocked(excluded, m)
+	}
+}
+
+// Call with lock held.
+func (s *Server) broadcastLocked(excluded uint16, m message.Message) {
 	broadcastMessage := m.ForBroadcast()
 	for _, conn := range s.conns {
-		if excluded == conn.id {
+		if excluded == conn.id || !conn.authenticated {
 			continue
 		}
 		logger := log.WithFields(log.Fields{
@@ -138,6 +223,11 @@ func (s *Server) Shutdown() error {
 	// Stop accepting
 	err := s.ln.Close()
 	s.connIDs.Stop()
+	if s.closeReplication != nil {
+		if e := s.closeReplication(); err == nil {
+			err = e
+		}
+	}
 	// Stop accepted
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -2,6 +2,10 @@ package server_test
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -9,6 +13,8 @@ import (
 	"github.com/nicolagi/dino/metadata/client"
 	"github.com/nicolagi/dino/metadata/server"
 	"github.com/nicolagi/dino/storage"
+	"github.com/nicolagi/dino/tlsconfig"
+	"github.com/nicolagi/dino/tlsconfig/tlsconfigtest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -126,15 +132,220 @@ func TestServer(t *testing.T) {
 		verify(vs2)
 		verify(vs3)
 	})
+	t.Run("put many reports each outcome and fans out accepted puts", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+
+		vs1, _ := newRemoteVersionedStore(address)
+		vs2, ready2 := newRemoteVersionedStore(address)
+		require.Nil(t, vs1.Put(1, []byte("color"), []byte("red")))
+		<-ready2
+
+		errs, err := vs1.PutMany([]storage.VersionedPut{
+			{Version: 1, Key: []byte("shape"), Value: []byte("circle")},
+			{Version: 1, Key: []byte("color"), Value: []byte("blue")},
+			{Version: 2, Key: []byte("color"), Value: []byte("green")},
+		})
+		require.Nil(t, err)
+		require.Len(t, errs, 3)
+		assert.Nil(t, errs[0])
+		assert.Equal(t, storage.ErrStalePut, errs[1])
+		assert.Nil(t, errs[2])
+
+		assert.Equal(t, "shape", (<-ready2).Key())
+		assert.Equal(t, "color", (<-ready2).Key())
+		version, value, err := vs2.Get([]byte("color"))
+		require.Nil(t, err)
+		assert.EqualValues(t, 2, version)
+		assert.EqualValues(t, "green", value)
+	})
+	t.Run("get many reports each outcome", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		defer cleanup()
+
+		vs1, _ := newRemoteVersionedStore(address)
+		require.Nil(t, vs1.Put(3, []byte("color"), []byte("red")))
+		vs2, _ := newRemoteVersionedStore(address)
+		values, err := vs2.GetMany([][]byte{[]byte("shape"), []byte("color")})
+		require.Nil(t, err)
+		require.Len(t, values, 2)
+		assert.Equal(t, storage.ErrNotFound, values[0].Err)
+		assert.Equal(t, storage.VersionedValue{Version: 3, Value: []byte("red")}, values[1])
+	})
+	t.Run("puts are audited with the client name", func(t *testing.T) {
+		var log lockedBuffer
+		address, cleanup := newDisposableServer(t, server.WithAuditLog(&log))
+		named := storage.NewRemoteVersionedStore(
+			client.New(client.WithAddress(address), client.WithName("glenda@plan9")),
+			storage.WithRequestTimeout(5*time.Second),
+		)
+		named.Start()
+		anonymous, _ := newRemoteVersionedStore(address)
+		require.Nil(t, named.Put(1, []byte("color"), []byte("red")))
+		assert.Equal(t, storage.ErrStalePut, anonymous.Put(1, []byte("color"), []byte("blue")))
+		_, err := named.PutMany([]storage.VersionedPut{
+			{Version: 2, Key: []byte("color"), Value: []byte("green")},
+		})
+		require.Nil(t, err)
+		cleanup()
+
+		var records []server.AuditRecord
+		decoder := json.NewDecoder(&log)
+		for decoder.More() {
+			var r server.AuditRecord
+			require.Nil(t, decoder.Decode(&r))
+			assert.False(t, r.Time.IsZero())
+			assert.NotEmpty(t, r.Remote)
+			r.Time, r.Remote, r.Conn = time.Time{}, "", 0
+			records = append(records, r)
+		}
+		assert.Equal(t, []server.AuditRecord{
+			{Client: "glenda@plan9", Key: "636f6c6f72", Version: 1, Size: 3, Accepted: true},
+			{Key: "636f6c6f72", Version: 1, Size: 4, Err: storage.ErrStalePut.Error()},
+			{Client: "glenda@plan9", Key: "636f6c6f72", Version: 2, Size: 5, Accepted: true},
+		}, records)
+	})
+	t.Run("clients must authenticate if secrets are set", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t, server.WithSecrets(map[string][]byte{
+			"glenda@plan9": []byte("s3cret"),
+		}))
+		defer cleanup()
+		newClient := func(opts ...client.Option) *client.Client {
+			return client.New(append([]client.Option{client.WithAddress(address)}, opts...)...)
+		}
+
+		anonymous := newClient()
+		require.Nil(t, anonymous.Send(message.NewPutMessage(1, "color", "red", 1)))
+		var response message.Message
+		require.Nil(t, anonymous.Receive(&response))
+		assert.Equal(t, message.NewErrorMessage(1, "authentication required"), response)
+		assert.NotNil(t, anonymous.Receive(&response), "connection should be closed")
+
+		impostor := newClient(client.WithName("glenda@plan9"), client.WithSecret([]byte("guess")))
+		err := impostor.Send(message.NewPutMessage(1, "color", "blue", 1))
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "authentication failed")
+		}
+		forgetful := newClient(client.WithName("glenda@plan9"))
+		err = forgetful.Send(message.NewPutMessage(1, "color", "blue", 1))
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "requires a secret")
+		}
+		unknown := newClient(client.WithName("rsc@plan9"), client.WithSecret([]byte("s3cret")))
+		assert.NotNil(t, unknown.Send(message.NewPutMessage(1, "color", "blue", 1)))
+
+		glenda := storage.NewRemoteVersionedStore(
+			newClient(client.WithName("glenda@plan9"), client.WithSecret([]byte("s3cret"))),
+			storage.WithRequestTimeout(5*time.Second),
+		)
+		glenda.Start()
+		_, _, err = glenda.Get([]byte("color"))
+		assert.Equal(t, storage.ErrNotFound, err)
+		assert.Nil(t, glenda.Put(1, []byte("color"), []byte("green")))
+	})
+	t.Run("clients fail over to the next address", func(t *testing.T) {
+		second, cleanupSecond := newDisposableServer(t)
+		first := freeAddress(t)
+		vs := storage.NewRemoteVersionedStore(
+			client.New(client.WithAddresses(first, second)),
+			storage.WithRequestTimeout(time.Second),
+		)
+		vs.Start()
+		require.Nil(t, vs.Put(1, []byte("color"), []byte("red")))
+		assert.Equal(t, second, vs.Status().Address)
+
+		_, cleanupFirst := newDisposableServer(t, server.WithAddress(first))
+		defer cleanupFirst()
+		cleanupSecond()
+		assert.True(t, eventually(func() bool {
+			return vs.Put(1, []byte("shape"), []byte("round")) == nil
+		}, 5*time.Second))
+		assert.Equal(t, first, vs.Status().Address)
+	})
+	t.Run("clients don't back off from their only server", func(t *testing.T) {
+		address, cleanup := newDisposableServer(t)
+		vs := storage.NewRemoteVersionedStore(
+			client.New(client.WithAddress(address)),
+			storage.WithRequestTimeout(time.Second),
+		)
+		vs.Start()
+		require.Nil(t, vs.Put(1, []byte("color"), []byte("red")))
+		cleanup()
+		// The client keeps trying to connect, rather than reporting that no
+		// server is available.
+		for i := 0; i < 3; i++ {
+			err := vs.Put(1, []byte("shape"), []byte("round"))
+			assert.NotNil(t, err)
+			assert.False(t, errors.Is(err, client.ErrUnavailable), "%v", err)
+		}
+
+		// A put that timed out may have been applied nonetheless.
+		_, cleanup = newDisposableServer(t, server.WithAddress(address))
+		defer cleanup()
+		assert.True(t, eventually(func() bool {
+			err := vs.Put(1, []byte("shape"), []byte("round"))
+			return err == nil || err == storage.ErrStalePut
+		}, 5*time.Second))
+	})
+	t.Run("clients are identified by their certificates over TLS", func(t *testing.T) {
+		dir := t.TempDir()
+		require.Nil(t, tlsconfigtest.WriteFiles(dir))
+		serverConfig, err := tlsconfig.Server(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.pem"))
+		require.Nil(t, err)
+		var log lockedBuffer
+		address, cleanup := newDisposableServer(t, server.WithTLS(serverConfig), server.WithAuditLog(&log))
+		newClient := func(certFile, keyFile string) *client.Client {
+			clientConfig, err := tlsconfig.Client(filepath.Join(dir, "ca.pem"), certFile, keyFile)
+			require.Nil(t, err)
+			return client.New(client.WithAddress(address), client.WithTLS(clientConfig))
+		}
+
+		// With TLS 1.3, the client only learns it was rejected on reading.
+		anonymous := newClient("", "")
+		_ = anonymous.Send(message.NewPutMessage(1, "color", "red", 1))
+		var response message.Message
+		assert.NotNil(t, anonymous.Receive(&response))
+
+		glenda := storage.NewRemoteVersionedStore(
+			newClient(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")),
+			storage.WithRequestTimeout(5*time.Second),
+		)
+		glenda.Start()
+		require.Nil(t, glenda.Put(1, []byte("color"), []byte("green")))
+		cleanup()
+
+		var r server.AuditRecord
+		require.Nil(t, json.NewDecoder(&log).Decode(&r))
+		assert.Equal(t, "glenda@plan9", r.Client)
+		assert.True(t, r.Accepted)
+	})
 }
 
-func newDisposableServer(t *testing.T) (address string, cleanup func()) {
+// Safe for the server to write to while the test reads.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Read(p)
+}
+
+func newDisposableServer(t *testing.T, opts ...server.Option) (address string, cleanup func()) {
 	store := storage.NewInMemoryStore()
 	versionedStore := storage.NewVersionedWrapper(store)
-	metadataServer := server.New(
+	metadataServer := server.New(append([]server.Option{
 		server.WithAddress("localhost:0"),
 		server.WithVersionedStore(versionedStore),
-	)
+	}, opts...)...)
 	address, err := metadataServer.Listen()
 	require.Nil(t, err)
 	errc := make(chan error, 1)
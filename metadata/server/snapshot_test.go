@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A raft.SnapshotSink that keeps the snapshot in memory.
+type bufferSink struct {
+	bytes.Buffer
+	closed, canceled bool
+}
+
+func (s *bufferSink) ID() string    { return "test" }
+func (s *bufferSink) Close() error  { s.closed = true; return nil }
+func (s *bufferSink) Cancel() error { s.canceled = true; return nil }
+
+var _ raft.SnapshotSink = (*bufferSink)(nil)
+
+// Returns the contents of the store, by key, as versions and values.
+func dump(t *testing.T, store storage.VersionedStore) map[string]storeEntry {
+	t.Helper()
+	entries := make(map[string]storeEntry)
+	require.Nil(t, storage.ForEachKey(store, func(key []byte) error {
+		version, value, err := store.Get(key)
+		entries[string(key)] = storeEntry{version: version, value: string(value)}
+		return err
+	}))
+	return entries
+}
+
+type storeEntry struct {
+	version uint64
+	value   string
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	source := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	require.Nil(t, source.Put(1, []byte("a"), []byte("first")))
+	require.Nil(t, source.Put(1, []byte("b"), []byte("stale")))
+	require.Nil(t, source.Put(2, []byte("b"), []byte("second")))
+	require.Nil(t, source.Put(1, []byte("c"), nil))
+	require.Nil(t, source.Put(1, []byte("binary\x00key"), []byte("\xff\x00\x01")))
+
+	snapshot, err := (*fsm)(New(WithVersionedStore(source))).Snapshot()
+	require.Nil(t, err)
+	var sink bufferSink
+	require.Nil(t, snapshot.Persist(&sink))
+	snapshot.Release()
+	assert.True(t, sink.closed)
+	assert.False(t, sink.canceled)
+
+	// The target has keys of its own, at other versions, which the restore
+	// replaces or deletes.
+	target := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	require.Nil(t, target.Put(5, []byte("a"), []byte("newer")))
+	require.Nil(t, target.Put(1, []byte("d"), []byte("not in the snapshot")))
+	require.Nil(t, (*fsm)(New(WithVersionedStore(target))).Restore(ioutil.NopCloser(&sink)))
+
+	want := map[string]storeEntry{
+		"a":             {version: 1, value: "first"},
+		"b":             {version: 2, value: "second"},
+		"c":             {version: 1, value: ""},
+		"binary\x00key": {version: 1, value: "\xff\x00\x01"},
+	}
+	assert.Equal(t, want, dump(t, source))
+	assert.Equal(t, want, dump(t, target))
+}
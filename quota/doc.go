@@ -0,0 +1,5 @@
+// Package quota keeps track of byte and inode usage, per user and per volume,
+// and of the corresponding limits. Both usage and limits are stored as
+// counters in a storage.VersionedStore, the same one holding the file system
+// metadata, so that all clients sharing a volume share the same counters.
+package quota // import "github.com/nicolagi/dino/quota"
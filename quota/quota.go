@@ -0,0 +1,232 @@
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nicolagi/dino/bits"
+	"github.com/nicolagi/dino/storage"
+)
+
+var (
+	// ErrExceeded is returned by Tracker.Check if charging a subject would
+	// exceed its limits.
+	ErrExceeded = errors.New("quota exceeded")
+
+	// ErrBadCounters indicates a stored value could not be decoded as counters.
+	ErrBadCounters = errors.New("malformed quota counters")
+)
+
+const (
+	usagePrefix = "quota/usage/"
+	limitPrefix = "quota/limit/"
+
+	// How many times to retry an update that failed because some other client
+	// updated the same counters concurrently.
+	maxUpdateAttempts = 10
+)
+
+// Subject identifies what usage is charged to, either a user or the whole
+// volume.
+type Subject string
+
+// Volume is the subject that all usage is charged to.
+const Volume Subject = "volume"
+
+// User returns the subject representing the user with the given uid.
+func User(uid uint32) Subject {
+	return Subject(fmt.Sprintf("uid/%d", uid))
+}
+
+// Counters hold either usage or limits. For limits, zero means unlimited.
+type Counters struct {
+	Bytes  int64
+	Inodes int64
+}
+
+// String implements fmt.Stringer.
+func (c Counters) String() string {
+	return fmt.Sprintf("bytes=%d inodes=%d", c.Bytes, c.Inodes)
+}
+
+func (c Counters) encode() []byte {
+	b := make([]byte, 16)
+	bits.Put64(bits.Put64(b, uint64(c.Bytes)), uint64(c.Inodes))
+	return b
+}
+
+func decodeCounters(b []byte) (c Counters, err error) {
+	if len(b) != 16 {
+		return c, fmt.Errorf("%d bytes: %w", len(b), ErrBadCounters)
+	}
+	var v uint64
+	v, b = bits.Get64(b)
+	c.Bytes = int64(v)
+	v, _ = bits.Get64(b)
+	c.Inodes = int64(v)
+	return c, nil
+}
+
+// IsKey tells whether the given key is one of those used to store quota
+// counters, as opposed to, e.g., file system metadata.
+func IsKey(key []byte) bool {
+	s := string(key)
+	return strings.HasPrefix(s, usagePrefix) || strings.HasPrefix(s, limitPrefix)
+}
+
+type entry struct {
+	version  uint64
+	counters Counters
+}
+
+// Tracker reads and updates usage and limits counters. It caches counters, so
+// that checking quotas does not require network round trips. The cache for a
+// key must be invalidated (see Invalidate) when learning that some other
+// client updated that key.
+type Tracker struct {
+	store storage.VersionedStore
+
+	mu    sync.Mutex
+	cache map[string]entry
+}
+
+func NewTracker(store storage.VersionedStore) *Tracker {
+	return &Tracker{
+		store: store,
+		cache: make(map[string]entry),
+	}
+}
+
+// Invalidate drops the cached counters for the given key, if any.
+func (t *Tracker) Invalidate(key []byte) {
+	t.mu.Lock()
+	delete(t.cache, string(key))
+	t.mu.Unlock()
+}
+
+// Usage returns what has been charged to the given subject.
+func (t *Tracker) Usage(s Subject) (Counters, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, err := t.get(usagePrefix + string(s))
+	return e.counters, err
+}
+
+// Limits returns the limits for the given subject.
+func (t *Tracker) Limits(s Subject) (Counters, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, err := t.get(limitPrefix + string(s))
+	return e.counters, err
+}
+
+// SetLimits sets the limits for the given subject. Zero means unlimited.
+func (t *Tracker) SetLimits(s Subject, limits Counters) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.update(limitPrefix+string(s), func(Counters) Counters {
+		return limits
+	})
+}
+
+// Charge adds the given amounts, which can be negative, to the usage of the
+// given subject. Charging never fails because of limits being exceeded. Use
+// Check to enforce limits.
+func (t *Tracker) Charge(s Subject, bytes, inodes int64) error {
+	if bytes == 0 && inodes == 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.update(usagePrefix+string(s), func(usage Counters) Counters {
+		usage.Bytes += bytes
+		usage.Inodes += inodes
+		return usage
+	})
+}
+
+// Check returns ErrExceeded if charging the given amounts to the given subject
+// would exceed its limits.
+func (t *Tracker) Check(s Subject, bytes, inodes int64) error {
+	if bytes <= 0 && inodes <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	limits, err := t.get(limitPrefix + string(s))
+	if err != nil {
+		return err
+	}
+	if limits.counters.Bytes == 0 && limits.counters.Inodes == 0 {
+		return nil
+	}
+	usage, err := t.get(usagePrefix + string(s))
+	if err != nil {
+		return err
+	}
+	if exceeds(usage.counters.Bytes, bytes, limits.counters.Bytes) {
+		return fmt.Errorf("%s: %d more bytes: %w", s, bytes, ErrExceeded)
+	}
+	if exceeds(usage.counters.Inodes, inodes, limits.counters.Inodes) {
+		return fmt.Errorf("%s: %d more inodes: %w", s, inodes, ErrExceeded)
+	}
+	return nil
+}
+
+func exceeds(used, more, limit int64) bool {
+	return limit > 0 && more > 0 && used+more > limit
+}
+
+// Call with lock held.
+func (t *Tracker) get(key string) (entry, error) {
+	if e, ok := t.cache[key]; ok {
+		return e, nil
+	}
+	version, value, err := t.store.Get([]byte(key))
+	if errors.Is(err, storage.ErrNotFound) {
+		// Absent counters are all zero.
+		t.cache[key] = entry{}
+		return entry{}, nil
+	}
+	if err != nil {
+		return entry{}, err
+	}
+	counters, err := decodeCounters(value)
+	if err != nil {
+		return entry{}, fmt.Errorf("%q: %w", key, err)
+	}
+	e := entry{version: version, counters: counters}
+	t.cache[key] = e
+	return e, nil
+}
+
+// Call with lock held. It's released while waiting to retry.
+func (t *Tracker) update(key string, f func(Counters) Counters) error {
+	for attempt := 1; ; attempt++ {
+		e, err := t.get(key)
+		if err != nil {
+			return err
+		}
+		next := entry{
+			version:  e.version + 1,
+			counters: f(e.counters),
+		}
+		err = t.store.Put(next.version, []byte(key), next.counters.encode())
+		if err == nil {
+			t.cache[key] = next
+			return nil
+		}
+		delete(t.cache, key)
+		if !errors.Is(err, storage.ErrStalePut) || attempt == maxUpdateAttempts {
+			return err
+		}
+		// Some other client updated the counters. Give its update some time to be
+		// broadcast to us, and try again.
+		t.mu.Unlock()
+		time.Sleep(time.Duration(attempt) * 10 * time.Millisecond)
+		t.mu.Lock()
+	}
+}
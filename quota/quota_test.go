@@ -0,0 +1,67 @@
+package quota_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nicolagi/dino/quota"
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracker(t *testing.T) {
+	newStore := func() storage.VersionedStore {
+		return storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	}
+	t.Run("absent counters are zero", func(t *testing.T) {
+		tracker := quota.NewTracker(newStore())
+		usage, err := tracker.Usage(quota.Volume)
+		require.Nil(t, err)
+		assert.Equal(t, quota.Counters{}, usage)
+		limits, err := tracker.Limits(quota.User(1000))
+		require.Nil(t, err)
+		assert.Equal(t, quota.Counters{}, limits)
+	})
+	t.Run("charges add up", func(t *testing.T) {
+		tracker := quota.NewTracker(newStore())
+		require.Nil(t, tracker.Charge(quota.User(1000), 100, 1))
+		require.Nil(t, tracker.Charge(quota.User(1000), -40, 1))
+		require.Nil(t, tracker.Charge(quota.User(1001), 7, 1))
+		usage, err := tracker.Usage(quota.User(1000))
+		require.Nil(t, err)
+		assert.Equal(t, quota.Counters{Bytes: 60, Inodes: 2}, usage)
+	})
+	t.Run("zero limits mean unlimited", func(t *testing.T) {
+		tracker := quota.NewTracker(newStore())
+		require.Nil(t, tracker.Charge(quota.Volume, 1<<40, 1<<20))
+		assert.Nil(t, tracker.Check(quota.Volume, 1<<40, 1<<20))
+	})
+	t.Run("check enforces limits", func(t *testing.T) {
+		tracker := quota.NewTracker(newStore())
+		require.Nil(t, tracker.SetLimits(quota.User(42), quota.Counters{Bytes: 100, Inodes: 2}))
+		require.Nil(t, tracker.Charge(quota.User(42), 90, 1))
+		assert.Nil(t, tracker.Check(quota.User(42), 10, 1))
+		assert.True(t, errors.Is(tracker.Check(quota.User(42), 11, 0), quota.ErrExceeded))
+		assert.True(t, errors.Is(tracker.Check(quota.User(42), 0, 2), quota.ErrExceeded))
+		// Shrinking is always allowed.
+		assert.Nil(t, tracker.Check(quota.User(42), -1000, -1))
+	})
+	t.Run("concurrent trackers do not lose updates", func(t *testing.T) {
+		store := newStore()
+		t1 := quota.NewTracker(store)
+		t2 := quota.NewTracker(store)
+		require.Nil(t, t1.Charge(quota.Volume, 1, 1))
+		require.Nil(t, t2.Charge(quota.Volume, 2, 1))
+		// The cache of t1 is stale, the put will be rejected and retried.
+		require.Nil(t, t1.Charge(quota.Volume, 4, 1))
+		usage, err := quota.NewTracker(store).Usage(quota.Volume)
+		require.Nil(t, err)
+		assert.Equal(t, quota.Counters{Bytes: 7, Inodes: 3}, usage)
+	})
+	t.Run("recognizes its own keys", func(t *testing.T) {
+		assert.True(t, quota.IsKey([]byte("quota/usage/volume")))
+		assert.True(t, quota.IsKey([]byte("quota/limit/uid/0")))
+		assert.False(t, quota.IsKey([]byte("quota")))
+	})
+}
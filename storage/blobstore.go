@@ -33,3 +33,7 @@ func (s *BlobStoreWrapper) Put(value []byte) (key []byte, err error) {
 func (s *BlobStoreWrapper) Get(key []byte) (value []byte, err error) {
 	return s.delegate.Get(key)
 }
+
+func (s *BlobStoreWrapper) Undecorated() interface{} {
+	return s.delegate
+}
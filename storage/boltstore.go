@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
 
 	"github.com/boltdb/bolt"
@@ -43,3 +44,29 @@ func (s *BoltStore) Get(key []byte) (value []byte, err error) {
 	})
 	return value, err
 }
+
+// List implements Lister.
+func (s *BoltStore) List(after []byte) (keys [][]byte, err error) {
+	err = (*bolt.DB)(s).View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketName).Cursor()
+		k, _ := c.Seek(after)
+		if k != nil && bytes.Equal(k, after) {
+			k, _ = c.Next()
+		}
+		for ; k != nil && len(keys) < listPageSize; k, _ = c.Next() {
+			keys = append(keys, dup(k))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// Delete implements Deleter.
+func (s *BoltStore) Delete(key []byte) error {
+	return (*bolt.DB)(s).Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketName).Delete(key); err != nil {
+			return fmt.Errorf("could not delete %.40q: %w", key, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/bits"
+
+	dinobits "github.com/nicolagi/dino/bits"
+)
+
+// Chunk indexes start with this magic, followed by a format byte. Values
+// without the magic were put whole, e.g., before chunking was enabled.
+const chunkIndexMagic = "\x00dc"
+
+const chunkIndexFormat byte = 1
+
+var errBadChunkIndex = errors.New("malformed chunk index")
+
+// ChunkSizes are the minimum, average and maximum sizes of the chunks values
+// are split into. The average must be a power of two. The zero value never
+// splits values, but still allows reading values that were split.
+type ChunkSizes struct {
+	Min int
+	Avg int
+	Max int
+}
+
+// DefaultChunkSizes trades off deduplication granularity for the number of
+// blobs to store and fetch.
+var DefaultChunkSizes = ChunkSizes{
+	Min: 16 << 10,
+	Avg: 64 << 10,
+	Max: 256 << 10,
+}
+
+// The gear table for the rolling hash. It must be the same for all clients
+// sharing a volume, so it's generated from a fixed seed (with splitmix64),
+// rather than being random.
+var gear = func() (table [256]uint64) {
+	seed := uint64(0x64696e6f)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// Chunk splits the value into chunks at content-defined boundaries, found
+// with a gear rolling hash, so that a local edit only changes the chunks
+// around it.
+func (cs ChunkSizes) Chunk(value []byte) (chunks [][]byte) {
+	if cs == (ChunkSizes{}) {
+		if len(value) == 0 {
+			return nil
+		}
+		return [][]byte{value}
+	}
+	// A boundary is where the top bits of the hash are all zero, which happens
+	// every Avg bytes on average.
+	shift := uint(64 - bits.TrailingZeros(uint(cs.Avg)))
+	for len(value) > 0 {
+		n := len(value)
+		if n > cs.Min {
+			if n > cs.Max {
+				n = cs.Max
+			}
+			var h uint64
+			for i := cs.Min; i < n; i++ {
+				h = (h << 1) + gear[value[i]]
+				if h>>shift == 0 {
+					n = i + 1
+					break
+				}
+			}
+		}
+		chunks = append(chunks, value[:n])
+		value = value[n:]
+	}
+	return chunks
+}
+
+// ChunkedBlobStore implements BlobStore wrapping another one, so that values
+// are split into chunks, stored separately, with an index listing them.
+// Chunks shared by different values, e.g., different versions of a big file
+// with small edits, are stored only once. The key of a value is the key of its
+// index, or of the value itself if it fits in one chunk.
+type ChunkedBlobStore struct {
+	delegate BlobStore
+	sizes    ChunkSizes
+}
+
+func NewChunkedBlobStore(delegate BlobStore, sizes ChunkSizes) (*ChunkedBlobStore, error) {
+	if sizes != (ChunkSizes{}) {
+		if sizes.Min <= 0 || sizes.Min > sizes.Avg || sizes.Avg > sizes.Max {
+			return nil, fmt.Errorf("chunk sizes %+v: want 0 < min <= avg <= max", sizes)
+		}
+		if sizes.Avg&(sizes.Avg-1) != 0 {
+			return nil, fmt.Errorf("chunk sizes %+v: average not a power of two", sizes)
+		}
+	}
+	return &ChunkedBlobStore{
+		delegate: delegate,
+		sizes:    sizes,
+	}, nil
+}
+
+func (s *ChunkedBlobStore) Put(value []byte) (key []byte, err error) {
+	chunks := s.sizes.Chunk(value)
+	// A value starting with the magic is indexed even if it fits in one chunk,
+	// so that it's not mistaken for an index.
+	if len(chunks) <= 1 && !bytes.HasPrefix(value, []byte(chunkIndexMagic)) {
+		return s.delegate.Put(value)
+	}
+	index := make([]byte, 0, len(chunkIndexMagic)+1+len(chunks)*26)
+	index = append(index, chunkIndexMagic...)
+	index = append(index, chunkIndexFormat)
+	for _, chunk := range chunks {
+		key, err := s.delegate.Put(chunk)
+		if err != nil {
+			return nil, err
+		}
+		entry := make([]byte, 6+len(key))
+		dinobits.Putb(dinobits.Put32(entry, uint32(len(chunk))), key)
+		index = append(index, entry...)
+	}
+	return s.delegate.Put(index)
+}
+
+func (s *ChunkedBlobStore) Get(key []byte) (value []byte, err error) {
+	b, err := s.delegate.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, []byte(chunkIndexMagic)) {
+		return b, nil
+	}
+	keys, size, err := parseChunkIndex(b)
+	if err != nil {
+		return nil, fmt.Errorf("key %.10x: %w", key, err)
+	}
+	value = make([]byte, 0, size)
+	for _, chunkKey := range keys {
+		chunk, err := s.delegate.Get(chunkKey)
+		if err != nil {
+			return nil, fmt.Errorf("chunk %.10x of %.10x: %w", chunkKey, key, err)
+		}
+		value = append(value, chunk...)
+	}
+	if len(value) != size {
+		return nil, fmt.Errorf("key %.10x: got %d bytes, want %d", key, len(value), size)
+	}
+	return value, nil
+}
+
+func (s *ChunkedBlobStore) Undecorated() interface{} {
+	return s.delegate
+}
+
+// ChunkKeys returns the keys of the chunks of the value stored under the given
+// key, or nil if the value is stored whole.
+func (s *ChunkedBlobStore) ChunkKeys(key []byte) ([][]byte, error) {
+	b, err := s.delegate.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(b, []byte(chunkIndexMagic)) {
+		return nil, nil
+	}
+	keys, _, err := parseChunkIndex(b)
+	return keys, err
+}
+
+func parseChunkIndex(b []byte) (keys [][]byte, size int, err error) {
+	b = b[len(chunkIndexMagic):]
+	if len(b) == 0 || b[0] != chunkIndexFormat {
+		return nil, 0, errBadChunkIndex
+	}
+	b = b[1:]
+	for len(b) > 0 {
+		if len(b) < 6 {
+			return nil, 0, errBadChunkIndex
+		}
+		var n uint32
+		var keylen uint16
+		n, b = dinobits.Get32(b)
+		keylen, b = dinobits.Get16(b)
+		if len(b) < int(keylen) {
+			return nil, 0, errBadChunkIndex
+		}
+		keys = append(keys, b[:keylen])
+		b = b[keylen:]
+		size += int(n)
+	}
+	return keys, size, nil
+}
@@ -0,0 +1,112 @@
+package storage_test
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Counts the blobs in the wrapped store.
+type countingBlobStore struct {
+	storage.BlobStore
+	keys map[string]bool
+}
+
+func (s *countingBlobStore) Put(value []byte) ([]byte, error) {
+	key, err := s.BlobStore.Put(value)
+	if err == nil {
+		s.keys[string(key)] = true
+	}
+	return key, err
+}
+
+func TestChunkedBlobStore(t *testing.T) {
+	inner := &countingBlobStore{
+		BlobStore: storage.NewBlobStore(storage.NewInMemoryStore()),
+		keys:      make(map[string]bool),
+	}
+	sizes := storage.ChunkSizes{Min: 256, Avg: 1024, Max: 4096}
+	store, err := storage.NewChunkedBlobStore(inner, sizes)
+	require.Nil(t, err)
+	random := rand.New(rand.NewSource(42))
+	big := make([]byte, 256<<10)
+	random.Read(big)
+
+	t.Run("chunk sizes are within bounds", func(t *testing.T) {
+		chunks := sizes.Chunk(big)
+		assert.Equal(t, big, bytes.Join(chunks, nil))
+		for _, chunk := range chunks[:len(chunks)-1] {
+			assert.True(t, len(chunk) >= sizes.Min && len(chunk) <= sizes.Max, "chunk size %d", len(chunk))
+		}
+		// Should be about 256 chunks.
+		assert.True(t, len(chunks) > 128 && len(chunks) < 512, "%d chunks", len(chunks))
+	})
+	t.Run("small values are stored whole", func(t *testing.T) {
+		key, err := store.Put([]byte("small"))
+		require.Nil(t, err)
+		whole, err := inner.Get(key)
+		require.Nil(t, err)
+		assert.Equal(t, []byte("small"), whole)
+		keys, err := store.ChunkKeys(key)
+		require.Nil(t, err)
+		assert.Nil(t, keys)
+	})
+	t.Run("values starting with the index magic are not mistaken for indexes", func(t *testing.T) {
+		value := []byte("\x00dc\x01\x05\x00\x00\x00")
+		key, err := store.Put(value)
+		require.Nil(t, err)
+		got, err := store.Get(key)
+		require.Nil(t, err)
+		assert.Equal(t, value, got)
+	})
+	t.Run("what you put is what you get", func(t *testing.T) {
+		key, err := store.Put(big)
+		require.Nil(t, err)
+		got, err := store.Get(key)
+		require.Nil(t, err)
+		assert.Equal(t, big, got)
+	})
+	t.Run("a small edit shares most chunks", func(t *testing.T) {
+		before := len(inner.keys)
+		edited := make([]byte, 0, len(big)+3)
+		edited = append(edited, big[:100000]...)
+		edited = append(edited, "foo"...)
+		edited = append(edited, big[100000:]...)
+		key, err := store.Put(edited)
+		require.Nil(t, err)
+		got, err := store.Get(key)
+		require.Nil(t, err)
+		assert.Equal(t, edited, got)
+		// The index, and one or two chunks around the edit.
+		added := len(inner.keys) - before
+		assert.True(t, added <= 3, "%d blobs added", added)
+	})
+	t.Run("zero sizes never split but read chunked values", func(t *testing.T) {
+		whole, err := storage.NewChunkedBlobStore(inner, storage.ChunkSizes{})
+		require.Nil(t, err)
+		value := make([]byte, 20000)
+		random.Read(value)
+		before := len(inner.keys)
+		key, err := whole.Put(value)
+		require.Nil(t, err)
+		assert.Equal(t, 1, len(inner.keys)-before)
+		got, err := store.Get(key)
+		require.Nil(t, err)
+		assert.Equal(t, value, got)
+		key, err = store.Put(value)
+		require.Nil(t, err)
+		got, err = whole.Get(key)
+		require.Nil(t, err)
+		assert.Equal(t, value, got)
+	})
+	t.Run("bad chunk sizes", func(t *testing.T) {
+		_, err := storage.NewChunkedBlobStore(inner, storage.ChunkSizes{Min: 256, Avg: 1000, Max: 4096})
+		assert.NotNil(t, err)
+		_, err = storage.NewChunkedBlobStore(inner, storage.ChunkSizes{Min: 2048, Avg: 1024, Max: 4096})
+		assert.NotNil(t, err)
+	})
+}
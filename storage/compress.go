@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+)
+
+// Compressed values start with this magic, followed by a format byte. Values
+// without the magic are stored as they are, and were either put before
+// compression was enabled or did not compress well.
+//
+// A value put before compression was enabled may start with the magic too. It
+// is returned as it is if what follows doesn't decode, which both formats
+// check: gzip with its own checksum, and the stored format with a CRC-32 of the
+// value. So such a value is only misread if its bytes happen to be a valid
+// encoding, which for the stored format is a one in 2^32 chance.
+const compressedMagic = "\x00dz"
+
+// The formats following the magic.
+const (
+	// Stored as is, because the value itself starts with the magic. The
+	// format byte is followed by the CRC-32 (IEEE, big endian) of the value,
+	// then the value.
+	formatStored byte = iota
+	formatGzip
+)
+
+// CompressedStore implements Store wrapping another store, so that values are
+// compressed before being put in the latter, and decompressed after being got
+// from it. Values that don't compress well are stored as they are.
+type CompressedStore struct {
+	delegate Store
+}
+
+func NewCompressedStore(delegate Store) *CompressedStore {
+	return &CompressedStore{
+		delegate: delegate,
+	}
+}
+
+func (s *CompressedStore) Put(key, value []byte) error {
+	return s.delegate.Put(key, compress(value))
+}
+
+func (s *CompressedStore) Get(key []byte) ([]byte, error) {
+	b, err := s.delegate.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(b), nil
+}
+
+func (s *CompressedStore) Undecorated() interface{} {
+	return s.delegate
+}
+
+func compress(value []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(compressedMagic)
+	buf.WriteByte(formatGzip)
+	w := gzip.NewWriter(&buf)
+	// Writes to a bytes.Buffer don't fail.
+	_, _ = w.Write(value)
+	_ = w.Close()
+	if buf.Len() < len(value) {
+		return buf.Bytes()
+	}
+	if !bytes.HasPrefix(value, []byte(compressedMagic)) {
+		return value
+	}
+	b := make([]byte, 0, len(compressedMagic)+1+crc32.Size+len(value))
+	b = append(b, compressedMagic...)
+	b = append(b, formatStored)
+	b = append(b, make([]byte, crc32.Size)...)
+	binary.BigEndian.PutUint32(b[len(b)-crc32.Size:], crc32.ChecksumIEEE(value))
+	return append(b, value...)
+}
+
+// Returns the value that was compressed, or the bytes as they are, if they
+// don't decode, as they were put before compression was enabled.
+func decompress(b []byte) []byte {
+	if value, ok := decode(b); ok {
+		return value
+	}
+	return b
+}
+
+func decode(b []byte) (value []byte, ok bool) {
+	if !bytes.HasPrefix(b, []byte(compressedMagic)) {
+		return nil, false
+	}
+	b = b[len(compressedMagic):]
+	if len(b) == 0 {
+		return nil, false
+	}
+	switch format, b := b[0], b[1:]; format {
+	case formatStored:
+		if len(b) < crc32.Size {
+			return nil, false
+		}
+		sum, value := binary.BigEndian.Uint32(b), b[crc32.Size:]
+		return value, crc32.ChecksumIEEE(value) == sum
+	case formatGzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, false
+		}
+		value, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, false
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		return value, true
+	default:
+		return nil, false
+	}
+}
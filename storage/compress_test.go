@@ -0,0 +1,55 @@
+package storage_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressedStore(t *testing.T) {
+	inner := storage.NewInMemoryStore()
+	store := storage.NewCompressedStore(inner)
+	testCases := []struct {
+		name  string
+		value []byte
+		// Whether the value should take less space in the inner store.
+		smaller bool
+	}{
+		{"compressible", bytes.Repeat([]byte("all work and no play "), 100), true},
+		{"incompressible", []byte("short"), false},
+		{"starting with the magic", []byte("\x00dz\x01not really compressed"), false},
+		{"empty", []byte{}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			key := randomKey()
+			require.Nil(t, store.Put(key, tc.value))
+			stored, err := inner.Get(key)
+			require.Nil(t, err)
+			assert.Equal(t, tc.smaller, len(stored) < len(tc.value))
+			value, err := store.Get(key)
+			require.Nil(t, err)
+			assert.Equal(t, tc.value, value)
+		})
+	}
+	t.Run("uncompressed values put directly in the inner store are readable", func(t *testing.T) {
+		for _, legacy := range [][]byte{
+			[]byte("legacy"),
+			// Starting with the magic, but not decoding as any format.
+			[]byte("\x00dz"),
+			[]byte("\x00dz\x00short"),
+			[]byte("\x00dz\x00not the checksum of the rest"),
+			[]byte("\x00dz\x01not gzip"),
+			[]byte("\x00dz\x09unknown format"),
+		} {
+			key := randomKey()
+			require.Nil(t, inner.Put(key, legacy))
+			value, err := store.Get(key)
+			require.Nil(t, err)
+			assert.Equal(t, legacy, value)
+		}
+	})
+}
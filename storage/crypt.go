@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// KeyLen is the length of the master key from which the encryption keys are
+// derived.
+const KeyLen = 32
+
+// ErrDecrypt indicates a value could not be authenticated, because it was
+// encrypted with another key, tampered with, or moved to another key.
+var ErrDecrypt = errors.New("could not decrypt")
+
+// LoadKey reads a master key from a file containing its hex encoding, e.g.,
+// as created by "head -c 32 /dev/urandom | xxd -p -c 32 > keyfile".
+func LoadKey(pathname string) ([]byte, error) {
+	b, err := ioutil.ReadFile(pathname)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", pathname, err)
+	}
+	if len(key) != KeyLen {
+		return nil, fmt.Errorf("%q: got a %d bytes key, want %d bytes", pathname, len(key), KeyLen)
+	}
+	return key, nil
+}
+
+// Derives from the master key a key for the given purpose, so that the same
+// key is never used for two different things.
+func deriveKey(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	_, _ = mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seals the plaintext, prepending the nonce to the ciphertext.
+func seal(aead cipher.AEAD, nonce, plaintext, ad []byte) []byte {
+	out := make([]byte, len(nonce), len(nonce)+len(plaintext)+aead.Overhead())
+	copy(out, nonce)
+	return aead.Seal(out, nonce, plaintext, ad)
+}
+
+func open(aead cipher.AEAD, ciphertext, ad []byte) ([]byte, error) {
+	n := aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:n], ciphertext[n:], ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	if plaintext == nil {
+		plaintext = []byte{}
+	}
+	return plaintext, nil
+}
+
+func randomNonce(aead cipher.AEAD) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// EncryptedStore implements Store wrapping another store, so that the latter
+// only sees encrypted values (with AES-GCM) and keyed hashes of keys. Values
+// are bound to their keys, so they can't be swapped without being detected.
+type EncryptedStore struct {
+	delegate Store
+	aead     cipher.AEAD
+	keys     []byte
+
+	// Nil unless encryption is convergent.
+	nonces []byte
+}
+
+// NewEncryptedStore wraps the delegate to encrypt values with a key derived
+// from the given master key. If convergent is true, equal values are
+// encrypted to equal ciphertexts, so that, e.g., identical blobs put by
+// different clients sharing the master key are identical in the delegate too.
+// That also reveals to the delegate which values are equal.
+func NewEncryptedStore(delegate Store, master []byte, convergent bool) (*EncryptedStore, error) {
+	aead, err := newAEAD(deriveKey(master, "blob encryption"))
+	if err != nil {
+		return nil, err
+	}
+	s := &EncryptedStore{
+		delegate: delegate,
+		aead:     aead,
+		keys:     deriveKey(master, "blob keys"),
+	}
+	if convergent {
+		s.nonces = deriveKey(master, "blob nonces")
+	}
+	return s, nil
+}
+
+// MapKey implements KeyMapper.
+func (s *EncryptedStore) MapKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, s.keys)
+	_, _ = mac.Write(key)
+	return mac.Sum(nil)
+}
+
+func (s *EncryptedStore) nonce(key, value []byte) ([]byte, error) {
+	if s.nonces == nil {
+		return randomNonce(s.aead)
+	}
+	// A synthetic nonce: it only repeats for the same key and value, and
+	// therefore the same ciphertext.
+	mac := hmac.New(sha256.New, s.nonces)
+	_, _ = mac.Write(key)
+	_, _ = mac.Write(value)
+	return mac.Sum(nil)[:s.aead.NonceSize()], nil
+}
+
+func (s *EncryptedStore) Put(key, value []byte) error {
+	nonce, err := s.nonce(key, value)
+	if err != nil {
+		return err
+	}
+	return s.delegate.Put(s.MapKey(key), seal(s.aead, nonce, value, key))
+}
+
+func (s *EncryptedStore) Get(key []byte) ([]byte, error) {
+	ciphertext, err := s.delegate.Get(s.MapKey(key))
+	if err != nil {
+		return nil, err
+	}
+	value, err := open(s.aead, ciphertext, key)
+	if err != nil {
+		return nil, fmt.Errorf("key %.10x: %w", key, err)
+	}
+	return value, nil
+}
+
+func (s *EncryptedStore) Undecorated() interface{} {
+	return s.delegate
+}
+
+// EncryptedVersionedStore implements VersionedStore wrapping another versioned
+// store, so that the latter only sees encrypted values (with AES-GCM). Keys
+// are not encrypted. Values are bound to their keys and versions, so they
+// can't be swapped or served with a different version without being detected.
+type EncryptedVersionedStore struct {
+	delegate VersionedStore
+	aead     cipher.AEAD
+}
+
+// NewEncryptedVersionedStore wraps the delegate to encrypt values with a key
+// derived from the given master key.
+func NewEncryptedVersionedStore(delegate VersionedStore, master []byte) (*EncryptedVersionedStore, error) {
+	aead, err := newAEAD(deriveKey(master, "metadata encryption"))
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedVersionedStore{
+		delegate: delegate,
+		aead:     aead,
+	}, nil
+}
+
+// The additional data authenticated with a value.
+func versionedAD(version uint64, key []byte) []byte {
+	ad := make([]byte, 8, 8+len(key))
+	binary.LittleEndian.PutUint64(ad, version)
+	return append(ad, key...)
+}
+
+func (s *EncryptedVersionedStore) encrypt(version uint64, key, value []byte) ([]byte, error) {
+	nonce, err := randomNonce(s.aead)
+	if err != nil {
+		return nil, err
+	}
+	return seal(s.aead, nonce, value, versionedAD(version, key)), nil
+}
+
+func (s *EncryptedVersionedStore) decrypt(version uint64, key, ciphertext []byte) ([]byte, error) {
+	value, err := open(s.aead, ciphertext, versionedAD(version, key))
+	if err != nil {
+		return nil, fmt.Errorf("key %.10x version %d: %w", key, version, err)
+	}
+	return value, nil
+}
+
+func (s *EncryptedVersionedStore) Put(version uint64, key []byte, value []byte) error {
+	ciphertext, err := s.encrypt(version, key, value)
+	if err != nil {
+		return err
+	}
+	return s.delegate.Put(version, key, ciphertext)
+}
+
+func (s *EncryptedVersionedStore) PutMany(puts []VersionedPut) (errs []error, err error) {
+	encrypted := make([]VersionedPut, len(puts))
+	for i, put := range puts {
+		encrypted[i] = put
+		if encrypted[i].Value, err = s.encrypt(put.Version, put.Key, put.Value); err != nil {
+			return nil, err
+		}
+	}
+	return s.delegate.PutMany(encrypted)
+}
+
+func (s *EncryptedVersionedStore) Get(key []byte) (version uint64, value []byte, err error) {
+	version, ciphertext, err := s.delegate.Get(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	if value, err = s.decrypt(version, key, ciphertext); err != nil {
+		return 0, nil, err
+	}
+	return version, value, nil
+}
+
+func (s *EncryptedVersionedStore) GetMany(keys [][]byte) (values []VersionedValue, err error) {
+	values, err = s.delegate.GetMany(keys)
+	if err != nil {
+		return nil, err
+	}
+	for i := range values {
+		if values[i].Err != nil {
+			continue
+		}
+		if values[i].Value, values[i].Err = s.decrypt(values[i].Version, keys[i], values[i].Value); values[i].Err != nil {
+			values[i].Version = 0
+		}
+	}
+	return values, nil
+}
+
+func (s *EncryptedVersionedStore) Undecorated() interface{} {
+	return s.delegate
+}
@@ -0,0 +1,119 @@
+package storage_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testKey = bytes.Repeat([]byte{42}, storage.KeyLen)
+
+// Records what's put in it.
+type recordingStore struct {
+	*storage.InMemoryStore
+	puts [][2][]byte
+}
+
+func (s *recordingStore) Put(key, value []byte) error {
+	s.puts = append(s.puts, [2][]byte{key, value})
+	return s.InMemoryStore.Put(key, value)
+}
+
+func TestEncryptedStore(t *testing.T) {
+	plaintext := []byte("some secret content")
+	t.Run("the delegate sees neither keys nor values", func(t *testing.T) {
+		inner := &recordingStore{InMemoryStore: storage.NewInMemoryStore()}
+		store, err := storage.NewEncryptedStore(inner, testKey, false)
+		require.Nil(t, err)
+		require.Nil(t, store.Put([]byte("key"), plaintext))
+		require.Len(t, inner.puts, 1)
+		assert.NotContains(t, string(inner.puts[0][0]), "key")
+		assert.NotContains(t, string(inner.puts[0][1]), "secret")
+	})
+	t.Run("only convergent encryption is deterministic", func(t *testing.T) {
+		for _, convergent := range []bool{false, true} {
+			inner := &recordingStore{InMemoryStore: storage.NewInMemoryStore()}
+			store, err := storage.NewEncryptedStore(inner, testKey, convergent)
+			require.Nil(t, err)
+			require.Nil(t, store.Put([]byte("key"), plaintext))
+			require.Nil(t, store.Put([]byte("key"), plaintext))
+			assert.Equal(t, inner.puts[0][0], inner.puts[1][0])
+			assert.Equal(t, convergent, bytes.Equal(inner.puts[0][1], inner.puts[1][1]))
+		}
+	})
+	t.Run("values can't be moved to other keys", func(t *testing.T) {
+		inner := &recordingStore{InMemoryStore: storage.NewInMemoryStore()}
+		store, err := storage.NewEncryptedStore(inner, testKey, false)
+		require.Nil(t, err)
+		require.Nil(t, store.Put([]byte("key"), plaintext))
+		require.Nil(t, store.Put([]byte("other"), []byte("other content")))
+		require.Nil(t, inner.InMemoryStore.Put(inner.puts[1][0], inner.puts[0][1]))
+		_, err = store.Get([]byte("other"))
+		assert.True(t, errors.Is(err, storage.ErrDecrypt))
+	})
+	t.Run("values can't be read with another key", func(t *testing.T) {
+		inner := storage.NewInMemoryStore()
+		store, err := storage.NewEncryptedStore(inner, testKey, false)
+		require.Nil(t, err)
+		require.Nil(t, store.Put([]byte("key"), plaintext))
+		otherKey := bytes.Repeat([]byte{43}, storage.KeyLen)
+		other, err := storage.NewEncryptedStore(inner, otherKey, false)
+		require.Nil(t, err)
+		_, err = other.Get([]byte("key"))
+		assert.True(t, errors.Is(err, storage.ErrNotFound))
+	})
+}
+
+func TestEncryptedVersionedStore(t *testing.T) {
+	inner := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	store, err := storage.NewEncryptedVersionedStore(inner, testKey)
+	require.Nil(t, err)
+	key := []byte("key")
+	require.Nil(t, store.Put(1, key, []byte("one")))
+	_, ciphertext, err := inner.Get(key)
+	require.Nil(t, err)
+	assert.NotContains(t, string(ciphertext), "one")
+	t.Run("values can't be served with another version", func(t *testing.T) {
+		require.Nil(t, inner.Put(2, key, ciphertext))
+		_, _, err := store.Get(key)
+		assert.True(t, errors.Is(err, storage.ErrDecrypt))
+		values, err := store.GetMany([][]byte{key})
+		require.Nil(t, err)
+		assert.True(t, errors.Is(values[0].Err, storage.ErrDecrypt))
+	})
+	t.Run("put many", func(t *testing.T) {
+		errs, err := store.PutMany([]storage.VersionedPut{
+			{Version: 3, Key: key, Value: []byte("three")},
+			{Version: 1, Key: []byte("other"), Value: []byte("other")},
+		})
+		require.Nil(t, err)
+		assert.Equal(t, []error{nil, nil}, errs)
+		values, err := store.GetMany([][]byte{key, []byte("other")})
+		require.Nil(t, err)
+		assert.Equal(t, []storage.VersionedValue{
+			{Version: 3, Value: []byte("three")},
+			{Version: 1, Value: []byte("other")},
+		}, values)
+	})
+}
+
+func TestLoadKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dino-key-")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	pathname := filepath.Join(dir, "key")
+	require.Nil(t, ioutil.WriteFile(pathname, []byte("2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a2a\n"), 0600))
+	key, err := storage.LoadKey(pathname)
+	require.Nil(t, err)
+	assert.Equal(t, testKey, key)
+	require.Nil(t, ioutil.WriteFile(pathname, []byte("2a2a"), 0600))
+	_, err = storage.LoadKey(pathname)
+	assert.NotNil(t, err)
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"crypto/sha512"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -49,3 +50,49 @@ func (s *DiskStore) pathFor(key []byte) string {
 	hex := fmt.Sprintf("%02x", key)
 	return filepath.Join(s.dir, hex[:2], hex)
 }
+
+// List implements Lister. Keys longer than sha512.Size are stored under their
+// hash, which is what's listed for them (and also works with Delete).
+func (s *DiskStore) List(after []byte) (keys [][]byte, err error) {
+	start := fmt.Sprintf("%02x", after)
+	dirs, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(start) >= 2 && dir.Name() < start[:2] {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(s.dir, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if len(after) > 0 && file.Name() <= start {
+				continue
+			}
+			key, err := hex.DecodeString(file.Name())
+			if err != nil {
+				// Not ours, e.g., a temporary file.
+				continue
+			}
+			keys = append(keys, key)
+			if len(keys) == listPageSize {
+				return keys, nil
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Delete implements Deleter.
+func (s *DiskStore) Delete(key []byte) error {
+	err := os.Remove(s.pathFor(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -108,6 +108,12 @@ func (s *DynamoDBVersionedStore) Put(version uint64, key []byte, value []byte) (
 	return nil
 }
 
+// PutMany implements VersionedStore. Conditional writes can't be batched, so
+// this does one request per put.
+func (s *DynamoDBVersionedStore) PutMany(puts []VersionedPut) (errs []error, err error) {
+	return PutEach(s, puts)
+}
+
 func (s *DynamoDBVersionedStore) Get(key []byte) (version uint64, value []byte, err error) {
 	version, value, err = s.local.Get(key)
 	if err == nil {
@@ -141,6 +147,74 @@ func (s *DynamoDBVersionedStore) Get(key []byte) (version uint64, value []byte,
 	return version, value, nil
 }
 
+// Maximum number of keys in a BatchGetItem request.
+const ddbMaxBatchGet = 100
+
+// GetMany serves what it can from the local copy of the key-value pairs, and
+// gets the rest with BatchGetItem requests.
+func (s *DynamoDBVersionedStore) GetMany(keys [][]byte) (values []VersionedValue, err error) {
+	values = make([]VersionedValue, len(keys))
+	// Indexes of the values still to get, by key.
+	missing := make(map[string][]int)
+	var requestKeys []map[string]*dynamodb.AttributeValue
+	for i, key := range keys {
+		v := &values[i]
+		v.Version, v.Value, v.Err = s.local.Get(key)
+		if v.Err == nil {
+			continue
+		}
+		if _, ok := missing[string(key)]; !ok {
+			requestKeys = append(requestKeys, map[string]*dynamodb.AttributeValue{
+				"k": ddbBinary(key),
+			})
+		}
+		missing[string(key)] = append(missing[string(key)], i)
+	}
+	for len(requestKeys) > 0 {
+		n := len(requestKeys)
+		if n > ddbMaxBatchGet {
+			n = ddbMaxBatchGet
+		}
+		batch := requestKeys[:n]
+		requestKeys = requestKeys[n:]
+		for len(batch) > 0 {
+			for range batch {
+				time.Sleep(s.getLimiter.Reserve().Delay())
+			}
+			output, err := s.ddb.BatchGetItem(&dynamodb.BatchGetItemInput{
+				RequestItems: map[string]*dynamodb.KeysAndAttributes{
+					s.table: {Keys: batch},
+				},
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, item := range output.Responses[s.table] {
+				key := string(item["k"].B)
+				// Trusting this to be a number.
+				version, _ := strconv.ParseUint(*item["ve"].N, 10, 64)
+				for _, i := range missing[key] {
+					values[i] = VersionedValue{
+						Version: version,
+						Value:   item["va"].B,
+					}
+				}
+				delete(missing, key)
+			}
+			batch = nil
+			if unprocessed := output.UnprocessedKeys[s.table]; unprocessed != nil {
+				batch = unprocessed.Keys
+			}
+		}
+	}
+	for key, indexes := range missing {
+		for _, i := range indexes {
+			values[i].Err = fmt.Errorf("%.10x: %w", key, ErrNotFound)
+		}
+	}
+	return values, nil
+}
+
 func ddbBinary(b []byte) *dynamodb.AttributeValue {
 	return &dynamodb.AttributeValue{
 		B: dup(b),
@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
+	"sort"
 	"sync"
 )
 
@@ -37,3 +39,29 @@ func (s *InMemoryStore) Get(key []byte) (value []byte, err error) {
 	}
 	return value, nil
 }
+
+// List implements Lister.
+func (s *InMemoryStore) List(after []byte) (keys [][]byte, err error) {
+	s.Lock()
+	for key := range s.m {
+		if bytes.Compare([]byte(key), after) > 0 {
+			keys = append(keys, []byte(key))
+		}
+	}
+	s.Unlock()
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	if len(keys) > listPageSize {
+		keys = keys[:listPageSize]
+	}
+	return keys, nil
+}
+
+// Delete implements Deleter.
+func (s *InMemoryStore) Delete(key []byte) error {
+	s.Lock()
+	delete(s.m, string(key))
+	s.Unlock()
+	return nil
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// How many keys List implementations return at most.
+const listPageSize = 1000
+
+// ErrNotSupported is returned for operations a store can't do, e.g., listing
+// keys in a store that doesn't implement Lister.
+var ErrNotSupported = errors.New("not supported")
+
+// Lister is implemented by stores that can enumerate their keys, e.g., for
+// garbage collection.
+type Lister interface {
+	// List returns some of the keys greater than after, in increasing order,
+	// or none if there are no more.
+	List(after []byte) (keys [][]byte, err error)
+}
+
+// Deleter is implemented by stores that can delete keys, e.g., for garbage
+// collection. Deleting a key that's not in the store is not an error.
+type Deleter interface {
+	Delete(key []byte) error
+}
+
+// KeyMapper is implemented by decorators that store values under different
+// keys than the ones they are given, e.g., to hide the keys from the wrapped
+// store.
+type KeyMapper interface {
+	MapKey(key []byte) []byte
+}
+
+// ForEachKey calls fn for each key in the store, which must implement Lister.
+func ForEachKey(store interface{}, fn func(key []byte) error) error {
+	lister, ok := store.(Lister)
+	if !ok {
+		return fmt.Errorf("listing keys of %T: %w", store, ErrNotSupported)
+	}
+	var after []byte
+	for {
+		keys, err := lister.List(after)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		after = keys[len(keys)-1]
+	}
+}
+
+// Delete deletes the key from the store, which must implement Deleter.
+func Delete(store interface{}, key []byte) error {
+	deleter, ok := store.(Deleter)
+	if !ok {
+		return fmt.Errorf("deleting from %T: %w", store, ErrNotSupported)
+	}
+	return deleter.Delete(key)
+}
+
+// StoredKey returns the key under which the innermost store wrapped by the
+// given one (see Undecorate) stores the value for the given key.
+func StoredKey(store interface{}, key []byte) []byte {
+	for {
+		if m, ok := store.(KeyMapper); ok {
+			key = m.MapKey(key)
+		}
+		d, ok := store.(Decorator)
+		if !ok {
+			return key
+		}
+		store = d.Undecorated()
+	}
+}
@@ -26,6 +26,75 @@ func ApplyMessage(store VersionedStore, in message.Message) (out message.Message
 			"version": in.Version(),
 		}).Debug("Applied put message")
 		return in
+	case message.KindPutMany:
+		entries := in.Entries()
+		var puts []VersionedPut
+		for _, entry := range entries {
+			if entry.Kind() != message.KindPut {
+				return message.NewErrorMessage(inTag, "put-many messages can only carry put messages")
+			}
+			puts = append(puts, VersionedPut{
+				Version: entry.Version(),
+				Key:     []byte(entry.Key()),
+				Value:   []byte(entry.Value()),
+			})
+		}
+		errs, err := store.PutMany(puts)
+		if err != nil {
+			return message.NewErrorMessage(inTag, err.Error())
+		}
+		outcomes := make([]message.Message, len(entries))
+		for i, entry := range entries {
+			if errs[i] != nil {
+				outcomes[i] = message.NewErrorMessage(0, errs[i].Error())
+			} else {
+				outcomes[i] = entry
+			}
+		}
+		log.WithField("count", len(entries)).Debug("Applied put-many message")
+		return message.NewPutManyMessage(inTag, outcomes)
+	case message.KindGetMany:
+		entries := in.Entries()
+		keys := make([][]byte, len(entries))
+		for i, entry := range entries {
+			if entry.Kind() != message.KindGet {
+				return message.NewErrorMessage(inTag, "get-many messages can only carry get messages")
+			}
+			keys[i] = []byte(entry.Key())
+		}
+		values, err := store.GetMany(keys)
+		if err != nil {
+			return message.NewErrorMessage(inTag, err.Error())
+		}
+		outcomes := make([]message.Message, len(entries))
+		for i, v := range values {
+			if v.Err != nil {
+				outcomes[i] = message.NewErrorMessage(0, v.Err.Error())
+			} else {
+				outcomes[i] = message.NewPutMessage(0, entries[i].Key(), string(v.Value), v.Version)
+			}
+		}
+		return message.NewGetManyMessage(inTag, outcomes)
+	case message.KindList:
+		lister, ok := store.(Lister)
+		if !ok {
+			return message.NewErrorMessage(inTag, ErrNotSupported.Error())
+		}
+		keys, err := lister.List([]byte(in.Key()))
+		if err != nil {
+			return message.NewErrorMessage(inTag, err.Error())
+		}
+		entries := make([]message.Message, len(keys))
+		for i, key := range keys {
+			entries[i] = message.NewGetMessage(0, string(key))
+		}
+		return message.NewListMessage(inTag, in.Key(), entries)
+	case message.KindDelete:
+		if err := Delete(store, []byte(in.Key())); err != nil {
+			return message.NewErrorMessage(inTag, err.Error())
+		}
+		log.WithField("key", fmt.Sprintf("%.10x", in.Key())).Debug("Applied delete message")
+		return in
 	case message.KindError:
 		return message.NewErrorMessage(inTag, "error messages cannot be applied")
 	default:
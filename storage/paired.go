@@ -3,6 +3,8 @@ package storage
 import (
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -18,13 +20,38 @@ type Paired struct {
 	slow Store
 
 	wbc chan [2][]byte
+
+	// Shared among copies of the struct.
+	stats *pairedStats
+}
+
+type pairedStats struct {
+	// Accessed atomically.
+	hits   uint64
+	misses uint64
+
+	mu sync.Mutex
+	// Keys put but not yet propagated to the slow store, with their multiplicity.
+	pending  map[string]int
+	npending int
+}
+
+func (ps *pairedStats) addPending(key []byte, delta int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.pending[string(key)] += delta
+	if ps.pending[string(key)] <= 0 {
+		delete(ps.pending, string(key))
+	}
+	ps.npending += delta
 }
 
 func NewPaired(fast, slow Store) Paired {
 	p := Paired{
-		fast: fast,
-		slow: slow,
-		wbc:  make(chan [2][]byte, 42),
+		fast:  fast,
+		slow:  slow,
+		wbc:   make(chan [2][]byte, 42),
+		stats: &pairedStats{pending: make(map[string]int)},
 	}
 	// Exits only when the process is terminated.
 	go p.writeback()
@@ -34,11 +61,13 @@ func NewPaired(fast, slow Store) Paired {
 func (s Paired) Get(key []byte) (value []byte, err error) {
 	value, err = s.fast.Get(key)
 	if err == nil {
+		atomic.AddUint64(&s.stats.hits, 1)
 		return
 	}
 	if !errors.Is(err, ErrNotFound) {
 		return
 	}
+	atomic.AddUint64(&s.stats.misses, 1)
 	value, err = s.slow.Get(key)
 	if err != nil {
 		return nil, err
@@ -59,8 +88,9 @@ func (s Paired) Put(key, value []byte) (err error) {
 		return err
 	}
 	// This can get stuck if it fills up and the remote is not able to fulfill
-	// our requests. Also, if we kill the process in the middle of propagation,
-	// we'll have missing data on the remote.
+	// our requests. Also, if the process is killed in the middle of propagation
+	// (without waiting for Drain), we'll have missing data on the remote.
+	s.stats.addPending(key, 1)
 	s.wbc <- [2][]byte{dup(key), dup(value)}
 	return nil
 }
@@ -70,6 +100,52 @@ func (s Paired) writeback() {
 		key := kv[0]
 		value := kv[1]
 		s.writeback1(key, value)
+		s.stats.addPending(key, -1)
+	}
+}
+
+// Pending returns how many puts have not been propagated to the slow store yet.
+func (s Paired) Pending() int {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	return s.stats.npending
+}
+
+// Drain waits until all puts have been propagated to the slow store, logging
+// progress periodically. It returns an error if puts are still pending after
+// the given timeout.
+func (s Paired) Drain(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	lastLog := time.Now()
+	for {
+		n := s.Pending()
+		if n == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d puts not propagated after %v", n, timeout)
+		}
+		if time.Since(lastLog) >= time.Second {
+			log.WithField("pending", n).Info("Waiting for propagation to slow store")
+			lastLog = time.Now()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// IsPending tells whether the value for the given key is yet to be propagated
+// to the slow store.
+func (s Paired) IsPending(key []byte) bool {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	return s.stats.pending[string(key)] > 0
+}
+
+// CacheStats tells how many gets were satisfied by the fast store.
+func (s Paired) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&s.stats.hits),
+		Misses: atomic.LoadUint64(&s.stats.misses),
 	}
 }
 
@@ -0,0 +1,45 @@
+package storage_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A store whose puts block until released.
+type gatedStore struct {
+	storage.Store
+	gate chan struct{}
+}
+
+func (s *gatedStore) Put(key, value []byte) error {
+	<-s.gate
+	return s.Store.Put(key, value)
+}
+
+func TestPairedDrain(t *testing.T) {
+	slow := &gatedStore{
+		Store: storage.NewInMemoryStore(),
+		gate:  make(chan struct{}),
+	}
+	paired := storage.NewPaired(storage.NewInMemoryStore(), slow)
+	require.Nil(t, paired.Put([]byte("key"), []byte("value")))
+	assert.Equal(t, 1, paired.Pending())
+	assert.True(t, paired.IsPending([]byte("key")))
+
+	t.Run("times out while puts are pending", func(t *testing.T) {
+		assert.NotNil(t, paired.Drain(50*time.Millisecond))
+	})
+	t.Run("returns when puts have been propagated", func(t *testing.T) {
+		close(slow.gate)
+		require.Nil(t, paired.Drain(time.Second))
+		assert.Equal(t, 0, paired.Pending())
+		assert.False(t, paired.IsPending([]byte("key")))
+		value, err := slow.Get([]byte("key"))
+		require.Nil(t, err)
+		assert.Equal(t, []byte("value"), value)
+	})
+}
@@ -2,28 +2,76 @@ package storage
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrUnauthorized indicates the blobserver requires a token, and none or an
+	// unknown one was sent.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrForbidden indicates the token sent doesn't allow the operation, e.g.,
+	// a put with a read-only token.
+	ErrForbidden = errors.New("forbidden")
 )
 
 // RemoteStore implements Store. It requires to connect to a blobserver.
 type RemoteStore struct {
 	address string
+	scheme  string
+	client  *http.Client
+	token   string
+
+	mu      sync.Mutex
+	lastErr error
 }
 
-func NewRemoteStore(address string) *RemoteStore {
-	return &RemoteStore{address: address}
+// RemoteStoreOption configures optional properties of a RemoteStore.
+type RemoteStoreOption func(*RemoteStore)
+
+// WithRemoteTLS makes the store connect to the blobserver over TLS.
+func WithRemoteTLS(value *tls.Config) RemoteStoreOption {
+	return func(r *RemoteStore) {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = value
+		r.scheme = "https"
+		r.client = &http.Client{Transport: transport}
+	}
 }
 
-func (r *RemoteStore) Put(key, value []byte) (err error) {
-	url := r.pathFor(key)
-	request, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(value))
-	if err != nil {
-		return err
+// WithRemoteToken makes the store send the given bearer token with each
+// request, for blobservers requiring one.
+func WithRemoteToken(value string) RemoteStoreOption {
+	return func(r *RemoteStore) {
+		r.token = value
 	}
-	response, err := http.DefaultClient.Do(request)
+}
+
+func NewRemoteStore(address string, opts ...RemoteStoreOption) *RemoteStore {
+	r := &RemoteStore{
+		address: address,
+		scheme:  "http",
+		client:  http.DefaultClient,
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	return r
+}
+
+func (r *RemoteStore) Put(key, value []byte) (err error) {
+	defer func() {
+		r.setLastErr(err)
+	}()
+	response, err := r.do(http.MethodPut, r.pathFor(key), bytes.NewReader(value))
 	if response != nil && response.Body != nil {
 		defer func() {
 			_ = response.Body.Close()
@@ -37,14 +85,18 @@ func (r *RemoteStore) Put(key, value []byte) (err error) {
 		return err
 	}
 	if response.StatusCode != http.StatusOK {
-		return errors.New(string(body))
+		return responseError(response, body)
 	}
 	return nil
 }
 
 func (r *RemoteStore) Get(key []byte) (value []byte, err error) {
-	url := r.pathFor(key)
-	response, err := http.Get(url)
+	defer func() {
+		if !errors.Is(err, ErrNotFound) {
+			r.setLastErr(err)
+		}
+	}()
+	response, err := r.do(http.MethodGet, r.pathFor(key), nil)
 	if response != nil && response.Body != nil {
 		defer func() {
 			_ = response.Body.Close()
@@ -61,11 +113,108 @@ func (r *RemoteStore) Get(key []byte) (value []byte, err error) {
 		return nil, err
 	}
 	if response.StatusCode != http.StatusOK {
-		return nil, errors.New(string(body))
+		return nil, responseError(response, body)
 	}
 	return body, nil
 }
 
+// List implements Lister.
+func (r *RemoteStore) List(after []byte) (keys [][]byte, err error) {
+	defer func() {
+		r.setLastErr(err)
+	}()
+	response, err := r.do(http.MethodGet, fmt.Sprintf("%s://%s/?after=%x", r.scheme, r.address, after), nil)
+	if response != nil && response.Body != nil {
+		defer func() {
+			_ = response.Body.Close()
+		}()
+	}
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, responseError(response, body)
+	}
+	for _, line := range strings.Fields(string(body)) {
+		key, err := hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", line, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Delete implements Deleter.
+func (r *RemoteStore) Delete(key []byte) (err error) {
+	defer func() {
+		r.setLastErr(err)
+	}()
+	response, err := r.do(http.MethodDelete, r.pathFor(key), nil)
+	if response != nil && response.Body != nil {
+		defer func() {
+			_ = response.Body.Close()
+		}()
+	}
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return responseError(response, body)
+	}
+	return nil
+}
+
+func (r *RemoteStore) setLastErr(err error) {
+	r.mu.Lock()
+	r.lastErr = err
+	r.mu.Unlock()
+}
+
+// Status implements StatusReporter. Since requests are independent of each
+// other, the store is considered connected if the last request was successful.
+func (r *RemoteStore) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return Status{
+		Address:   r.address,
+		Connected: r.lastErr == nil,
+		Err:       r.lastErr,
+	}
+}
+
+func (r *RemoteStore) do(method string, url string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if r.token != "" {
+		request.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	return r.client.Do(request)
+}
+
+// Maps the status of a failed request to an error, the body being the
+// blobserver's description of it.
+func responseError(response *http.Response, body []byte) error {
+	switch response.StatusCode {
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusForbidden:
+		return ErrForbidden
+	default:
+		return errors.New(string(body))
+	}
+}
+
 func (r *RemoteStore) pathFor(key []byte) string {
-	return fmt.Sprintf("http://%s/%x", r.address, key)
+	return fmt.Sprintf("%s://%s/%x", r.scheme, r.address, key)
 }
@@ -0,0 +1,39 @@
+package storage_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nicolagi/dino/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteStoreTokens(t *testing.T) {
+	// Like a blobserver with a read-only token, which doesn't store anything.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("Authorization") != "Bearer reader":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.Method != http.MethodGet:
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	anonymous := storage.NewRemoteStore(address)
+	_, err := anonymous.Get(randomKey())
+	assert.Equal(t, storage.ErrUnauthorized, err)
+	assert.Equal(t, storage.ErrUnauthorized, anonymous.Put(randomKey(), []byte("value")))
+	assert.Equal(t, storage.ErrUnauthorized, anonymous.Status().Err)
+
+	reader := storage.NewRemoteStore(address, storage.WithRemoteToken("reader"))
+	_, err = reader.Get(randomKey())
+	assert.Equal(t, storage.ErrNotFound, err)
+	assert.Equal(t, storage.ErrForbidden, reader.Put(randomKey(), []byte("value")))
+	assert.Equal(t, storage.ErrForbidden, reader.Delete(randomKey()))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nicolagi/dino/message"
@@ -22,8 +23,11 @@ type options struct {
 	listener        ChangeListener
 }
 
+// Requests time out after longer than the metadata server waits for a put to
+// be committed, if replicated (10s), so that slow commits aren't mistaken for
+// a lost server.
 var defaultOptions = options{
-	requestTimeout:  time.Second,
+	requestTimeout:  15 * time.Second,
 	responseBackoff: time.Second,
 }
 
@@ -52,6 +56,10 @@ type ChangeListener func(message.Message)
 // RemoteVersionedStore is an implementation of VersionedStore, via a client to a remote
 // metadataserver process.
 type RemoteVersionedStore struct {
+	// Accessed atomically, count gets served by the local cache or not.
+	hits   uint64
+	misses uint64
+
 	tags   *message.MonotoneTags
 	remote *client.Client
 	local  VersionedStore
@@ -66,6 +74,9 @@ type RemoteVersionedStore struct {
 	mu         sync.Mutex
 	rendezvous map[uint16]chan message.Message
 	stopped    bool
+	receiveErr error
+	// Requests that timed out since the last response.
+	timeouts int
 }
 
 func NewRemoteVersionedStore(remote *client.Client, options ...Option) *RemoteVersionedStore {
@@ -128,7 +139,11 @@ func (rs *RemoteVersionedStore) cancelRendezvous(tag uint16) {
 	rs.mu.Unlock()
 }
 
-// do sends a request and waits up to a second for its response.
+// How many requests in a row may time out before the client reconnects to the
+// server, if there's no other to fail over to.
+const maxTimeouts = 3
+
+// do sends a request and waits up to the request timeout for its response.
 func (rs *RemoteVersionedStore) do(request message.Message) (response message.Message, err error) {
 	rs.doing.Add(1)
 	defer rs.doing.Done()
@@ -140,9 +155,25 @@ func (rs *RemoteVersionedStore) do(request message.Message) (response message.Me
 	}
 	select {
 	case response = <-r:
+		rs.mu.Lock()
+		rs.timeouts = 0
+		rs.mu.Unlock()
 		return response, nil
 	case <-time.After(rs.opts.requestTimeout):
 		rs.cancelRendezvous(tag)
+		// The server may be gone without the connection being reset. Fail
+		// over right away if there's another server, otherwise reconnect after
+		// a few timeouts in a row, as the server may just be slow.
+		abandon := rs.remote.CanFailOver()
+		rs.mu.Lock()
+		rs.timeouts++
+		if abandon = abandon || rs.timeouts >= maxTimeouts; abandon {
+			rs.timeouts = 0
+		}
+		rs.mu.Unlock()
+		if abandon {
+			rs.remote.Abandon()
+		}
 		return response, ErrTimeout
 	}
 }
@@ -153,9 +184,42 @@ func (rs *RemoteVersionedStore) Put(version uint64, key []byte, value []byte) (e
 	if err != nil {
 		return err
 	}
+	return putOutcome(request, response)
+}
+
+// PutMany sends all puts in a single message.
+func (rs *RemoteVersionedStore) PutMany(puts []VersionedPut) (errs []error, err error) {
+	entries := make([]message.Message, len(puts))
+	for i, p := range puts {
+		entries[i] = message.NewPutMessage(0, string(p.Key), string(p.Value), p.Version)
+	}
+	response, err := rs.do(message.NewPutManyMessage(rs.tags.Next(), entries))
+	if err != nil {
+		return nil, err
+	}
+	switch response.Kind() {
+	case message.KindPutMany:
+		outcomes := response.Entries()
+		if len(outcomes) != len(entries) {
+			return nil, fmt.Errorf("got %d outcomes for %d puts", len(outcomes), len(entries))
+		}
+		errs = make([]error, len(entries))
+		for i := range entries {
+			errs[i] = putOutcome(entries[i], outcomes[i])
+		}
+		return errs, nil
+	case message.KindError:
+		return nil, errors.New(response.Value())
+	default:
+		return nil, fmt.Errorf("unexpected response kind: %v", response.Kind())
+	}
+}
+
+// Interprets the response to a put request.
+func putOutcome(request, response message.Message) error {
 	switch response.Kind() {
 	case message.KindPut:
-		if request != response {
+		if request.Key() != response.Key() || request.Value() != response.Value() || request.Version() != response.Version() {
 			log.WithFields(log.Fields{
 				"request":  request,
 				"response": response,
@@ -176,12 +240,107 @@ func (rs *RemoteVersionedStore) Put(version uint64, key []byte, value []byte) (e
 func (rs *RemoteVersionedStore) Get(key []byte) (version uint64, value []byte, err error) {
 	version, value, err = rs.local.Get(key)
 	if err == nil {
+		atomic.AddUint64(&rs.hits, 1)
 		return
 	}
+	atomic.AddUint64(&rs.misses, 1)
 	response, err := rs.do(message.NewGetMessage(rs.tags.Next(), string(key)))
 	if err != nil {
 		return 0, nil, err
 	}
+	return getOutcome(response)
+}
+
+// List implements Lister.
+func (rs *RemoteVersionedStore) List(after []byte) (keys [][]byte, err error) {
+	response, err := rs.do(message.NewListMessage(rs.tags.Next(), string(after), nil))
+	if err != nil {
+		return nil, err
+	}
+	switch response.Kind() {
+	case message.KindList:
+		for _, entry := range response.Entries() {
+			keys = append(keys, []byte(entry.Key()))
+		}
+		return keys, nil
+	case message.KindError:
+		return nil, errors.New(response.Value())
+	default:
+		return nil, fmt.Errorf("unexpected response kind: %v", response.Kind())
+	}
+}
+
+// Delete implements Deleter. The deletion is not broadcast to other clients,
+// which is fine as long as only keys no client uses are deleted.
+func (rs *RemoteVersionedStore) Delete(key []byte) error {
+	response, err := rs.do(message.NewDeleteMessage(rs.tags.Next(), string(key)))
+	if err != nil {
+		return err
+	}
+	switch response.Kind() {
+	case message.KindDelete:
+		return Delete(rs.local, key)
+	case message.KindError:
+		return errors.New(response.Value())
+	default:
+		return fmt.Errorf("unexpected response kind: %v", response.Kind())
+	}
+}
+
+// Maximum number of gets in a single get-many request.
+const maxGetMany = 1000
+
+// GetMany serves what it can from the local copy of the key-value pairs, and
+// gets the rest with as few messages as possible.
+func (rs *RemoteVersionedStore) GetMany(keys [][]byte) (values []VersionedValue, err error) {
+	values = make([]VersionedValue, len(keys))
+	var missing []int
+	for i, key := range keys {
+		v := &values[i]
+		v.Version, v.Value, v.Err = rs.local.Get(key)
+		if v.Err == nil {
+			atomic.AddUint64(&rs.hits, 1)
+		} else {
+			atomic.AddUint64(&rs.misses, 1)
+			missing = append(missing, i)
+		}
+	}
+	for len(missing) > 0 {
+		n := len(missing)
+		if n > maxGetMany {
+			n = maxGetMany
+		}
+		chunk := missing[:n]
+		missing = missing[n:]
+		entries := make([]message.Message, len(chunk))
+		for j, i := range chunk {
+			entries[j] = message.NewGetMessage(0, string(keys[i]))
+		}
+		response, err := rs.do(message.NewGetManyMessage(rs.tags.Next(), entries))
+		if err != nil {
+			return nil, err
+		}
+		switch response.Kind() {
+		case message.KindGetMany:
+			outcomes := response.Entries()
+			if len(outcomes) != len(entries) {
+				return nil, fmt.Errorf("got %d outcomes for %d gets", len(outcomes), len(entries))
+			}
+			for j, i := range chunk {
+				v := &values[i]
+				v.Version, v.Value, v.Err = getOutcome(outcomes[j])
+			}
+		case message.KindError:
+			return nil, errors.New(response.Value())
+		default:
+			return nil, fmt.Errorf("unexpected response kind: %v", response.Kind())
+		}
+	}
+	return values, nil
+}
+
+// Interprets the response to a get request.
+func getOutcome(response message.Message) (version uint64, value []byte, err error) {
 	switch response.Kind() {
 	case message.KindPut:
 		return response.Version(), []byte(response.Value()), nil
@@ -207,7 +366,15 @@ func (rs *RemoteVersionedStore) receiveLoop() {
 			break
 		}
 		var m message.Message
-		if err := rs.remote.Receive(&m); err != nil {
+		err := rs.remote.Receive(&m)
+		rs.mu.Lock()
+		rs.receiveErr = err
+		rs.mu.Unlock()
+		if errors.Is(err, client.ErrRedirected) {
+			// The client will connect to the leader straight away.
+			continue
+		}
+		if err != nil {
 			log.WithFields(log.Fields{
 				"err": err,
 			}).Error("Receive error")
@@ -239,3 +406,23 @@ func (rs *RemoteVersionedStore) receiveLoop() {
 		}
 	}
 }
+
+// Status implements StatusReporter.
+func (rs *RemoteVersionedStore) Status() Status {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return Status{
+		Address:   rs.remote.Address(),
+		Connected: rs.remote.Connected(),
+		Err:       rs.receiveErr,
+	}
+}
+
+// CacheStats tells how many gets were satisfied by the local copy of the
+// key-value pairs, which is kept up to date by the server's broadcasts.
+func (rs *RemoteVersionedStore) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadUint64(&rs.hits),
+		Misses: atomic.LoadUint64(&rs.misses),
+	}
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -72,3 +73,33 @@ func (s *S3Store) Put(key, value []byte) (err error) {
 	})
 	return
 }
+
+// List implements Lister.
+func (s *S3Store) List(after []byte) (keys [][]byte, err error) {
+	output, err := s.client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:     aws.String(s.bucket),
+		StartAfter: aws.String(fmt.Sprintf("%x", after)),
+		MaxKeys:    aws.Int64(listPageSize),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range output.Contents {
+		key, err := hex.DecodeString(aws.StringValue(object.Key))
+		if err != nil {
+			// Not ours.
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Delete implements Deleter.
+func (s *S3Store) Delete(key []byte) (err error) {
+	_, err = s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(fmt.Sprintf("%x", key)),
+	})
+	return
+}
@@ -0,0 +1,40 @@
+package storage
+
+// Status describes the connection between a store and the server backing it.
+type Status struct {
+	Address   string
+	Connected bool
+
+	// The last error talking to the server, if any, since the last success.
+	Err error
+}
+
+// StatusReporter is implemented by stores backed by a server.
+type StatusReporter interface {
+	Status() Status
+}
+
+// CacheStats counts how many times a cache could and could not satisfy a
+// request.
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// Decorator is implemented by stores wrapping another store, e.g., to encrypt
+// values, to give access to the wrapped store.
+type Decorator interface {
+	Undecorated() interface{}
+}
+
+// Undecorate returns the innermost store wrapped by the given store, which is
+// the one that may implement, e.g., StatusReporter.
+func Undecorate(store interface{}) interface{} {
+	for {
+		d, ok := store.(Decorator)
+		if !ok {
+			return store
+		}
+		store = d.Undecorated()
+	}
+}
@@ -3,6 +3,7 @@ package storage
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"sync"
 )
 
@@ -25,8 +26,56 @@ type VersionedStore interface {
 	// seen the most current version before trying to update it.
 	Put(version uint64, key []byte, value []byte) (err error)
 
+	// PutMany does the given puts in order, as if by calling Put for each, but
+	// possibly with fewer round trips. It returns the outcome of each put in
+	// errs, unless err is not nil, in which case the outcome of the puts is not
+	// known.
+	PutMany(puts []VersionedPut) (errs []error, err error)
+
 	// Get should return ErrNotFound if the key is not in the store.
 	Get(key []byte) (version uint64, value []byte, err error)
+
+	// GetMany gets the given keys, as if by calling Get for each, but possibly
+	// with fewer round trips. The returned values are in the same order as the
+	// keys, unless err is not nil, in which case there are none.
+	GetMany(keys [][]byte) (values []VersionedValue, err error)
+}
+
+// VersionedPut is one of the puts of a VersionedStore.PutMany call.
+type VersionedPut struct {
+	Version uint64
+	Key     []byte
+	Value   []byte
+}
+
+// VersionedValue is one of the results of a VersionedStore.GetMany call.
+type VersionedValue struct {
+	Version uint64
+	Value   []byte
+
+	// What Get would have returned for the key, e.g., ErrNotFound.
+	Err error
+}
+
+// PutEach implements VersionedStore.PutMany by calling Put for each put, for
+// stores that can't do better than that.
+func PutEach(store VersionedStore, puts []VersionedPut) (errs []error, err error) {
+	errs = make([]error, len(puts))
+	for i, p := range puts {
+		errs[i] = store.Put(p.Version, p.Key, p.Value)
+	}
+	return errs, nil
+}
+
+// GetEach implements VersionedStore.GetMany by calling Get for each key, for
+// stores that can't do better than that.
+func GetEach(store VersionedStore, keys [][]byte) (values []VersionedValue, err error) {
+	values = make([]VersionedValue, len(keys))
+	for i, key := range keys {
+		v := &values[i]
+		v.Version, v.Value, v.Err = store.Get(key)
+	}
+	return values, nil
 }
 
 var (
@@ -71,6 +120,16 @@ func (s *VersionedWrapper) Put(version uint64, key []byte, value []byte) error {
 	return s.delegate.Put(key, val)
 }
 
+// PutMany implements VersionedStore.
+func (s *VersionedWrapper) PutMany(puts []VersionedPut) (errs []error, err error) {
+	return PutEach(s, puts)
+}
+
+// GetMany implements VersionedStore.
+func (s *VersionedWrapper) GetMany(keys [][]byte) (values []VersionedValue, err error) {
+	return GetEach(s, keys)
+}
+
 // Get retrieves the value associated with a key and its version number.
 func (s *VersionedWrapper) Get(key []byte) (version uint64, value []byte, err error) {
 	s.Lock()
@@ -82,3 +141,19 @@ func (s *VersionedWrapper) Get(key []byte) (version uint64, value []byte, err er
 	}
 	return
 }
+
+// List implements Lister, if the delegate does.
+func (s *VersionedWrapper) List(after []byte) (keys [][]byte, err error) {
+	lister, ok := s.delegate.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("listing keys of %T: %w", s.delegate, ErrNotSupported)
+	}
+	return lister.List(after)
+}
+
+// Delete implements Deleter, if the delegate does.
+func (s *VersionedWrapper) Delete(key []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	return Delete(s.delegate, key)
+}
@@ -91,6 +91,28 @@ func TestStoreImplementations(t *testing.T) {
 				), func() {}
 			},
 		},
+		{
+			name: "Compressed store backed by an in-memory store",
+			setup: func(t *testing.T) (s storage.Store, teardown func()) {
+				return storage.NewCompressedStore(storage.NewInMemoryStore()), func() {}
+			},
+		},
+		{
+			name: "Encrypted store backed by an in-memory store",
+			setup: func(t *testing.T) (s storage.Store, teardown func()) {
+				store, err := storage.NewEncryptedStore(storage.NewInMemoryStore(), testKey, false)
+				require.Nil(t, err)
+				return store, func() {}
+			},
+		},
+		{
+			name: "Convergently encrypted store backed by an in-memory store",
+			setup: func(t *testing.T) (s storage.Store, teardown func()) {
+				store, err := storage.NewEncryptedStore(storage.NewInMemoryStore(), testKey, true)
+				require.Nil(t, err)
+				return store, func() {}
+			},
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -154,6 +176,17 @@ func TestVersionedStoreImplementations(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "encrypted",
+			setup: func(t *testing.T) (store storage.VersionedStore, teardown func()) {
+				store, err := storage.NewEncryptedVersionedStore(
+					storage.NewVersionedWrapper(storage.NewInMemoryStore()),
+					testKey,
+				)
+				require.Nil(t, err)
+				return store, func() {}
+			},
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -219,6 +252,31 @@ func testStore(t *testing.T, store storage.Store) {
 		}
 		copy(key, "other")
 	})
+	t.Run("list and delete keys", func(t *testing.T) {
+		inner := storage.Undecorate(store)
+		if _, ok := inner.(storage.Lister); !ok {
+			t.Skip()
+		}
+		key := randomKey()[:16]
+		require.Nil(t, store.Put(key, []byte("value")))
+		stored := storage.StoredKey(store, key)
+		listed := func() (found bool) {
+			var prev []byte
+			require.Nil(t, storage.ForEachKey(inner, func(k []byte) error {
+				assert.True(t, bytes.Compare(prev, k) < 0)
+				prev = k
+				found = found || bytes.Equal(k, stored)
+				return nil
+			}))
+			return found
+		}
+		assert.True(t, listed())
+		require.Nil(t, storage.Delete(inner, stored))
+		assert.False(t, listed())
+		_, err := store.Get(key)
+		assert.True(t, errors.Is(err, storage.ErrNotFound))
+		assert.Nil(t, storage.Delete(inner, stored))
+	})
 	t.Run("corresponding versioned store", func(t *testing.T) {
 		vs := storage.NewVersionedWrapper(store)
 		testVersionedStore(t, vs)
@@ -257,6 +315,29 @@ func testVersionedStore(t *testing.T, vs storage.VersionedStore) {
 		assert.EqualValues(t, 0, version)
 		assert.Equal(t, []byte("hello"), storedValue)
 	})
+	t.Run("list and delete keys", func(t *testing.T) {
+		// A wrapped store may not support listing.
+		if lister, ok := vs.(storage.Lister); !ok {
+			t.Skip()
+		} else if _, err := lister.List(nil); errors.Is(err, storage.ErrNotSupported) {
+			t.Skip()
+		}
+		// Short enough that the disk store lists it as it is.
+		key := randomKey()[:16]
+		require.Nil(t, vs.Put(0, key, []byte("hello")))
+		listed := func() (found bool) {
+			require.Nil(t, storage.ForEachKey(vs, func(k []byte) error {
+				found = found || bytes.Equal(k, key)
+				return nil
+			}))
+			return found
+		}
+		assert.True(t, listed())
+		require.Nil(t, storage.Delete(vs, key))
+		assert.False(t, listed())
+		_, _, err := vs.Get(key)
+		assert.True(t, errors.Is(err, storage.ErrNotFound))
+	})
 	t.Run("puts increase version number", func(t *testing.T) {
 		key := randomKey()
 		require.Nil(t, vs.Put(0, key, []byte("hello")))
@@ -0,0 +1,3 @@
+// Package tlsconfig builds the TLS configurations of the servers and their
+// clients from PEM files, as named in their configuration files.
+package tlsconfig // import "github.com/nicolagi/dino/tlsconfig"
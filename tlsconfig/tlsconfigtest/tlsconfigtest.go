@@ -0,0 +1,88 @@
+// Package tlsconfigtest generates certificates for tests of TLS clients and
+// servers.
+package tlsconfigtest // import "github.com/nicolagi/dino/tlsconfig/tlsconfigtest"
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// WriteFiles writes to dir a certificate authority (ca.pem), a certificate it
+// signed for localhost (server.pem and server.key), and one it signed for a
+// client named "glenda@plan9" (client.pem and client.key).
+func WriteFiles(dir string) error {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dino test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(dir, "ca.pem"), "CERTIFICATE", der); err != nil {
+		return err
+	}
+	leaves := []struct {
+		name  string
+		cert  *x509.Certificate
+		usage x509.ExtKeyUsage
+	}{
+		{"server", &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "localhost"},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		}, x509.ExtKeyUsageServerAuth},
+		{"client", &x509.Certificate{
+			SerialNumber: big.NewInt(3),
+			Subject:      pkix.Name{CommonName: "glenda@plan9"},
+		}, x509.ExtKeyUsageClientAuth},
+	}
+	for _, leaf := range leaves {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+		leaf.cert.NotBefore = ca.NotBefore
+		leaf.cert.NotAfter = ca.NotAfter
+		leaf.cert.KeyUsage = x509.KeyUsageDigitalSignature
+		leaf.cert.ExtKeyUsage = []x509.ExtKeyUsage{leaf.usage}
+		der, err := x509.CreateCertificate(rand.Reader, leaf.cert, ca, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+		if err := writePEM(filepath.Join(dir, leaf.name+".pem"), "CERTIFICATE", der); err != nil {
+			return err
+		}
+		b, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+		if err := writePEM(filepath.Join(dir, leaf.name+".key"), "EC PRIVATE KEY", b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePEM(pathname string, kind string, der []byte) error {
+	return ioutil.WriteFile(pathname, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600)
+}
@@ -0,0 +1,315 @@
+package volume
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// File is an open file or directory. Files returned by Open are read-only,
+// and those returned by Create are write-only.
+type File struct {
+	v    *FS
+	name string
+	node *node
+
+	// For reading regular files and symlinks.
+	reader *bytes.Reader
+
+	// For reading directories, loaded on the first call to ReadDir.
+	entries []fs.DirEntry
+	read    bool
+
+	// For writing, nil otherwise. The content is committed on Close.
+	buf *bytes.Buffer
+
+	closed bool
+}
+
+// Open implements fs.FS. Symlinks are not followed: reading one reads its
+// target.
+func (v *FS) Open(name string) (fs.File, error) {
+	n, err := v.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	f := &File{v: v, name: name, node: n}
+	if !n.IsDir() {
+		content, err := v.content(n)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		f.reader = bytes.NewReader(content)
+	}
+	return f, nil
+}
+
+// Stat implements fs.StatFS.
+func (v *FS) Stat(name string) (fs.FileInfo, error) {
+	n, err := v.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	info, err := v.info(name, n)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (v *FS) ReadFile(name string) ([]byte, error) {
+	n, err := v.lookup(name)
+	if err == nil && n.IsDir() {
+		err = syscall.EISDIR
+	}
+	var content []byte
+	if err == nil {
+		content, err = v.content(n)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return content, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (v *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := v.lookup(name)
+	if err == nil && !n.IsDir() {
+		err = syscall.ENOTDIR
+	}
+	var entries []fs.DirEntry
+	if err == nil {
+		entries, err = v.entries(n)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// Lookup returns the node at the given path. Unlike Stat, it doesn't need
+// to fetch the content.
+func (v *FS) Lookup(name string) (*NodeInfo, error) {
+	n, err := v.lookup(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lookup", Path: name, Err: err}
+	}
+	return n.info(), nil
+}
+
+// Readlink returns the target of the symlink.
+func (v *FS) Readlink(name string) (string, error) {
+	n, err := v.lookup(name)
+	if err == nil && n.Mode&ModeType != ModeSymlink {
+		err = fs.ErrInvalid
+	}
+	var target []byte
+	if err == nil {
+		target, err = v.content(n)
+	}
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return string(target), nil
+}
+
+// Loads the children of the directory, sorted by name.
+func (v *FS) entries(dir *node) ([]fs.DirEntry, error) {
+	names := make([]string, 0, len(dir.Children))
+	for name := range dir.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]fs.DirEntry, len(names))
+	for i, name := range names {
+		child, err := v.load(dir.Children[name])
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = &dirEntry{v: v, name: name, node: child}
+	}
+	return entries, nil
+}
+
+// Computes the size, which means fetching the content, unless it's inline.
+func (v *FS) info(name string, n *node) (*fileInfo, error) {
+	info := &fileInfo{name: path.Base(name), n: n.info()}
+	switch {
+	case n.IsDir():
+	case n.Inline:
+		info.size = int64(len(n.ContentKey))
+	default:
+		content, err := v.content(n)
+		if err != nil {
+			return nil, err
+		}
+		info.size = int64(len(content))
+	}
+	return info, nil
+}
+
+func (f *File) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: fs.ErrClosed}
+	}
+	switch {
+	case f.reader != nil:
+		return &fileInfo{name: path.Base(f.name), size: f.reader.Size(), n: f.node.info()}, nil
+	case f.buf != nil:
+		// The size of what will be committed on Close.
+		return &fileInfo{name: path.Base(f.name), size: int64(f.buf.Len()), n: f.node.info()}, nil
+	}
+	return f.v.info(f.name, f.node)
+}
+
+func (f *File) Read(p []byte) (int, error) {
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	return f.reader.Read(p)
+}
+
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	return f.reader.ReadAt(p, off)
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	if err := f.check("seek"); err != nil {
+		return 0, err
+	}
+	return f.reader.Seek(offset, whence)
+}
+
+// Returns an error unless the file can be read.
+func (f *File) check(op string) error {
+	switch {
+	case f.closed:
+		return &fs.PathError{Op: op, Path: f.name, Err: fs.ErrClosed}
+	case f.node.IsDir():
+		return &fs.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+	case f.reader == nil:
+		return &fs.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (f *File) ReadDir(n int) ([]fs.DirEntry, error) {
+	if f.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrClosed}
+	}
+	if !f.node.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	if !f.read {
+		entries, err := f.v.entries(f.node)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: err}
+		}
+		f.entries = entries
+		f.read = true
+	}
+	if n > 0 && len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n <= 0 || n > len(f.entries) {
+		n = len(f.entries)
+	}
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+// Write appends to the content to commit on Close. It only works for files
+// returned by Create.
+func (f *File) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: fs.ErrClosed}
+	}
+	if f.buf == nil {
+		return 0, &fs.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+	return f.buf.Write(p)
+}
+
+// Close commits the content written, if the file was returned by Create.
+func (f *File) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	if f.buf == nil {
+		return nil
+	}
+	if err := f.v.commitContent(f.node.key, f.buf.Bytes()); err != nil {
+		return &fs.PathError{Op: "close", Path: f.name, Err: err}
+	}
+	return nil
+}
+
+// NodeInfo is what the Sys method of the fs.FileInfo values returned by FS
+// returns.
+type NodeInfo struct {
+	Key     Key
+	Version uint64
+	Metadata
+}
+
+type fileInfo struct {
+	name string
+	size int64
+	n    *NodeInfo
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fileMode(fi.n.Mode) }
+func (fi *fileInfo) ModTime() time.Time { return fi.n.Time }
+func (fi *fileInfo) IsDir() bool        { return fi.n.IsDir() }
+func (fi *fileInfo) Sys() interface{}   { return fi.n }
+
+func fileMode(mode uint32) fs.FileMode {
+	m := fs.FileMode(mode & 0777)
+	switch mode & ModeType {
+	case ModeDir:
+		m |= fs.ModeDir
+	case ModeSymlink:
+		m |= fs.ModeSymlink
+	case ModeRegular:
+	default:
+		m |= fs.ModeIrregular
+	}
+	if mode&syscall.S_ISUID != 0 {
+		m |= fs.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= fs.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+type dirEntry struct {
+	v    *FS
+	name string
+	node *node
+}
+
+func (e *dirEntry) Name() string      { return e.name }
+func (e *dirEntry) IsDir() bool       { return e.node.IsDir() }
+func (e *dirEntry) Type() fs.FileMode { return fileMode(e.node.Mode).Type() }
+
+func (e *dirEntry) Info() (fs.FileInfo, error) {
+	return e.v.info(e.name, e.node)
+}
@@ -0,0 +1,329 @@
+package volume
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/nicolagi/dino/bits"
+)
+
+// KeyLen is the length of node keys.
+const KeyLen = 20
+
+// Key identifies a node in the metadata store. Keys are random, except for
+// the root's, which is all zeros.
+type Key [KeyLen]byte
+
+// RootKey is the key of the root directory.
+var RootKey Key
+
+// File types, as in the mode of stat(2).
+const (
+	ModeType    uint32 = 0170000
+	ModeDir     uint32 = 0040000
+	ModeRegular uint32 = 0100000
+	ModeSymlink uint32 = 0120000
+)
+
+// MaxInlineThreshold is the upper limit for inline thresholds, to keep
+// metadata values small.
+const MaxInlineThreshold = 16 << 10
+
+// ErrMalformed is returned when decoding metadata that's not in any known
+// format, e.g., because it's truncated.
+var ErrMalformed = errors.New("malformed node")
+
+// Encoded nodes start with this magic, followed by the format version and
+// a sequence of fields. Nodes encoded before the format was versioned start
+// with the user instead, and are unlikely to belong to a user with such a
+// large id.
+const formatMagic = "\xffdn\xff"
+
+// The version changes only for incompatible changes. Adding a field doesn't
+// need a new version, because clients skip (and preserve) unknown fields.
+const formatVersion uint8 = 1
+
+// Set in the legacy encoded mode of nodes whose content is inline.
+const legacyModeInline uint32 = 1 << 31
+
+// Field tags. Each field is encoded as its tag (one byte), the length of the
+// value (four bytes) and the value. Repeated fields are allowed.
+const (
+	fieldUser uint8 = iota + 1
+	fieldGroup
+	fieldMode
+	fieldTime
+	fieldContentKey
+	// Inline content, instead of a content key.
+	fieldContent
+	// One per extended attribute: the name (length-prefixed) and the value.
+	fieldXattr
+	// One per child: the node key and the name.
+	fieldChild
+	fieldOrigin
+)
+
+const fieldHeaderLen = 5
+
+var errUnknownField = errors.New("unknown field")
+
+// Metadata is what's stored about a node in the metadata store.
+type Metadata struct {
+	User  uint32
+	Group uint32
+	Mode  uint32
+	Time  time.Time
+
+	// Only makes sense for regular files or symlinks. If Inline is true,
+	// ContentKey is the content itself, rather than the key of the blob
+	// containing it.
+	ContentKey []byte
+	Inline     bool
+
+	Xattrs map[string][]byte
+
+	// Who last saved the node, e.g., "user@host", as set by the client; not
+	// necessarily the owner.
+	Origin string
+
+	// Only makes sense for directories, for which it's never nil once decoded.
+	Children map[string]Key
+
+	// Encoded fields this version doesn't know about, encoded back as they
+	// are, for the benefit of clients that know about them.
+	Unknown []byte
+}
+
+// IsDir tells whether the node is a directory.
+func (m *Metadata) IsDir() bool {
+	return m.Mode&ModeType == ModeDir
+}
+
+// Encode encodes the metadata in the current format.
+func (m *Metadata) Encode() []byte {
+	// Could use a pool of buffers, to be reused, instead of putting pressure on
+	// the GC.
+	size := len(formatMagic) + 1 + 4*fieldHeaderLen + 20
+	size += fieldHeaderLen + len(m.ContentKey)
+	for attr, value := range m.Xattrs {
+		size += fieldHeaderLen + 2 + len(attr) + len(value)
+	}
+	for name := range m.Children {
+		size += fieldHeaderLen + KeyLen + len(name)
+	}
+	if m.Origin != "" {
+		size += fieldHeaderLen + len(m.Origin)
+	}
+	size += len(m.Unknown)
+	buf := make([]byte, size)
+	b := buf
+	b = b[copy(b, formatMagic):]
+	b = bits.Put8(b, formatVersion)
+	b = bits.Put32(putFieldHeader(b, fieldUser, 4), m.User)
+	b = bits.Put32(putFieldHeader(b, fieldGroup, 4), m.Group)
+	b = bits.Put32(putFieldHeader(b, fieldMode, 4), m.Mode)
+	b = bits.Put64(putFieldHeader(b, fieldTime, 8), uint64(m.Time.UnixNano()))
+	tag := fieldContentKey
+	if m.Inline {
+		tag = fieldContent
+	}
+	b = putFieldHeader(b, tag, len(m.ContentKey))
+	b = b[copy(b, m.ContentKey):]
+	for attr, value := range m.Xattrs {
+		b = bits.Puts(putFieldHeader(b, fieldXattr, 2+len(attr)+len(value)), attr)
+		b = b[copy(b, value):]
+	}
+	for name, key := range m.Children {
+		b = putFieldHeader(b, fieldChild, KeyLen+len(name))
+		b = b[copy(b, key[:]):]
+		b = b[copy(b, name):]
+	}
+	if m.Origin != "" {
+		b = putFieldHeader(b, fieldOrigin, len(m.Origin))
+		b = b[copy(b, m.Origin):]
+	}
+	copy(b, m.Unknown)
+	return buf
+}
+
+func putFieldHeader(b []byte, tag uint8, n int) []byte {
+	return bits.Put32(bits.Put8(b, tag), uint32(n))
+}
+
+// Decode replaces the metadata with the encoded one, in the current or in
+// the legacy format. Nodes in the legacy format are upgraded to the current
+// one when encoded again.
+func (m *Metadata) Decode(b []byte) error {
+	*m = Metadata{}
+	if !bytes.HasPrefix(b, []byte(formatMagic)) {
+		return m.decodeLegacy(b)
+	}
+	b = b[len(formatMagic):]
+	if len(b) == 0 {
+		return ErrMalformed
+	}
+	var version uint8
+	version, b = bits.Get8(b)
+	if version != formatVersion {
+		return fmt.Errorf("unsupported node format version %d", version)
+	}
+	for len(b) > 0 {
+		if len(b) < fieldHeaderLen {
+			return ErrMalformed
+		}
+		var tag uint8
+		var n uint32
+		field := b
+		tag, b = bits.Get8(b)
+		n, b = bits.Get32(b)
+		if uint32(len(b)) < n {
+			return ErrMalformed
+		}
+		value := b[:n]
+		b = b[n:]
+		if err := m.setField(tag, value); err == errUnknownField {
+			m.Unknown = append(m.Unknown, field[:fieldHeaderLen+n]...)
+		} else if err != nil {
+			return err
+		}
+	}
+	if m.IsDir() && m.Children == nil {
+		m.Children = make(map[string]Key)
+	}
+	return nil
+}
+
+func (m *Metadata) setField(tag uint8, value []byte) error {
+	fixed := func(n int) error {
+		if len(value) != n {
+			return fmt.Errorf("field %d of length %d: %w", tag, len(value), ErrMalformed)
+		}
+		return nil
+	}
+	switch tag {
+	case fieldUser:
+		if err := fixed(4); err != nil {
+			return err
+		}
+		m.User, _ = bits.Get32(value)
+	case fieldGroup:
+		if err := fixed(4); err != nil {
+			return err
+		}
+		m.Group, _ = bits.Get32(value)
+	case fieldMode:
+		if err := fixed(4); err != nil {
+			return err
+		}
+		m.Mode, _ = bits.Get32(value)
+	case fieldTime:
+		if err := fixed(8); err != nil {
+			return err
+		}
+		unixnano, _ := bits.Get64(value)
+		m.Time = time.Unix(0, int64(unixnano))
+	case fieldContentKey, fieldContent:
+		m.ContentKey = dup(value)
+		m.Inline = tag == fieldContent
+	case fieldXattr:
+		if len(value) < 2 {
+			return ErrMalformed
+		}
+		n, rest := bits.Get16(value)
+		if len(rest) < int(n) {
+			return ErrMalformed
+		}
+		if m.Xattrs == nil {
+			m.Xattrs = make(map[string][]byte)
+		}
+		m.Xattrs[string(rest[:n])] = dup(rest[n:])
+	case fieldChild:
+		if len(value) < KeyLen {
+			return ErrMalformed
+		}
+		var key Key
+		copy(key[:], value)
+		if m.Children == nil {
+			m.Children = make(map[string]Key)
+		}
+		m.Children[string(value[KeyLen:])] = key
+	case fieldOrigin:
+		m.Origin = string(value)
+	default:
+		return errUnknownField
+	}
+	return nil
+}
+
+// Decodes nodes encoded before the format was versioned.
+func (m *Metadata) decodeLegacy(b []byte) (err error) {
+	defer func() {
+		// The bits package doesn't check bounds.
+		if r := recover(); r != nil {
+			err = ErrMalformed
+		}
+	}()
+	m.User, b = bits.Get32(b)
+	m.Group, b = bits.Get32(b)
+	m.Mode, b = bits.Get32(b)
+	var unixnano uint64
+	unixnano, b = bits.Get64(b)
+	m.Time = time.Unix(0, int64(unixnano))
+	m.ContentKey, b = bits.Getb(b)
+	if m.Mode&legacyModeInline != 0 {
+		m.Mode &^= legacyModeInline
+		m.Inline = true
+	}
+	if m.IsDir() {
+		m.Children = make(map[string]Key)
+	}
+	var nxattr uint16
+	nxattr, b = bits.Get16(b)
+	if nxattr > 0 {
+		m.Xattrs = make(map[string][]byte)
+	}
+	for ; nxattr > 0; nxattr-- {
+		var attr string
+		var value []byte
+		attr, b = bits.Gets(b)
+		value, b = bits.Getb(b)
+		m.Xattrs[attr] = value
+	}
+	for len(b) > 0 {
+		var name string
+		var key []byte
+		name, b = bits.Gets(b)
+		key, b = bits.Getb(b)
+		var k Key
+		copy(k[:], key)
+		m.Children[name] = k
+	}
+	return nil
+}
+
+// DefaultOrigin identifies the current user and host, as "user@host".
+func DefaultOrigin() string {
+	name := strconv.Itoa(os.Getuid())
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return name + "@" + host
+}
+
+func dup(p []byte) []byte {
+	if p == nil {
+		return nil
+	}
+	q := make([]byte, len(p))
+	copy(q, p)
+	return q
+}
@@ -0,0 +1,122 @@
+package volume_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nicolagi/dino/bits"
+	"github.com/nicolagi/dino/volume"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Encodes the metadata as before the format was versioned.
+func encodeLegacy(m *volume.Metadata) []byte {
+	size := 24 + len(m.ContentKey)
+	for attr, value := range m.Xattrs {
+		size += 4 + len(attr) + len(value)
+	}
+	for name := range m.Children {
+		size += 4 + volume.KeyLen + len(name)
+	}
+	mode := m.Mode
+	if m.Inline {
+		mode |= 1 << 31
+	}
+	buf := make([]byte, size)
+	b := buf
+	b = bits.Put32(b, m.User)
+	b = bits.Put32(b, m.Group)
+	b = bits.Put32(b, mode)
+	b = bits.Put64(b, uint64(m.Time.UnixNano()))
+	b = bits.Putb(b, m.ContentKey)
+	b = bits.Put16(b, uint16(len(m.Xattrs)))
+	for attr, value := range m.Xattrs {
+		b = bits.Puts(b, attr)
+		b = bits.Putb(b, value)
+	}
+	for name, key := range m.Children {
+		b = bits.Puts(b, name)
+		b = bits.Putb(b, key[:])
+	}
+	return buf
+}
+
+func TestMetadataFormat(t *testing.T) {
+	dir := &volume.Metadata{
+		User:     1000,
+		Group:    100,
+		Mode:     volume.ModeDir | 0755,
+		Time:     time.Unix(0, 1234567890),
+		Xattrs:   map[string][]byte{"user.color": []byte("blue")},
+		Children: map[string]volume.Key{"child": {1, 2, 3}},
+		Origin:   "glenda@plan9",
+	}
+	check := func(t *testing.T, got *volume.Metadata) {
+		assert.Equal(t, dir.User, got.User)
+		assert.Equal(t, dir.Group, got.Group)
+		assert.Equal(t, dir.Mode, got.Mode)
+		assert.Equal(t, dir.Time.UnixNano(), got.Time.UnixNano())
+		assert.Equal(t, dir.Xattrs, got.Xattrs)
+		assert.Equal(t, dir.Children, got.Children)
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		var got volume.Metadata
+		require.Nil(t, got.Decode(dir.Encode()))
+		check(t, &got)
+		assert.True(t, got.IsDir())
+		assert.Equal(t, dir.Origin, got.Origin)
+	})
+	t.Run("legacy nodes are decoded, and upgraded when encoded", func(t *testing.T) {
+		var got volume.Metadata
+		require.Nil(t, got.Decode(encodeLegacy(dir)))
+		check(t, &got)
+		var again volume.Metadata
+		require.Nil(t, again.Decode(got.Encode()))
+		check(t, &again)
+	})
+	t.Run("unknown fields are preserved", func(t *testing.T) {
+		unknown := []byte{200, 3, 0, 0, 0, 'n', 'e', 'w'}
+		var got volume.Metadata
+		require.Nil(t, got.Decode(append(dir.Encode(), unknown...)))
+		check(t, &got)
+		assert.Equal(t, unknown, got.Unknown)
+		var again volume.Metadata
+		require.Nil(t, again.Decode(got.Encode()))
+		check(t, &again)
+		assert.Equal(t, unknown, again.Unknown)
+	})
+	t.Run("inline content", func(t *testing.T) {
+		file := &volume.Metadata{Mode: volume.ModeRegular | 0644, ContentKey: []byte("tiny"), Inline: true}
+		for _, b := range [][]byte{file.Encode(), encodeLegacy(file)} {
+			var got volume.Metadata
+			require.Nil(t, got.Decode(b))
+			assert.True(t, got.Inline)
+			assert.Equal(t, []byte("tiny"), got.ContentKey)
+			assert.Equal(t, file.Mode, got.Mode)
+		}
+	})
+	t.Run("directories always have children", func(t *testing.T) {
+		empty := &volume.Metadata{Mode: volume.ModeDir | 0755}
+		var got volume.Metadata
+		require.Nil(t, got.Decode(empty.Encode()))
+		assert.NotNil(t, got.Children)
+	})
+	t.Run("malformed nodes are rejected", func(t *testing.T) {
+		b := dir.Encode()
+		for _, bad := range [][]byte{
+			b[:len(b)-1],
+			b[:7],
+			encodeLegacy(dir)[:10],
+		} {
+			var got volume.Metadata
+			assert.True(t, errors.Is(got.Decode(bad), volume.ErrMalformed))
+		}
+		var got volume.Metadata
+		err := got.Decode(append(b[:4:4], 2))
+		assert.NotNil(t, err)
+		assert.False(t, errors.Is(err, volume.ErrMalformed))
+	})
+}
@@ -0,0 +1,199 @@
+package volume
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nicolagi/dino/storage"
+)
+
+// The methods in this file address nodes by key, and directory entries by the
+// key of their directory and their name, rather than by path. They're for
+// servers whose clients hold on to files, e.g., dino9p's fids, which should
+// keep referring to the same node while other clients rename it. A node that
+// another client removed remains accessible by key, as unlinking doesn't
+// delete it.
+
+// LookupKey returns the node with the given key.
+func (v *FS) LookupKey(key Key) (*NodeInfo, error) {
+	n, err := v.loadKey(key)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lookup", Path: keyPath(key), Err: err}
+	}
+	return n.info(), nil
+}
+
+// LookupChild returns the named child of the directory with the given key.
+func (v *FS) LookupChild(dir Key, name string) (*NodeInfo, error) {
+	n, err := v.child(dir, name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lookup", Path: name, Err: err}
+	}
+	return n.info(), nil
+}
+
+// StatKey is like Stat, for the node with the given key, which the returned
+// fs.FileInfo calls name.
+func (v *FS) StatKey(key Key, name string) (fs.FileInfo, error) {
+	n, err := v.loadKey(key)
+	var info *fileInfo
+	if err == nil {
+		info, err = v.info(name, n)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+// ReadFileKey is like ReadFile, for the node with the given key.
+func (v *FS) ReadFileKey(key Key) ([]byte, error) {
+	n, err := v.loadKey(key)
+	if err == nil && n.IsDir() {
+		err = syscall.EISDIR
+	}
+	var content []byte
+	if err == nil {
+		content, err = v.content(n)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: keyPath(key), Err: err}
+	}
+	return content, nil
+}
+
+// ReadDirKey is like ReadDir, for the directory with the given key.
+func (v *FS) ReadDirKey(key Key) ([]fs.DirEntry, error) {
+	n, err := v.loadKey(key)
+	if err == nil && !n.IsDir() {
+		err = syscall.ENOTDIR
+	}
+	var entries []fs.DirEntry
+	if err == nil {
+		entries, err = v.entries(n)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: keyPath(key), Err: err}
+	}
+	return entries, nil
+}
+
+// WriteFileKey replaces the content of the regular file with the given key.
+func (v *FS) WriteFileKey(key Key, data []byte) error {
+	n, err := v.loadKey(key)
+	if err == nil && n.Mode&ModeType != ModeRegular {
+		err = fs.ErrInvalid
+	}
+	if err == nil {
+		err = v.commitContent(key, data)
+	}
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: keyPath(key), Err: err}
+	}
+	return nil
+}
+
+// ChmodKey is like Chmod, for the node with the given key.
+func (v *FS) ChmodKey(key Key, mode fs.FileMode) error {
+	return v.update("chmod", keyPath(key), v.keyLoader(key), chmod(mode))
+}
+
+// ChtimesKey is like Chtimes, for the node with the given key.
+func (v *FS) ChtimesKey(key Key, mtime time.Time) error {
+	return v.update("chtimes", keyPath(key), v.keyLoader(key), chtimes(mtime))
+}
+
+// CreateChild creates the named child of the directory with the given key,
+// an empty regular file or directory, depending on mode, which must not
+// exist.
+func (v *FS) CreateChild(dir Key, name string, mode uint32) (*NodeInfo, error) {
+	if t := mode & ModeType; t != ModeRegular && t != ModeDir {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	n, err := v.create("create", name, v.childLocator(dir, name), mode, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(), nil
+}
+
+// RemoveChild removes the named child of the directory with the given key,
+// as long as it's still the node with the given key.
+func (v *FS) RemoveChild(dir Key, name string, key Key) error {
+	if err := v.remove(v.childLocator(dir, name), &key); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+// RenameChild renames the named child of the directory with the given key, as
+// long as it's still the node with the given key. As with Rename, newname is
+// replaced if it exists.
+func (v *FS) RenameChild(dir Key, oldname, newname string, key Key) error {
+	var err error
+	if oldname == newname {
+		var n *node
+		if n, err = v.child(dir, oldname); err == nil && n.key != key {
+			err = fs.ErrNotExist
+		}
+	} else {
+		err = v.move(v.childLocator(dir, oldname), v.childLocator(dir, newname), &key)
+	}
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldname, Err: err}
+	}
+	return nil
+}
+
+// Like load, but a missing node doesn't exist, rather than being an empty
+// file system.
+func (v *FS) loadKey(key Key) (*node, error) {
+	n, err := v.load(key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, fs.ErrNotExist
+	}
+	return n, err
+}
+
+func (v *FS) keyLoader(key Key) func() (*node, error) {
+	return func() (*node, error) {
+		return v.loadKey(key)
+	}
+}
+
+func (v *FS) childLocator(dir Key, name string) locator {
+	return func() (*node, string, error) {
+		if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+			return nil, "", fs.ErrInvalid
+		}
+		n, err := v.loadKey(dir)
+		if err != nil {
+			return nil, "", err
+		}
+		if !n.IsDir() {
+			return nil, "", syscall.ENOTDIR
+		}
+		return n, name, nil
+	}
+}
+
+func (v *FS) child(dir Key, name string) (*node, error) {
+	parent, base, err := v.childLocator(dir, name)()
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parent.Children[base]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return v.loadKey(key)
+}
+
+// Used in errors, in place of a path.
+func keyPath(key Key) string {
+	return fmt.Sprintf("%x", key[:])
+}
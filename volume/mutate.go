@@ -0,0 +1,369 @@
+package volume
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nicolagi/dino/storage"
+)
+
+// Create creates the named regular file, unless it exists already, and
+// returns it for writing. The content written replaces the file's content
+// when the file is closed, not before.
+func (v *FS) Create(name string, perm fs.FileMode) (*File, error) {
+	n, err := v.create("create", name, v.pathLocator(name), ModeRegular|uint32(perm.Perm()), nil, true)
+	if err != nil {
+		return nil, err
+	}
+	return &File{v: v, name: name, node: n, buf: new(bytes.Buffer)}, nil
+}
+
+// WriteFile writes the content to the named file, creating it if necessary.
+func (v *FS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	f, err := v.Create(name, perm)
+	if err != nil {
+		return err
+	}
+	_, _ = f.Write(data)
+	return f.Close()
+}
+
+// Mkdir creates the named directory, which must not exist.
+func (v *FS) Mkdir(name string, perm fs.FileMode) error {
+	_, err := v.create("mkdir", name, v.pathLocator(name), ModeDir|uint32(perm.Perm()), nil, false)
+	return err
+}
+
+// Symlink creates newname as a symlink to oldname.
+func (v *FS) Symlink(oldname, newname string) error {
+	_, err := v.create("symlink", newname, v.pathLocator(newname), ModeSymlink|0777, []byte(oldname), false)
+	return err
+}
+
+// Locates a directory entry, returning the directory, loaded anew, and the
+// entry's name. Mutations call it again at each attempt.
+type locator func() (dir *node, base string, err error)
+
+func (v *FS) pathLocator(name string) locator {
+	return func() (*node, string, error) {
+		return v.lookupParent(name)
+	}
+}
+
+// Creates a node with the given mode and content, and links it into its
+// parent. If the name exists already, and reuse is true, returns the existing
+// node, as long as it's a regular file. The name is only used for errors.
+func (v *FS) create(op string, name string, locate locator, mode uint32, content []byte, reuse bool) (*node, error) {
+	child, err := v.newNode(mode)
+	if err == nil && content != nil {
+		err = v.StoreContent(&child.Metadata, content)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	// The child is saved once, and only linking it is retried.
+	saved := false
+	var result *node
+	err = v.retry(func() error {
+		parent, base, err := locate()
+		if err != nil {
+			return err
+		}
+		if key, ok := parent.Children[base]; ok {
+			if !reuse {
+				return fs.ErrExist
+			}
+			existing, err := v.load(key)
+			if err != nil {
+				return err
+			}
+			switch existing.Mode & ModeType {
+			case ModeRegular:
+				result = existing
+				return nil
+			case ModeDir:
+				return syscall.EISDIR
+			default:
+				return fs.ErrExist
+			}
+		}
+		if !saved {
+			if err := v.CheckQuota(child.User, int64(len(content)), 1); err != nil {
+				return err
+			}
+			if err := v.save(child); err != nil {
+				return err
+			}
+			saved = true
+		}
+		parent.Children[base] = child.key
+		parent.Time = time.Now()
+		if err := v.save(parent); err != nil {
+			return err
+		}
+		result = child
+		return nil
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if result == child {
+		v.Charge(child.User, int64(len(content)), 1)
+	}
+	return result, nil
+}
+
+// Replaces the content of the node with the given key.
+func (v *FS) commitContent(key Key, content []byte) error {
+	var stored Metadata
+	if err := v.StoreContent(&stored, content); err != nil {
+		return err
+	}
+	var user uint32
+	var grown int64
+	err := v.retry(func() error {
+		n, err := v.load(key)
+		if err != nil {
+			return err
+		}
+		if v.opts.quotas != nil {
+			used, err := v.Usage(&n.Metadata)
+			if err != nil {
+				return err
+			}
+			user, grown = n.User, int64(len(content))-used
+			if err := v.CheckQuota(user, grown, 0); err != nil {
+				return err
+			}
+		}
+		n.ContentKey = stored.ContentKey
+		n.Inline = stored.Inline
+		n.Time = time.Now()
+		return v.save(n)
+	})
+	if err == nil {
+		v.Charge(user, grown, 0)
+	}
+	return err
+}
+
+// Chmod changes the permission bits of the named file.
+func (v *FS) Chmod(name string, mode fs.FileMode) error {
+	return v.update("chmod", name, v.pathLoader(name), chmod(mode))
+}
+
+// Returns the change that sets the mode of a node.
+func chmod(mode fs.FileMode) func(*node) {
+	return func(n *node) {
+		n.Mode = n.Mode&^07777 | uint32(mode.Perm())
+		if mode&fs.ModeSetuid != 0 {
+			n.Mode |= syscall.S_ISUID
+		}
+		if mode&fs.ModeSetgid != 0 {
+			n.Mode |= syscall.S_ISGID
+		}
+		if mode&fs.ModeSticky != 0 {
+			n.Mode |= syscall.S_ISVTX
+		}
+	}
+}
+
+// Chtimes changes the modification time of the named file. Nodes have no
+// access time.
+func (v *FS) Chtimes(name string, mtime time.Time) error {
+	return v.update("chtimes", name, v.pathLoader(name), chtimes(mtime))
+}
+
+// Returns the change that sets the modification time of a node.
+func chtimes(mtime time.Time) func(*node) {
+	return func(n *node) {
+		n.Time = mtime
+	}
+}
+
+func (v *FS) pathLoader(name string) func() (*node, error) {
+	return func() (*node, error) {
+		return v.lookup(name)
+	}
+}
+
+// Applies the change to the node returned by load, and saves it. The name is
+// only used for errors.
+func (v *FS) update(op string, name string, load func() (*node, error), change func(*node)) error {
+	err := v.retry(func() error {
+		n, err := load()
+		if err != nil {
+			return err
+		}
+		change(n)
+		return v.save(n)
+	})
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return nil
+}
+
+// Remove removes the named file or empty directory.
+func (v *FS) Remove(name string) error {
+	if err := v.remove(v.pathLocator(name), nil); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Unlinks the located entry, failing with fs.ErrNotExist if expected is not
+// nil and the entry doesn't refer to that node.
+func (v *FS) remove(locate locator, expected *Key) error {
+	var removed *node
+	err := v.retry(func() error {
+		parent, base, err := locate()
+		if err != nil {
+			return err
+		}
+		key, ok := parent.Children[base]
+		if !ok || expected != nil && key != *expected {
+			return fs.ErrNotExist
+		}
+		// A child whose node is missing can be unlinked all the same.
+		child, err := v.load(key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+		if child != nil && child.IsDir() && len(child.Children) > 0 {
+			return syscall.ENOTEMPTY
+		}
+		delete(parent.Children, base)
+		parent.Time = time.Now()
+		removed = child
+		return v.save(parent)
+	})
+	if err == nil && removed != nil {
+		v.discharge(removed)
+	}
+	return err
+}
+
+// RemoveAll removes the named file, or directory and its descendants. Unlike
+// os.RemoveAll, it fails if the name doesn't exist. It isn't atomic: if it
+// fails, some descendants may have been removed.
+func (v *FS) RemoveAll(name string) error {
+	n, err := v.lookup(name)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if n.IsDir() {
+		for base := range n.Children {
+			if err := v.RemoveAll(path.Join(name, base)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return v.Remove(name)
+}
+
+// Rename moves oldname to newname, replacing newname if it exists, as long as
+// both are directories (in which case newname must be empty) or neither is.
+func (v *FS) Rename(oldname, newname string) error {
+	err := v.rename(oldname, newname)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (v *FS) rename(oldname, newname string) error {
+	if !fs.ValidPath(newname) || newname == "." || strings.HasPrefix(newname, oldname+"/") {
+		return fs.ErrInvalid
+	}
+	if oldname == newname {
+		_, err := v.lookup(oldname)
+		return err
+	}
+	return v.move(v.pathLocator(oldname), v.pathLocator(newname), nil)
+}
+
+// Moves the entry located by from to the one located by to, which must be
+// different, failing with fs.ErrNotExist if expected is not nil and the entry
+// doesn't refer to that node.
+func (v *FS) move(from, to locator, expected *Key) error {
+	var replaced *node
+	err := v.retry(func() error {
+		replaced = nil
+		oldParent, oldBase, err := from()
+		if err != nil {
+			return err
+		}
+		key, ok := oldParent.Children[oldBase]
+		if !ok || expected != nil && key != *expected {
+			return fs.ErrNotExist
+		}
+		newParent, newBase, err := to()
+		if err != nil {
+			return err
+		}
+		if newParent.key == oldParent.key {
+			newParent = oldParent
+		}
+		if r, ok := newParent.Children[newBase]; ok && r != key {
+			if replaced, err = v.checkReplace(key, r); err != nil {
+				return err
+			}
+		}
+		now := time.Now()
+		newParent.Children[newBase] = key
+		newParent.Time = now
+		if newParent != oldParent {
+			// If saving the old parent fails, retrying finds the child linked
+			// in both parents, and completes the move.
+			if err := v.save(newParent); err != nil {
+				return err
+			}
+		}
+		delete(oldParent.Children, oldBase)
+		oldParent.Time = now
+		return v.save(oldParent)
+	})
+	if err == nil && replaced != nil {
+		v.discharge(replaced)
+	}
+	return err
+}
+
+// Returns the node that moving the first over the second would replace, if
+// that's allowed.
+func (v *FS) checkReplace(moved, replaced Key) (*node, error) {
+	m, err := v.load(moved)
+	if err != nil {
+		return nil, err
+	}
+	r, err := v.load(replaced)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckReplace(&m.Metadata, &r.Metadata); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// CheckReplace returns the syscall.Errno for moving a node over another, or
+// nil if that's allowed: both must be directories, the replaced one empty, or
+// neither.
+func CheckReplace(moved, replaced *Metadata) error {
+	switch {
+	case replaced.IsDir() && !moved.IsDir():
+		return syscall.EISDIR
+	case !replaced.IsDir() && moved.IsDir():
+		return syscall.ENOTDIR
+	case replaced.IsDir() && len(replaced.Children) > 0:
+		return syscall.ENOTEMPTY
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package volume
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/nicolagi/dino/quota"
+	log "github.com/sirupsen/logrus"
+)
+
+// WithQuotas makes the file system charge the owners of nodes, and the
+// volume, for the nodes it creates and the contents it writes, and refund
+// them for those it removes, as dinofs does with quotas enabled. Mutations
+// that would exceed the limits fail with syscall.EDQUOT.
+func WithQuotas(value *quota.Tracker) Option {
+	return func(o *options) {
+		o.quotas = value
+	}
+}
+
+// Usage returns the number of bytes charged for a node's content, its size,
+// which means fetching it, unless it's inline.
+func (v *FS) Usage(m *Metadata) (int64, error) {
+	if m.Inline || len(m.ContentKey) == 0 {
+		return int64(len(m.ContentKey)), nil
+	}
+	content, err := v.blobs.Get(m.ContentKey)
+	return int64(len(content)), err
+}
+
+// CheckQuota fails with syscall.EDQUOT if charging the given user and the
+// volume for the given amounts would exceed their limits.
+func (v *FS) CheckQuota(user uint32, bytes, inodes int64) error {
+	q := v.opts.quotas
+	if q == nil {
+		return nil
+	}
+	for _, s := range []quota.Subject{quota.User(user), quota.Volume} {
+		err := q.Check(s, bytes, inodes)
+		if errors.Is(err, quota.ErrExceeded) {
+			return syscall.EDQUOT
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Charge charges the given user and the volume for the given amounts, which
+// can be negative, after the mutation that uses them has been committed. As
+// there's nothing to roll back, failures are only logged, and the counters will
+// be a bit off.
+func (v *FS) Charge(user uint32, bytes, inodes int64) {
+	q := v.opts.quotas
+	if q == nil {
+		return
+	}
+	err := q.Charge(quota.User(user), bytes, inodes)
+	if err == nil {
+		err = q.Charge(quota.Volume, bytes, inodes)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"user":   user,
+			"bytes":  bytes,
+			"inodes": inodes,
+			"err":    err,
+		}).Warn("Could not update quota usage")
+	}
+}
+
+// Refunds the owner of the removed node, and the volume.
+func (v *FS) discharge(n *node) {
+	if v.opts.quotas == nil {
+		return
+	}
+	bytes, err := v.Usage(&n.Metadata)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"key": fmt.Sprintf("%.10x", n.key[:]),
+			"err": err,
+		}).Warn("Could not determine quota usage")
+	}
+	v.Charge(n.User, -bytes, -1)
+}
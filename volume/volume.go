@@ -0,0 +1,258 @@
+// Package volume gives access to dino file systems without mounting them, on
+// top of any metadata store and blob store, e.g., those used by dinofs.
+//
+// FS implements io/fs.FS, and the other interfaces of io/fs, for reading, and
+// has methods to create, write, rename and remove files. Unlike dinofs, it
+// doesn't cache anything: each operation loads the nodes it needs, and each
+// mutation is committed right away, and retried if another client changed the
+// same nodes meanwhile. Mutations charge quotas only if configured to, see
+// WithQuotas.
+//
+// Clients that keep nodes of their own, as dinofs keeps its tree of cached
+// nodes, store contents, save nodes, check renames and charge quotas through
+// StoreContent, Save, CheckReplace, Usage, CheckQuota and Charge, which FS's
+// own mutations use too, so that all clients treat and account for nodes the
+// same way.
+package volume
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nicolagi/dino/quota"
+	"github.com/nicolagi/dino/storage"
+)
+
+// How many times a mutation is attempted, if other clients keep changing the
+// same nodes.
+const maxCommitAttempts = 3
+
+type options struct {
+	inlineThreshold int
+	user            uint32
+	group           uint32
+	origin          string
+	quotas          *quota.Tracker
+}
+
+type Option func(*options)
+
+// WithInlineThreshold makes contents smaller than the given number of bytes
+// be stored in the metadata of their nodes, rather than as blobs. It should be
+// at most MaxInlineThreshold.
+func WithInlineThreshold(value int) Option {
+	return func(o *options) {
+		o.inlineThreshold = value
+	}
+}
+
+// WithOwner sets the owner of the nodes created, which is the current
+// process's by default.
+func WithOwner(user, group uint32) Option {
+	return func(o *options) {
+		o.user = user
+		o.group = group
+	}
+}
+
+// WithOrigin sets what identifies this client in the nodes it saves, which
+// is DefaultOrigin() by default.
+func WithOrigin(value string) Option {
+	return func(o *options) {
+		o.origin = value
+	}
+}
+
+// FS is a dino file system. It's safe for concurrent use, if the stores are.
+type FS struct {
+	metadata storage.VersionedStore
+	blobs    storage.BlobStore
+	opts     options
+}
+
+// New returns the file system whose nodes are in the given metadata store,
+// and whose contents are in the given blob store.
+func New(metadata storage.VersionedStore, blobs storage.BlobStore, opts ...Option) *FS {
+	v := &FS{
+		metadata: metadata,
+		blobs:    blobs,
+		opts: options{
+			user:   uint32(os.Getuid()),
+			group:  uint32(os.Getgid()),
+			origin: DefaultOrigin(),
+		},
+	}
+	for _, o := range opts {
+		o(&v.opts)
+	}
+	return v
+}
+
+// A node as loaded from the metadata store.
+type node struct {
+	key     Key
+	version uint64
+	Metadata
+}
+
+func (n *node) info() *NodeInfo {
+	return &NodeInfo{Key: n.key, Version: n.version, Metadata: n.Metadata}
+}
+
+func (v *FS) load(key Key) (*node, error) {
+	version, b, err := v.metadata.Get(key[:])
+	if errors.Is(err, storage.ErrNotFound) && key == RootKey {
+		// An empty file system.
+		return &node{
+			Metadata: Metadata{
+				Mode:     ModeDir | 0755,
+				Children: make(map[string]Key),
+			},
+		}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	n := &node{key: key, version: version}
+	if err := n.Decode(b); err != nil {
+		return nil, fmt.Errorf("node %x version %d: %w", key, version, err)
+	}
+	return n, nil
+}
+
+// Save puts the node in the metadata store, as the version following its own,
+// failing with storage.ErrStalePut if another client saved that version first.
+// On success, it increments the node's version.
+func (v *FS) Save(n *NodeInfo) error {
+	n.Origin = v.opts.origin
+	if err := v.metadata.Put(n.Version+1, n.Key[:], n.Encode()); err != nil {
+		return err
+	}
+	n.Version++
+	return nil
+}
+
+// Saves the node, failing with storage.ErrStalePut if it changed since it was
+// loaded.
+func (v *FS) save(n *node) error {
+	info := n.info()
+	if err := v.Save(info); err != nil {
+		return err
+	}
+	n.version, n.Origin = info.Version, info.Origin
+	return nil
+}
+
+// Makes a node, not saved yet.
+func (v *FS) newNode(mode uint32) (*node, error) {
+	n := &node{
+		Metadata: Metadata{
+			User:  v.opts.user,
+			Group: v.opts.group,
+			Mode:  mode,
+			Time:  time.Now(),
+		},
+	}
+	if _, err := rand.Read(n.key[:]); err != nil {
+		return nil, err
+	}
+	if n.IsDir() {
+		n.Children = make(map[string]Key)
+	}
+	return n, nil
+}
+
+// Runs the mutation again, from scratch, while it fails because other clients
+// changed the same nodes meanwhile.
+func (v *FS) retry(mutation func() error) (err error) {
+	for attempt := 0; attempt < maxCommitAttempts; attempt++ {
+		if err = mutation(); !errors.Is(err, storage.ErrStalePut) {
+			return err
+		}
+	}
+	return err
+}
+
+// Loads the node at the given path, which must be valid as per fs.ValidPath.
+func (v *FS) lookup(name string) (*node, error) {
+	if !fs.ValidPath(name) {
+		return nil, fs.ErrInvalid
+	}
+	n, err := v.load(RootKey)
+	if err != nil || name == "." {
+		return n, err
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if !n.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+		key, ok := n.Children[elem]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		if n, err = v.load(key); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// Loads the directory containing the node at the given path, and returns it
+// with the last element of the path.
+func (v *FS) lookupParent(name string) (dir *node, base string, err error) {
+	if !fs.ValidPath(name) || name == "." {
+		return nil, "", fs.ErrInvalid
+	}
+	dirname, base := path.Split(name)
+	if dirname == "" {
+		dirname = "."
+	}
+	if dir, err = v.lookup(strings.TrimSuffix(dirname, "/")); err != nil {
+		return nil, "", err
+	}
+	if !dir.IsDir() {
+		return nil, "", syscall.ENOTDIR
+	}
+	return dir, base, nil
+}
+
+// Returns a copy of the content, which the caller can modify, as stores may
+// return their own.
+func (v *FS) content(n *node) ([]byte, error) {
+	if n.Inline {
+		return dup(n.ContentKey), nil
+	}
+	if len(n.ContentKey) == 0 {
+		return nil, nil
+	}
+	b, err := v.blobs.Get(n.ContentKey)
+	if err != nil {
+		return nil, err
+	}
+	return dup(b), nil
+}
+
+// StoreContent stores the content, inline in the given metadata, if smaller
+// than the inline threshold, or as a blob, whose key it sets in the metadata.
+// It doesn't save the node.
+func (v *FS) StoreContent(m *Metadata, content []byte) error {
+	if len(content) < v.opts.inlineThreshold {
+		m.ContentKey = dup(content)
+		m.Inline = true
+		return nil
+	}
+	key, err := v.blobs.Put(content)
+	if err != nil {
+		return err
+	}
+	m.ContentKey = key
+	m.Inline = false
+	return nil
+}
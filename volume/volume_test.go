@@ -0,0 +1,216 @@
+package volume_test
+
+import (
+	"errors"
+	"io/fs"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/nicolagi/dino/quota"
+	"github.com/nicolagi/dino/storage"
+	"github.com/nicolagi/dino/volume"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFS(t *testing.T) {
+	metadata := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	blobs := storage.NewBlobStore(storage.NewInMemoryStore())
+	v := volume.New(metadata, blobs, volume.WithInlineThreshold(8), volume.WithOwner(1000, 100))
+
+	require.Nil(t, v.Mkdir("a", 0755))
+	require.Nil(t, v.Mkdir("a/b", 0700))
+	require.Nil(t, v.WriteFile("a/b/tiny", []byte("inline"), 0644))
+	require.Nil(t, v.WriteFile("a/large", []byte("stored as a blob"), 0600))
+	require.Nil(t, v.Symlink("b/tiny", "a/link"))
+	require.Nil(t, v.WriteFile("empty", nil, 0644))
+
+	t.Run("io/fs conformance", func(t *testing.T) {
+		assert.Nil(t, fstest.TestFS(v, "a/b/tiny", "a/large", "a/link", "empty"))
+	})
+	t.Run("reading", func(t *testing.T) {
+		content, err := v.ReadFile("a/large")
+		require.Nil(t, err)
+		assert.Equal(t, "stored as a blob", string(content))
+		target, err := v.Readlink("a/link")
+		require.Nil(t, err)
+		assert.Equal(t, "b/tiny", target)
+		info, err := v.Stat("a/b")
+		require.Nil(t, err)
+		assert.Equal(t, fs.ModeDir|0700, info.Mode())
+		info, err = v.Stat("a/link")
+		require.Nil(t, err)
+		assert.Equal(t, fs.ModeSymlink, info.Mode().Type())
+		m := info.Sys().(*volume.NodeInfo)
+		assert.Equal(t, uint32(1000), m.User)
+		assert.Equal(t, uint32(100), m.Group)
+	})
+	t.Run("errors", func(t *testing.T) {
+		_, err := v.ReadFile("a/missing")
+		assert.True(t, errors.Is(err, fs.ErrNotExist))
+		_, err = v.ReadFile("a/large/child")
+		assert.True(t, errors.Is(err, syscall.ENOTDIR))
+		_, err = v.ReadFile("a")
+		assert.True(t, errors.Is(err, syscall.EISDIR))
+		assert.True(t, errors.Is(v.Mkdir("a", 0755), fs.ErrExist))
+		assert.True(t, errors.Is(v.Remove("a"), syscall.ENOTEMPTY))
+		assert.True(t, errors.Is(v.Rename("a", "a/b/c"), fs.ErrInvalid))
+		assert.True(t, errors.Is(v.Rename("a/large", "a/b"), syscall.EISDIR))
+		assert.True(t, errors.Is(v.Rename("a/b", "a/large"), syscall.ENOTDIR))
+		_, err = v.Create("a/b", 0644)
+		assert.True(t, errors.Is(err, syscall.EISDIR))
+		_, err = v.Open("/a")
+		assert.True(t, errors.Is(err, fs.ErrInvalid))
+	})
+	t.Run("overwriting", func(t *testing.T) {
+		f, err := v.Create("empty", 0644)
+		require.Nil(t, err)
+		_, err = f.Write([]byte("not "))
+		require.Nil(t, err)
+		// Not committed until closed.
+		content, err := v.ReadFile("empty")
+		require.Nil(t, err)
+		assert.Empty(t, content)
+		_, err = f.Write([]byte("empty any more"))
+		require.Nil(t, err)
+		require.Nil(t, f.Close())
+		content, err = v.ReadFile("empty")
+		require.Nil(t, err)
+		assert.Equal(t, "not empty any more", string(content))
+		assert.True(t, errors.Is(f.Close(), fs.ErrClosed))
+	})
+	t.Run("renaming and removing", func(t *testing.T) {
+		require.Nil(t, v.Rename("a/b/tiny", "renamed"))
+		require.Nil(t, v.Rename("renamed", "renamed"))
+		require.Nil(t, v.Rename("empty", "renamed"))
+		require.Nil(t, v.Remove("a/b"))
+		content, err := v.ReadFile("renamed")
+		require.Nil(t, err)
+		assert.Equal(t, "not empty any more", string(content))
+		// Another client sees the same file system.
+		other := volume.New(metadata, blobs)
+		assert.Nil(t, fstest.TestFS(other, "a/large", "a/link", "renamed"))
+		entries, err := other.ReadDir(".")
+		require.Nil(t, err)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		assert.Equal(t, []string{"a", "renamed"}, names)
+	})
+	t.Run("attributes", func(t *testing.T) {
+		before, err := v.Lookup("a/large")
+		require.Nil(t, err)
+		mtime := time.Unix(1234567890, 0)
+		require.Nil(t, v.Chmod("a/large", 0640|fs.ModeSetgid))
+		require.Nil(t, v.Chtimes("a/large", mtime))
+		after, err := v.Lookup("a/large")
+		require.Nil(t, err)
+		assert.Equal(t, before.Key, after.Key)
+		assert.Equal(t, before.Version+2, after.Version)
+		info, err := v.Stat("a/large")
+		require.Nil(t, err)
+		assert.Equal(t, 0640|fs.ModeSetgid, info.Mode())
+		assert.True(t, mtime.Equal(info.ModTime()))
+	})
+	t.Run("conflicting changes are retried", func(t *testing.T) {
+		other := volume.New(metadata, blobs)
+		f, err := v.Create("a/conflict", 0644)
+		require.Nil(t, err)
+		_, _ = f.Write([]byte("mine"))
+		require.Nil(t, other.WriteFile("a/conflict", []byte("theirs"), 0644))
+		require.Nil(t, f.Close())
+		content, err := other.ReadFile("a/conflict")
+		require.Nil(t, err)
+		assert.Equal(t, "mine", string(content))
+	})
+}
+
+func TestQuotas(t *testing.T) {
+	metadata := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	blobs := storage.NewBlobStore(storage.NewInMemoryStore())
+	quotas := quota.NewTracker(metadata)
+	v := volume.New(metadata, blobs, volume.WithInlineThreshold(8), volume.WithOwner(1000, 100), volume.WithQuotas(quotas))
+	usage := func() quota.Counters {
+		t.Helper()
+		c, err := quotas.Usage(quota.Volume)
+		require.Nil(t, err)
+		u, err := quotas.Usage(quota.User(1000))
+		require.Nil(t, err)
+		assert.Equal(t, c, u)
+		return c
+	}
+
+	require.Nil(t, v.Mkdir("a", 0755))
+	require.Nil(t, v.WriteFile("a/tiny", []byte("inline"), 0644))
+	require.Nil(t, v.WriteFile("a/large", []byte("stored as a blob"), 0644))
+	require.Nil(t, v.Symlink("tiny", "a/link"))
+	assert.Equal(t, quota.Counters{Bytes: 6 + 16 + 4, Inodes: 4}, usage())
+
+	require.Nil(t, v.WriteFile("a/large", []byte("shorter"), 0644))
+	assert.Equal(t, quota.Counters{Bytes: 6 + 7 + 4, Inodes: 4}, usage())
+
+	require.Nil(t, v.Rename("a/tiny", "a/large"))
+	assert.Equal(t, quota.Counters{Bytes: 6 + 4, Inodes: 3}, usage())
+	require.Nil(t, v.Remove("a/link"))
+	assert.Equal(t, quota.Counters{Bytes: 6, Inodes: 2}, usage())
+
+	require.Nil(t, quotas.SetLimits(quota.User(1000), quota.Counters{Bytes: 10, Inodes: 3}))
+	assert.True(t, errors.Is(v.WriteFile("a/large", []byte("far too long"), 0644), syscall.EDQUOT))
+	require.Nil(t, v.WriteFile("a/large", []byte("fits"), 0644))
+	require.Nil(t, v.Mkdir("b", 0755))
+	assert.True(t, errors.Is(v.Mkdir("c", 0755), syscall.EDQUOT))
+	assert.Equal(t, quota.Counters{Bytes: 4, Inodes: 3}, usage())
+	content, err := v.ReadFile("a/large")
+	require.Nil(t, err)
+	assert.Equal(t, "fits", string(content))
+}
+
+func TestKeys(t *testing.T) {
+	metadata := storage.NewVersionedWrapper(storage.NewInMemoryStore())
+	blobs := storage.NewBlobStore(storage.NewInMemoryStore())
+	v := volume.New(metadata, blobs)
+
+	dir, err := v.CreateChild(volume.RootKey, "dir", volume.ModeDir|0755)
+	require.Nil(t, err)
+	file, err := v.CreateChild(dir.Key, "file", volume.ModeRegular|0644)
+	require.Nil(t, err)
+	_, err = v.CreateChild(dir.Key, "file", volume.ModeRegular|0644)
+	assert.True(t, errors.Is(err, fs.ErrExist))
+	_, err = v.CreateChild(dir.Key, "../escape", volume.ModeRegular|0644)
+	assert.True(t, errors.Is(err, fs.ErrInvalid))
+
+	// The keys keep referring to the same nodes after renames.
+	require.Nil(t, v.Rename("dir", "renamed"))
+	require.Nil(t, v.WriteFileKey(file.Key, []byte("content")))
+	require.Nil(t, v.ChmodKey(file.Key, 0600))
+	content, err := v.ReadFile("renamed/file")
+	require.Nil(t, err)
+	assert.Equal(t, "content", string(content))
+	info, err := v.StatKey(file.Key, "file")
+	require.Nil(t, err)
+	assert.Equal(t, "file", info.Name())
+	assert.Equal(t, int64(7), info.Size())
+	assert.Equal(t, fs.FileMode(0600), info.Mode())
+	entries, err := v.ReadDirKey(dir.Key)
+	require.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "file", entries[0].Name())
+	}
+
+	// Entries are renamed or removed only if they still refer to the node.
+	other, err := v.CreateChild(dir.Key, "other", volume.ModeRegular|0644)
+	require.Nil(t, err)
+	assert.True(t, errors.Is(v.RenameChild(dir.Key, "file", "moved", other.Key), fs.ErrNotExist))
+	require.Nil(t, v.RenameChild(dir.Key, "file", "moved", file.Key))
+	assert.True(t, errors.Is(v.RemoveChild(dir.Key, "moved", other.Key), fs.ErrNotExist))
+	require.Nil(t, v.RemoveChild(dir.Key, "moved", file.Key))
+	_, err = v.LookupChild(dir.Key, "moved")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	// Unlinked nodes remain readable.
+	content, err = v.ReadFileKey(file.Key)
+	require.Nil(t, err)
+	assert.Equal(t, "content", string(content))
+}